@@ -0,0 +1,404 @@
+// Package client is a Go client for kvstore that routes every request
+// straight to a replica of its key.
+//
+// The client keeps a copy of the cluster topology, places keys with the same
+// placement strategy as the nodes and sends each request to the first
+// reachable replica, which coordinates it. The topology is refreshed
+// periodically, whenever a node answers with a newer ring epoch and before
+// retrying a failed request.
+//
+//	c, err := client.New(client.Config{Endpoints: []string{"http://localhost:8001"}})
+//	if err != nil { ... }
+//	defer c.Close()
+//	err = c.Put(ctx, "", "greeting", "hello", nil)
+//	v, err := c.Get(ctx, "", "greeting")
+//	if errors.Is(err, client.ErrNotFound) { ... }
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"kvstore/model"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultTimeout         = 5 * time.Second
+	DefaultMaxRetries      = 3
+	DefaultRetryBackoff    = 100 * time.Millisecond
+	DefaultMaxRetryBackoff = 2 * time.Second
+	DefaultMaxConnsPerHost = 16
+	DefaultRefreshInterval = 30 * time.Second
+)
+
+// ringEpochHeader is the header nodes report their ring epoch in.
+const ringEpochHeader = "X-Ring-Epoch"
+
+// Error codes nodes send with error responses; see handler.ErrorCodeQuorum.
+const (
+	errorCodeQuorum         = "quorum_not_met"
+	errorCodeKeyNotFound    = "key_not_found"
+	errorCodeBucketNotFound = "bucket_not_found"
+)
+
+// Config configures a Client. Zero values mean the defaults above.
+type Config struct {
+	// Endpoints are the nodes the topology is first fetched from and the
+	// fallback when none of the known nodes answers.
+	Endpoints []string
+	// Timeout bounds every single HTTP request.
+	Timeout time.Duration
+	// MaxRetries is how many more rounds over a key's replicas are tried
+	// after the first one failed, waiting RetryBackoff before the first
+	// retry and doubling it up to MaxRetryBackoff. A negative value
+	// disables retries.
+	MaxRetries      int
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+	// MaxConnsPerHost is the number of idle connections kept per node.
+	MaxConnsPerHost int
+	// RefreshInterval is how often the topology is refreshed in the
+	// background. A negative value disables the background refresh.
+	RefreshInterval time.Duration
+}
+
+// Value is a stored value as returned by the cluster.
+type Value struct {
+	Bucket    string `json:"bucket"`
+	Key       string `json:"key"`
+	Value     string `json:"value"`
+	Timestamp int64  `json:"timestamp"`
+	ExpiresAt int64  `json:"expires_at,omitempty"`
+	Node      string `json:"node,omitempty"`
+}
+
+// PutOptions are optional settings of a write.
+type PutOptions struct {
+	// TTL expires the key after the given time, rounded down to seconds.
+	TTL time.Duration
+}
+
+// ScanPage is one page of a scan. Next is the cursor for the following
+// page, empty on the last one.
+type ScanPage struct {
+	Bucket string  `json:"bucket"`
+	Items  []Value `json:"items"`
+	Next   string  `json:"next,omitempty"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+type Client struct {
+	cfg  Config
+	http *http.Client
+
+	mu         sync.RWMutex
+	topo       *topology
+	refreshing bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// New creates a client and fetches the topology from the first reachable
+// endpoint.
+func New(cfg Config) (*Client, error) {
+	if len(cfg.Endpoints) == 0 {
+		return nil, errors.New("kvstore: no endpoints configured")
+	}
+	cfg.Endpoints = append([]string(nil), cfg.Endpoints...)
+	for i, endpoint := range cfg.Endpoints {
+		if !strings.Contains(endpoint, "://") {
+			endpoint = "http://" + endpoint
+		}
+		cfg.Endpoints[i] = strings.TrimRight(endpoint, "/")
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = DefaultMaxRetries
+	}
+	if cfg.RetryBackoff <= 0 {
+		cfg.RetryBackoff = DefaultRetryBackoff
+	}
+	if cfg.MaxRetryBackoff <= 0 {
+		cfg.MaxRetryBackoff = DefaultMaxRetryBackoff
+	}
+	if cfg.MaxConnsPerHost <= 0 {
+		cfg.MaxConnsPerHost = DefaultMaxConnsPerHost
+	}
+	if cfg.RefreshInterval == 0 {
+		cfg.RefreshInterval = DefaultRefreshInterval
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = cfg.MaxConnsPerHost
+	c := &Client{
+		cfg:  cfg,
+		http: &http.Client{Timeout: cfg.Timeout, Transport: transport},
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+	if err := c.Refresh(ctx); err != nil {
+		return nil, err
+	}
+	go c.refreshLoop()
+	return c, nil
+}
+
+// Close stops the background refresh and closes idle connections.
+func (c *Client) Close() {
+	close(c.stop)
+	<-c.done
+	c.http.CloseIdleConnections()
+}
+
+func (c *Client) refreshLoop() {
+	defer close(c.done)
+	if c.cfg.RefreshInterval < 0 {
+		<-c.stop
+		return
+	}
+	ticker := time.NewTicker(c.cfg.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), c.cfg.Timeout)
+			c.Refresh(ctx)
+			cancel()
+		}
+	}
+}
+
+// Refresh fetches the topology from the known nodes, falling back to the
+// configured endpoints. An older topology than the current one is ignored.
+func (c *Client) Refresh(ctx context.Context) error {
+	var candidates []string
+	c.mu.RLock()
+	if c.topo != nil {
+		candidates = c.topo.addresses()
+	}
+	c.mu.RUnlock()
+	candidates = append(candidates, c.cfg.Endpoints...)
+
+	var lastErr error
+	for _, address := range candidates {
+		topo, err := c.fetchTopology(ctx, address)
+		if err != nil {
+			lastErr = err
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		c.mu.Lock()
+		if c.topo == nil || topo.epoch >= c.topo.epoch {
+			c.topo = topo
+		}
+		c.mu.Unlock()
+		return nil
+	}
+	return fmt.Errorf("%w: %v", ErrNoNodes, lastErr)
+}
+
+// refreshAsync refreshes the topology in the background unless a refresh is
+// already running.
+func (c *Client) refreshAsync() {
+	c.mu.Lock()
+	if c.refreshing {
+		c.mu.Unlock()
+		return
+	}
+	c.refreshing = true
+	c.mu.Unlock()
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), c.cfg.Timeout)
+		c.Refresh(ctx)
+		cancel()
+		c.mu.Lock()
+		c.refreshing = false
+		c.mu.Unlock()
+	}()
+}
+
+// Epoch returns the ring epoch of the client's topology.
+func (c *Client) Epoch() uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.topo.epoch
+}
+
+// Replicas returns the addresses of a key's replicas in the order the
+// client tries them.
+func (c *Client) Replicas(bucket string, key string) []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.topo.replicas(normalizeBucket(bucket), key)
+}
+
+// route returns the nodes to try for a key: its replicas, or any node if
+// the topology does not place the key anywhere yet.
+func (c *Client) route(bucket string, key string) []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if addresses := c.topo.replicas(bucket, key); len(addresses) > 0 {
+		return addresses
+	}
+	if addresses := c.topo.addresses(); len(addresses) > 0 {
+		return addresses
+	}
+	return c.cfg.Endpoints
+}
+
+func normalizeBucket(bucket string) string {
+	if bucket == "" {
+		return model.DefaultBucket
+	}
+	return bucket
+}
+
+// Get reads a key. It returns ErrNotFound if the key does not exist.
+func (c *Client) Get(ctx context.Context, bucket string, key string) (*Value, error) {
+	return c.do(ctx, "get", http.MethodGet, bucket, key, nil)
+}
+
+// Put writes a key.
+func (c *Client) Put(ctx context.Context, bucket string, key string, value string, opts *PutOptions) (*Value, error) {
+	query := url.Values{}
+	query.Set("value", value)
+	if opts != nil && opts.TTL > 0 {
+		query.Set("ttl", strconv.FormatInt(int64(opts.TTL/time.Second), 10))
+	}
+	return c.do(ctx, "put", http.MethodPost, bucket, key, query)
+}
+
+// Delete deletes a key. Deleting a key that does not exist succeeds.
+func (c *Client) Delete(ctx context.Context, bucket string, key string) error {
+	_, err := c.do(ctx, "delete", http.MethodDelete, bucket, key, nil)
+	return err
+}
+
+// Scan lists up to limit keys of a bucket starting with prefix, after the
+// cursor after. Pass the returned page's Next as after to continue.
+func (c *Client) Scan(ctx context.Context, bucket string, prefix string, after string, limit int) (*ScanPage, error) {
+	query := url.Values{}
+	query.Set("bucket", normalizeBucket(bucket))
+	query.Set("prefix", prefix)
+	query.Set("after", after)
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	var lastErr error = ErrNoNodes
+	for _, address := range c.route("", "") {
+		var page ScanPage
+		err := c.send(ctx, http.MethodGet, address+"/kv/scan?"+query.Encode(), &page)
+		if err == nil {
+			return &page, nil
+		}
+		if !retryable(err) || ctx.Err() != nil {
+			return nil, err
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// do runs a key operation against the key's replicas, retrying with backoff
+// and a fresh topology while the failure may be transient.
+func (c *Client) do(ctx context.Context, op string, method string, bucket string, key string, query url.Values) (*Value, error) {
+	bucket = normalizeBucket(bucket)
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("bucket", bucket)
+	query.Set("key", key)
+
+	backoff := c.cfg.RetryBackoff
+	var lastErr error = ErrNoNodes
+	for attempt := 0; attempt <= c.cfg.MaxRetries || attempt == 0; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > c.cfg.MaxRetryBackoff {
+				backoff = c.cfg.MaxRetryBackoff
+			}
+			c.Refresh(ctx)
+		}
+		for _, address := range c.route(bucket, key) {
+			var value Value
+			err := c.send(ctx, method, address+"/kv?"+query.Encode(), &value)
+			if err == nil {
+				return &value, nil
+			}
+			var quorum *QuorumError
+			if errors.As(err, &quorum) {
+				quorum.Op, quorum.Key = op, key
+			}
+			if !retryable(err) || ctx.Err() != nil {
+				return nil, err
+			}
+			lastErr = err
+		}
+	}
+	return nil, lastErr
+}
+
+// send performs one request and decodes a successful response into out.
+func (c *Client) send(ctx context.Context, method string, target string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, target, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if raw := resp.Header.Get(ringEpochHeader); raw != "" {
+		if epoch, err := strconv.ParseUint(raw, 10, 64); err == nil && epoch > c.Epoch() {
+			c.refreshAsync()
+		}
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return json.Unmarshal(body, out)
+	}
+
+	var errResp errorResponse
+	if json.Unmarshal(body, &errResp) != nil || errResp.Error == "" {
+		errResp.Error = strings.TrimSpace(string(body))
+	}
+	switch errResp.Code {
+	case errorCodeQuorum:
+		return &QuorumError{Message: errResp.Error}
+	case errorCodeKeyNotFound:
+		return ErrNotFound
+	case errorCodeBucketNotFound:
+		return ErrBucketNotFound
+	}
+	return &APIError{StatusCode: resp.StatusCode, Code: errResp.Code, Message: errResp.Error}
+}
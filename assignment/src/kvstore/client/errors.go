@@ -0,0 +1,52 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNotFound is returned when a key does not exist or was deleted.
+var ErrNotFound = errors.New("kvstore: key not found")
+
+// ErrBucketNotFound is returned when the bucket of a key does not exist.
+var ErrBucketNotFound = errors.New("kvstore: bucket not found")
+
+// ErrNoNodes is returned when no node of the cluster could be reached.
+var ErrNoNodes = errors.New("kvstore: no node reachable")
+
+// QuorumError is returned when too few replicas of a key answered. The
+// operation may have been applied on some replicas; retrying a write is
+// safe because a retry only produces a newer version of the same value.
+type QuorumError struct {
+	Op      string
+	Key     string
+	Message string
+}
+
+func (e *QuorumError) Error() string {
+	return fmt.Sprintf("kvstore: %s %s: %s", e.Op, e.Key, e.Message)
+}
+
+// APIError is any other error response from a node.
+type APIError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("kvstore: status %d: %s", e.StatusCode, e.Message)
+}
+
+// retryable reports whether another replica or a later attempt may succeed.
+func retryable(err error) bool {
+	var quorum *QuorumError
+	if errors.As(err, &quorum) {
+		return true
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode >= 500
+	}
+	return !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrBucketNotFound)
+}
@@ -0,0 +1,102 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"kvstore/hash"
+	"kvstore/model"
+	"net/http"
+)
+
+// topology is the client's copy of the cluster layout, rebuilt from scratch
+// whenever the ring epoch changes.
+type topology struct {
+	epoch     uint64
+	placement hash.Placement
+	nodes     map[string]string
+	buckets   map[string]int
+}
+
+// topologyResponse mirrors the /cluster/topology response.
+type topologyResponse struct {
+	Epoch       uint64            `json:"epoch"`
+	Placement   string            `json:"placement"`
+	LoadEpsilon float64           `json:"load_epsilon"`
+	Ring        model.RingState   `json:"ring"`
+	Nodes       map[string]string `json:"nodes"`
+	Buckets     map[string]int    `json:"buckets"`
+}
+
+func newTopology(resp topologyResponse) (*topology, error) {
+	placement, err := hash.NewPlacement(resp.Placement, 1)
+	if err != nil {
+		return nil, err
+	}
+	if ring, ok := placement.(*hash.HashRing); ok {
+		ring.SetBoundedLoad(resp.LoadEpsilon)
+	}
+	for _, id := range resp.Ring.ActiveMembers() {
+		placement.AddWeightedNode(id, resp.Ring.VnodesOf(id))
+	}
+	if zoneAware, ok := placement.(hash.ZoneAware); ok {
+		zoneAware.SetZones(resp.Ring.Zones())
+	}
+	if ordered, ok := placement.(hash.Ordered); ok {
+		ordered.SetJoinOrder(resp.Ring.JoinOrder())
+	}
+	return &topology{
+		epoch:     resp.Epoch,
+		placement: placement,
+		nodes:     resp.Nodes,
+		buckets:   resp.Buckets,
+	}, nil
+}
+
+// replicas returns the addresses of a key's replicas in preference order.
+func (t *topology) replicas(bucket string, key string) []string {
+	replicas, ok := t.buckets[bucket]
+	if !ok {
+		replicas = t.buckets[model.DefaultBucket]
+	}
+	placementKey := key
+	if bucket != model.DefaultBucket {
+		placementKey = bucket + "/" + key
+	}
+	var addresses []string
+	for _, id := range t.placement.GetNodesForKey(placementKey, replicas) {
+		if address, ok := t.nodes[id]; ok {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+// addresses returns every known node address.
+func (t *topology) addresses() []string {
+	var addresses []string
+	for _, address := range t.nodes {
+		addresses = append(addresses, address)
+	}
+	return addresses
+}
+
+func (c *Client) fetchTopology(ctx context.Context, address string) (*topology, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, address+"/cluster/topology", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned status %d", address, resp.StatusCode)
+	}
+	var topo topologyResponse
+	if err := json.NewDecoder(resp.Body).Decode(&topo); err != nil {
+		return nil, fmt.Errorf("decode topology from %s: %w", address, err)
+	}
+	return newTopology(topo)
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"kvstore/handler"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var commands = map[string]command{
+	"get":          {"<key>", "read a key", runGet},
+	"put":          {"[-ttl seconds] <key> <value>", "write a key", runPut},
+	"delete":       {"<key>", "delete a key", runDelete},
+	"scan":         {"[-prefix p] [-limit n] [-all]", "list keys in key order", runScan},
+	"import":       {"[-parallel n] <file|->", "write key=value or JSON lines from a file", runImport},
+	"members":      {"", "show cluster membership and liveness", runMembers},
+	"ring":         {"", "show ring ownership per node", runRing},
+	"tokens":       {"[-node id]", "show the ring's vnodes", runTokens},
+	"replicas":     {"<key>", "show the replicas of a key in preference order", runReplicas},
+	"transfers":    {"[-node url] [-state s]", "show rebalancing transfers of a node", runTransfers},
+	"evict":        {"<node id>", "force a node out of the ring", runMemberAction("evict", "remove")},
+	"readmit":      {"<node id>", "put an evicted node back into the ring", runMemberAction("readmit", "add")},
+	"decommission": {"[-node url] [-status]", "hand off a node's data and remove it", runDecommission},
+	"cleanup":      {"[-node url] [-run]", "show or run the cleanup of unowned keys", runCleanup},
+}
+
+// parse parses a command's flags and checks the number of arguments left.
+func parse(flags *flag.FlagSet, args []string, want int) ([]string, error) {
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if flags.NArg() != want {
+		return nil, fmt.Errorf("%s takes %d argument(s), got %d", flags.Name(), want, flags.NArg())
+	}
+	return flags.Args(), nil
+}
+
+func (c *ctl) keyQuery(key string) url.Values {
+	query := url.Values{}
+	query.Set("key", key)
+	if c.bucket != "" {
+		query.Set("bucket", c.bucket)
+	}
+	return query
+}
+
+// nodeEndpoints returns the endpoint a node-local command should use: the
+// -node flag if given, otherwise the configured endpoints.
+func (c *ctl) nodeEndpoints(node string) []string {
+	if node == "" {
+		return c.endpoints
+	}
+	if !strings.Contains(node, "://") {
+		node = "http://" + node
+	}
+	return []string{strings.TrimRight(node, "/")}
+}
+
+func (c *ctl) printValues(values ...handler.KVResponse) error {
+	var rows [][]string
+	for _, v := range values {
+		expires := "-"
+		if v.ExpiresAt != 0 {
+			expires = formatTimestamp(v.ExpiresAt)
+		}
+		rows = append(rows, []string{v.Bucket, v.Key, v.Value, formatTimestamp(v.Timestamp), expires})
+	}
+	if len(values) == 1 {
+		return c.print(values[0], []string{"BUCKET", "KEY", "VALUE", "WRITTEN", "EXPIRES"}, rows)
+	}
+	return c.print(values, []string{"BUCKET", "KEY", "VALUE", "WRITTEN", "EXPIRES"}, rows)
+}
+
+func runGet(c *ctl, args []string) error {
+	args, err := parse(flag.NewFlagSet("get", flag.ExitOnError), args, 1)
+	if err != nil {
+		return err
+	}
+	var value handler.KVResponse
+	if err := c.do(http.MethodGet, "/kv", c.keyQuery(args[0]), nil, &value); err != nil {
+		if isNotFound(err) {
+			return fmt.Errorf("key %q not found", args[0])
+		}
+		return err
+	}
+	return c.printValues(value)
+}
+
+func runPut(c *ctl, args []string) error {
+	flags := flag.NewFlagSet("put", flag.ExitOnError)
+	ttl := flags.Int("ttl", 0, "expire the key after this many seconds")
+	args, err := parse(flags, args, 2)
+	if err != nil {
+		return err
+	}
+	value, err := c.put(args[0], args[1], *ttl)
+	if err != nil {
+		return err
+	}
+	return c.printValues(value)
+}
+
+func (c *ctl) put(key string, value string, ttl int) (handler.KVResponse, error) {
+	query := c.keyQuery(key)
+	query.Set("value", value)
+	if ttl > 0 {
+		query.Set("ttl", strconv.Itoa(ttl))
+	}
+	var written handler.KVResponse
+	err := c.do(http.MethodPost, "/kv", query, nil, &written)
+	return written, err
+}
+
+func runDelete(c *ctl, args []string) error {
+	args, err := parse(flag.NewFlagSet("delete", flag.ExitOnError), args, 1)
+	if err != nil {
+		return err
+	}
+	var deleted handler.KVResponse
+	if err := c.do(http.MethodDelete, "/kv", c.keyQuery(args[0]), nil, &deleted); err != nil {
+		return err
+	}
+	row := []string{deleted.Bucket, deleted.Key, formatTimestamp(deleted.Timestamp)}
+	return c.print(deleted, []string{"BUCKET", "KEY", "DELETED"}, [][]string{row})
+}
+
+func runScan(c *ctl, args []string) error {
+	flags := flag.NewFlagSet("scan", flag.ExitOnError)
+	prefix := flags.String("prefix", "", "only keys starting with this prefix")
+	limit := flags.Int("limit", handler.DefaultScanLimit, "keys per page")
+	after := flags.String("after", "", "start after this key")
+	all := flags.Bool("all", false, "follow the cursor until every key is listed")
+	if _, err := parse(flags, args, 0); err != nil {
+		return err
+	}
+	query := url.Values{}
+	if c.bucket != "" {
+		query.Set("bucket", c.bucket)
+	}
+	query.Set("prefix", *prefix)
+	query.Set("limit", strconv.Itoa(*limit))
+
+	result := handler.ScanResponse{Items: []handler.KVResponse{}}
+	cursor := *after
+	for {
+		query.Set("after", cursor)
+		var page handler.ScanResponse
+		if err := c.do(http.MethodGet, "/kv/scan", query, nil, &page); err != nil {
+			return err
+		}
+		result.Bucket = page.Bucket
+		result.Items = append(result.Items, page.Items...)
+		result.Next = page.Next
+		result.Unreachable = page.Unreachable
+		if len(page.Unreachable) > 0 {
+			fmt.Fprintf(os.Stderr, "Warning: nodes not scanned: %s\n", strings.Join(page.Unreachable, ", "))
+		}
+		if !*all || page.Next == "" {
+			break
+		}
+		cursor = page.Next
+	}
+	if c.output == "json" {
+		return c.print(result, nil, nil)
+	}
+	if err := c.printValues(result.Items...); err != nil {
+		return err
+	}
+	if result.Next != "" {
+		fmt.Fprintf(os.Stderr, "More keys follow, continue with -after %q\n", result.Next)
+	}
+	return nil
+}
+
+// importRecord is one line of an import file: either key=value or a JSON
+// object with key, value and optionally bucket and ttl.
+type importRecord struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	TTL    int    `json:"ttl"`
+}
+
+func parseImportLine(line string) (importRecord, error) {
+	var record importRecord
+	if strings.HasPrefix(line, "{") {
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			return record, err
+		}
+	} else {
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return record, fmt.Errorf("expected key=value")
+		}
+		record.Key, record.Value = strings.TrimSpace(key), value
+	}
+	if record.Key == "" || record.Value == "" {
+		return record, fmt.Errorf("key and value must not be empty")
+	}
+	return record, nil
+}
+
+func runImport(c *ctl, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	parallel := flags.Int("parallel", 4, "concurrent writes")
+	args, err := parse(flags, args, 1)
+	if err != nil {
+		return err
+	}
+	if *parallel < 1 {
+		return fmt.Errorf("-parallel must be at least 1")
+	}
+	input := os.Stdin
+	if args[0] != "-" {
+		if input, err = os.Open(args[0]); err != nil {
+			return err
+		}
+		defer input.Close()
+	}
+
+	type job struct {
+		line   int
+		record importRecord
+	}
+	jobs := make(chan job)
+	var mu sync.Mutex
+	var written, failed int
+	var wg sync.WaitGroup
+	for i := 0; i < *parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				target := *c
+				if j.record.Bucket != "" {
+					target.bucket = j.record.Bucket
+				}
+				_, err := target.put(j.record.Key, j.record.Value, j.record.TTL)
+				mu.Lock()
+				if err != nil {
+					failed++
+					fmt.Fprintf(os.Stderr, "Line %d (%s): %v\n", j.line, j.record.Key, err)
+				} else {
+					written++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		record, err := parseImportLine(line)
+		if err != nil {
+			mu.Lock()
+			failed++
+			mu.Unlock()
+			fmt.Fprintf(os.Stderr, "Line %d: %v\n", lineNo, err)
+			continue
+		}
+		jobs <- job{line: lineNo, record: record}
+	}
+	close(jobs)
+	wg.Wait()
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	summary := map[string]int{"written": written, "failed": failed}
+	if err := c.print(summary, []string{"WRITTEN", "FAILED"}, [][]string{{strconv.Itoa(written), strconv.Itoa(failed)}}); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d records failed", failed)
+	}
+	return nil
+}
+
+func runMembers(c *ctl, args []string) error {
+	if _, err := parse(flag.NewFlagSet("members", flag.ExitOnError), args, 0); err != nil {
+		return err
+	}
+	var members []handler.MemberStatus
+	if err := c.do(http.MethodGet, "/admin/peers", nil, nil, &members); err != nil {
+		return err
+	}
+	var rows [][]string
+	for _, m := range members {
+		ring := "yes"
+		if m.Evicted {
+			ring = "evicted"
+		} else if !m.InRing {
+			ring = "no"
+		}
+		phi := "-"
+		if !m.Self {
+			phi = strconv.FormatFloat(m.Phi, 'f', 2, 64)
+		}
+		url := m.URL
+		if m.Self {
+			url += " (self)"
+		}
+		rows = append(rows, []string{m.ID, url, m.State, orDash(m.Zone), strconv.Itoa(m.Vnodes), ring, phi})
+	}
+	return c.print(members, []string{"ID", "URL", "STATE", "ZONE", "VNODES", "IN RING", "PHI"}, rows)
+}
+
+func runRing(c *ctl, args []string) error {
+	if _, err := parse(flag.NewFlagSet("ring", flag.ExitOnError), args, 0); err != nil {
+		return err
+	}
+	var ownership []handler.OwnershipResponse
+	if err := c.do(http.MethodGet, "/admin/ownership", nil, nil, &ownership); err != nil {
+		return err
+	}
+	var rows [][]string
+	for _, o := range ownership {
+		rows = append(rows, []string{o.ID, o.URL, orDash(o.Zone), strconv.Itoa(o.Weight), fmt.Sprintf("%.2f%%", o.Ownership)})
+	}
+	return c.print(ownership, []string{"ID", "URL", "ZONE", "WEIGHT", "OWNERSHIP"}, rows)
+}
+
+func runTokens(c *ctl, args []string) error {
+	flags := flag.NewFlagSet("tokens", flag.ExitOnError)
+	node := flags.String("node", "", "only the vnodes of this node id")
+	if _, err := parse(flags, args, 0); err != nil {
+		return err
+	}
+	query := url.Values{}
+	if *node != "" {
+		query.Set("node", *node)
+	}
+	var vnodes []handler.VnodeResponse
+	if err := c.do(http.MethodGet, "/admin/tokens", query, nil, &vnodes); err != nil {
+		return err
+	}
+	var rows [][]string
+	for _, v := range vnodes {
+		rows = append(rows, []string{strconv.FormatUint(uint64(v.Token), 10), v.Node, fmt.Sprintf("%.3f%%", v.Ownership)})
+	}
+	return c.print(vnodes, []string{"TOKEN", "NODE", "OWNERSHIP"}, rows)
+}
+
+func runReplicas(c *ctl, args []string) error {
+	args, err := parse(flag.NewFlagSet("replicas", flag.ExitOnError), args, 1)
+	if err != nil {
+		return err
+	}
+	var pref handler.PreferenceResponse
+	if err := c.do(http.MethodGet, "/admin/preference", c.keyQuery(args[0]), nil, &pref); err != nil {
+		return err
+	}
+	var rows [][]string
+	for i, r := range pref.Replicas {
+		rows = append(rows, []string{strconv.Itoa(i + 1), r.ID, r.URL, r.State, orDash(r.Zone)})
+	}
+	if c.output == "table" {
+		fmt.Fprintf(c.out, "%s/%s token %d\n", pref.Bucket, pref.Key, pref.Token)
+	}
+	return c.print(pref, []string{"#", "ID", "URL", "STATE", "ZONE"}, rows)
+}
+
+func runTransfers(c *ctl, args []string) error {
+	flags := flag.NewFlagSet("transfers", flag.ExitOnError)
+	node := flags.String("node", "", "node to ask (default the first endpoint)")
+	state := flags.String("state", "", "only transfers in this state: running, queued, done or failed")
+	if _, err := parse(flags, args, 0); err != nil {
+		return err
+	}
+	query := url.Values{}
+	if *state != "" {
+		query.Set("state", *state)
+	}
+	var transfers []handler.Transfer
+	if err := c.doOn(c.nodeEndpoints(*node), http.MethodGet, "/admin/transfers", query, nil, &transfers); err != nil {
+		return err
+	}
+	var rows [][]string
+	for _, t := range transfers {
+		rows = append(rows, []string{
+			t.ID, shortID(t.Target), string(t.State),
+			fmt.Sprintf("%d/%d", t.KeysSent, t.KeysTotal),
+			strconv.FormatInt(t.BytesSent, 10), strconv.Itoa(t.Attempts), orDash(t.Error),
+		})
+	}
+	return c.print(transfers, []string{"ID", "TARGET", "STATE", "KEYS", "BYTES", "ATTEMPTS", "ERROR"}, rows)
+}
+
+func runMemberAction(name string, action string) func(c *ctl, args []string) error {
+	return func(c *ctl, args []string) error {
+		args, err := parse(flag.NewFlagSet(name, flag.ExitOnError), args, 1)
+		if err != nil {
+			return err
+		}
+		var member handler.MemberStatus
+		req := handler.MemberActionRequest{ID: args[0], Action: action}
+		if err := c.do(http.MethodPost, "/admin/members", nil, req, &member); err != nil {
+			return err
+		}
+		row := []string{member.ID, member.URL, member.State, strconv.FormatBool(member.InRing)}
+		return c.print(member, []string{"ID", "URL", "STATE", "IN RING"}, [][]string{row})
+	}
+}
+
+func runDecommission(c *ctl, args []string) error {
+	flags := flag.NewFlagSet("decommission", flag.ExitOnError)
+	node := flags.String("node", "", "node to decommission (default the first endpoint)")
+	status := flags.Bool("status", false, "only show the decommission status")
+	if _, err := parse(flags, args, 0); err != nil {
+		return err
+	}
+	endpoints := c.nodeEndpoints(*node)
+	if *node == "" && !*status {
+		// Never fail over to another node: that would decommission it instead.
+		endpoints = endpoints[:1]
+	}
+	method := http.MethodPost
+	if *status {
+		method = http.MethodGet
+	}
+	var resp handler.DecommissionStatus
+	if err := c.doOn(endpoints, method, "/admin/decommission", nil, nil, &resp); err != nil {
+		return err
+	}
+	started := "-"
+	if !resp.StartedAt.IsZero() {
+		started = resp.StartedAt.UTC().Format("2006-01-02T15:04:05Z")
+	}
+	row := []string{string(resp.State), started, strconv.Itoa(resp.KeysSent), strconv.Itoa(resp.Errors)}
+	return c.print(resp, []string{"STATE", "STARTED", "KEYS SENT", "ERRORS"}, [][]string{row})
+}
+
+func runCleanup(c *ctl, args []string) error {
+	flags := flag.NewFlagSet("cleanup", flag.ExitOnError)
+	node := flags.String("node", "", "node to ask (default the first endpoint)")
+	run := flags.Bool("run", false, "start a cleanup run now")
+	if _, err := parse(flags, args, 0); err != nil {
+		return err
+	}
+	method := http.MethodGet
+	if *run {
+		method = http.MethodPost
+	}
+	var report handler.CleanupReport
+	if err := c.doOn(c.nodeEndpoints(*node), method, "/admin/cleanup", nil, nil, &report); err != nil {
+		return err
+	}
+	removed := strconv.Itoa(report.Removed)
+	if report.DryRun {
+		removed = fmt.Sprintf("%d (dry run)", len(report.WouldRemove))
+	}
+	row := []string{
+		report.StartedAt.UTC().Format("2006-01-02T15:04:05Z"), orDash(report.Skipped),
+		strconv.Itoa(report.Scanned), strconv.Itoa(report.Unowned), strconv.Itoa(report.Waiting),
+		strconv.Itoa(report.Unconfirmed), removed, strconv.Itoa(report.Tombstones),
+	}
+	return c.print(report, []string{"STARTED", "SKIPPED", "SCANNED", "UNOWNED", "WAITING", "UNCONFIRMED", "REMOVED", "TOMBSTONES"}, [][]string{row})
+}
@@ -0,0 +1,229 @@
+// Command kvctl reads and writes keys and administers a kvstore cluster.
+//
+// Usage:
+//
+//	kvctl [flags] <command> [arguments]
+//
+// Requests go to the first reachable node of -endpoints (or KVCTL_ENDPOINTS).
+// Admin commands send -token (or KVCTL_TOKEN) as a bearer token.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type ctl struct {
+	endpoints []string
+	token     string
+	output    string
+	bucket    string
+	client    *http.Client
+	out       io.Writer
+}
+
+// apiError is an error response from a node.
+type apiError struct {
+	Status  int
+	Message string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%s (%d)", e.Message, e.Status)
+}
+
+type command struct {
+	args    string
+	summary string
+	run     func(c *ctl, args []string) error
+}
+
+func main() {
+	flags := flag.NewFlagSet("kvctl", flag.ExitOnError)
+	endpoints := flags.String("endpoints", envOr("KVCTL_ENDPOINTS", "http://localhost:8001"), "comma separated node URLs, tried in order")
+	token := flags.String("token", "", "admin bearer token (default $KVCTL_TOKEN)")
+	output := flags.String("o", "table", "output format: table or json")
+	bucket := flags.String("bucket", "", "bucket for key commands (default bucket if empty)")
+	timeout := flags.Duration("timeout", 10*time.Second, "timeout of each request")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: kvctl [flags] <command> [arguments]\n\nCommands:")
+		var names []string
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		w := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+		for _, name := range names {
+			fmt.Fprintf(w, "  %s %s\t%s\n", name, commands[name].args, commands[name].summary)
+		}
+		w.Flush()
+		fmt.Fprintln(os.Stderr, "\nFlags:")
+		flags.PrintDefaults()
+	}
+	flags.Parse(os.Args[1:])
+	if *token == "" {
+		*token = os.Getenv("KVCTL_TOKEN")
+	}
+
+	if *output != "table" && *output != "json" {
+		fmt.Fprintln(os.Stderr, "-o must be table or json")
+		os.Exit(2)
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flags.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", flags.Arg(0))
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	c := &ctl{
+		token:  *token,
+		output: *output,
+		bucket: *bucket,
+		client: &http.Client{Timeout: *timeout},
+		out:    os.Stdout,
+	}
+	for _, endpoint := range strings.Split(*endpoints, ",") {
+		if endpoint = strings.TrimSpace(endpoint); endpoint != "" {
+			if !strings.Contains(endpoint, "://") {
+				endpoint = "http://" + endpoint
+			}
+			c.endpoints = append(c.endpoints, strings.TrimRight(endpoint, "/"))
+		}
+	}
+	if len(c.endpoints) == 0 {
+		fmt.Fprintln(os.Stderr, "No endpoints given")
+		os.Exit(2)
+	}
+
+	if err := cmd.run(c, flags.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
+
+func envOr(name string, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// do sends a request to the first endpoint that answers and decodes the JSON
+// response into out. Only connection errors move on to the next endpoint; an
+// error response from a node is returned as an *apiError.
+func (c *ctl) do(method string, path string, query url.Values, body interface{}, out interface{}) error {
+	return c.doOn(c.endpoints, method, path, query, body, out)
+}
+
+func (c *ctl) doOn(endpoints []string, method string, path string, query url.Values, body interface{}, out interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	var lastErr error
+	for _, endpoint := range endpoints {
+		target := endpoint + path
+		if len(query) > 0 {
+			target += "?" + query.Encode()
+		}
+		req, err := http.NewRequest(method, target, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if c.token != "" && strings.HasPrefix(path, "/admin/") {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		resp, err := c.client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		err = decodeResponse(resp, out)
+		resp.Body.Close()
+		return err
+	}
+	return fmt.Errorf("no endpoint reachable: %w", lastErr)
+}
+
+func decodeResponse(resp *http.Response, out interface{}) error {
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		var errResp struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &errResp) != nil || errResp.Error == "" {
+			errResp.Error = strings.TrimSpace(string(data))
+		}
+		return &apiError{Status: resp.StatusCode, Message: errResp.Error}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+func isNotFound(err error) bool {
+	var apiErr *apiError
+	return errors.As(err, &apiErr) && apiErr.Status == http.StatusNotFound
+}
+
+// print writes v as JSON or, in table form, the given rows under headers.
+func (c *ctl) print(v interface{}, headers []string, rows [][]string) error {
+	if c.output == "json" {
+		enc := json.NewEncoder(c.out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(headers, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+func formatTimestamp(nanos int64) string {
+	if nanos == 0 {
+		return "-"
+	}
+	return time.Unix(0, nanos).UTC().Format(time.RFC3339)
+}
+
+func shortID(id string) string {
+	if len(id) > 8 {
+		return id[:8]
+	}
+	return id
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
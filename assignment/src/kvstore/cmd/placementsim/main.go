@@ -0,0 +1,178 @@
+// Command placementsim compares placement strategies by simulating a cluster
+// and reporting how evenly keys are spread and how many keys change replicas
+// when a node joins or leaves.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"kvstore/hash"
+	"kvstore/logging"
+	"log/slog"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type result struct {
+	strategy     string
+	maxOverMean  float64
+	stdDevPct    float64
+	joinMoved    float64
+	joinPrimary  float64
+	leaveMoved   float64
+	leavePrimary float64
+	zoneSpread   float64
+}
+
+func newPlacement(strategy string, nodes int, weight int, zones int) (hash.Placement, error) {
+	p, err := hash.NewPlacement(strategy, weight)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < nodes; i++ {
+		p.AddWeightedNode(nodeName(i), weight)
+	}
+	if zoneAware, ok := p.(hash.ZoneAware); ok && zones > 0 {
+		// The joining node, nodeName(nodes), gets a zone as well.
+		assigned := make(map[string]string)
+		for i := 0; i <= nodes; i++ {
+			assigned[nodeName(i)] = zoneName(i, zones)
+		}
+		zoneAware.SetZones(assigned)
+	}
+	return p, nil
+}
+
+func zoneName(i int, zones int) string {
+	return "zone-" + strconv.Itoa(i%zones)
+}
+
+// zoneSpread returns the fraction of keys whose replicas span as many zones
+// as possible.
+func zoneSpread(placed [][]string, zones int) float64 {
+	if zones == 0 {
+		return 0
+	}
+	var spread int
+	for _, replicas := range placed {
+		distinct := make(map[string]bool)
+		for _, node := range replicas {
+			i, _ := strconv.Atoi(strings.TrimPrefix(node, "node-"))
+			distinct[zoneName(i, zones)] = true
+		}
+		if len(distinct) == int(math.Min(float64(zones), float64(len(replicas)))) {
+			spread++
+		}
+	}
+	return float64(spread) / float64(len(placed))
+}
+
+func nodeName(i int) string {
+	return "node-" + strconv.Itoa(i)
+}
+
+func placeAll(p hash.Placement, keys int, replicas int) [][]string {
+	placed := make([][]string, keys)
+	for i := range placed {
+		placed[i] = p.GetNodesForKey("key-"+strconv.Itoa(i), replicas)
+	}
+	return placed
+}
+
+// moved returns the fraction of replicas that changed node and the fraction
+// of keys whose primary changed.
+func moved(before [][]string, after [][]string) (float64, float64) {
+	var replicas, changed, primaries int
+	for i := range before {
+		holders := make(map[string]bool, len(after[i]))
+		for _, node := range after[i] {
+			holders[node] = true
+		}
+		for _, node := range before[i] {
+			replicas++
+			if !holders[node] {
+				changed++
+			}
+		}
+		if len(before[i]) > 0 && len(after[i]) > 0 && before[i][0] != after[i][0] {
+			primaries++
+		}
+	}
+	return float64(changed) / float64(replicas), float64(primaries) / float64(len(before))
+}
+
+func balance(placed [][]string, nodes int) (float64, float64) {
+	counts := make(map[string]float64)
+	for _, replicas := range placed {
+		for _, node := range replicas {
+			counts[node]++
+		}
+	}
+	var total, max float64
+	for _, count := range counts {
+		total += count
+		max = math.Max(max, count)
+	}
+	mean := total / float64(nodes)
+	var variance float64
+	for i := 0; i < nodes; i++ {
+		diff := counts[nodeName(i)] - mean
+		variance += diff * diff
+	}
+	return max / mean, 100 * math.Sqrt(variance/float64(nodes)) / mean
+}
+
+func simulate(strategy string, nodes int, keys int, replicas int, weight int, zones int) (result, error) {
+	p, err := newPlacement(strategy, nodes, weight, zones)
+	if err != nil {
+		return result{}, err
+	}
+	before := placeAll(p, keys, replicas)
+	res := result{strategy: strategy}
+	res.maxOverMean, res.stdDevPct = balance(before, nodes)
+	res.zoneSpread = zoneSpread(before, zones)
+
+	joined := p.Clone()
+	joined.AddWeightedNode(nodeName(nodes), weight)
+	res.joinMoved, res.joinPrimary = moved(before, placeAll(joined, keys, replicas))
+
+	// Remove a node from the middle, the usual case for a failure.
+	left := p.Clone()
+	left.RemoveNode(nodeName(nodes / 2))
+	res.leaveMoved, res.leavePrimary = moved(before, placeAll(left, keys, replicas))
+	return res, nil
+}
+
+func main() {
+	strategies := flag.String("strategies", strings.Join(hash.Strategies, ","), "comma separated placement strategies to compare")
+	nodes := flag.Int("nodes", 10, "number of nodes in the cluster")
+	keys := flag.Int("keys", 100000, "number of keys to place")
+	replicas := flag.Int("replicas", 3, "replicas per key")
+	weight := flag.Int("weight", 64, "vnodes (ring) or weight per node")
+	zones := flag.Int("zones", 0, "number of zones nodes are spread over round-robin, 0 for none")
+	flag.Parse()
+
+	if *nodes < 2 || *keys < 1 || *replicas < 1 || *weight < 1 || *zones < 0 {
+		fmt.Fprintln(os.Stderr, "nodes must be at least 2; keys, replicas and weight at least 1; zones not negative")
+		os.Exit(2)
+	}
+	logging.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	fmt.Printf("%d nodes, %d keys, %d replicas, weight %d, %d zones\n\n", *nodes, *keys, *replicas, *weight, *zones)
+	fmt.Printf("%-12s %12s %10s %14s %14s %14s %14s %12s\n",
+		"strategy", "max/mean", "stddev%", "join moved%", "join primary%", "leave moved%", "leave primary%", "zone spread%")
+	for _, strategy := range strings.Split(*strategies, ",") {
+		res, err := simulate(strings.TrimSpace(strategy), *nodes, *keys, *replicas, *weight, *zones)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("%-12s %12.3f %10.2f %14.2f %14.2f %14.2f %14.2f %12.2f\n",
+			res.strategy, res.maxOverMean, res.stdDevPct,
+			100*res.joinMoved, 100*res.joinPrimary, 100*res.leaveMoved, 100*res.leavePrimary, 100*res.zoneSpread)
+	}
+	fmt.Printf("\nIdeal movement: join %.2f%%, leave %.2f%%\n", 100/float64(*nodes+1), 100/float64(*nodes))
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"kvstore/handler"
+	"kvstore/hash"
+	"kvstore/seed"
+	"kvstore/store"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DefaultVnodes = 64
+const DefaultShutdownTimeout = 10 * time.Second
+
+type Config struct {
+	SelfURL   string
+	Port      string
+	Seeds     seed.Source
+	DataDir   string
+	Vnodes    int
+	Weight    float64
+	Zone      string
+	Retention store.Retention
+	Debug     bool
+
+	PhiThreshold float64
+	LoadEpsilon  float64
+	Placement    string
+
+	// Replicas and the quorums are the defaults of buckets created without
+	// their own.
+	Replicas    int
+	ReadQuorum  int
+	WriteQuorum int
+
+	GossipInterval time.Duration
+	PeerTimeout    time.Duration
+
+	// RebalanceRate caps rebalancing traffic in bytes per second, 0 for no limit.
+	RebalanceRate int64
+	CleanupDelay  time.Duration
+	CleanupDryRun bool
+	AdminToken    string
+	// AdminInsecure opens the admin API when no AdminToken is set.
+	AdminInsecure bool
+
+	// ShutdownTimeout bounds how long in-flight requests may take to finish
+	// when the node stops.
+	ShutdownTimeout time.Duration
+
+	// TraceExporter is where spans go: none, stdout or file, which appends
+	// to TraceFile.
+	TraceExporter    string
+	TraceFile        string
+	TraceSampleRatio float64
+}
+
+func defaultConfig() Config {
+	return Config{
+		Vnodes:         DefaultVnodes,
+		Weight:         1,
+		Retention:      store.DefaultRetention,
+		PhiThreshold:   handler.DefaultPhiThreshold,
+		Placement:      hash.StrategyRing,
+		Replicas:       3,
+		ReadQuorum:     2,
+		WriteQuorum:    2,
+		GossipInterval: handler.DefaultGossipInterval,
+		PeerTimeout:    handler.DefaultPeerTimeout,
+		CleanupDelay:   handler.DefaultCleanupDelay,
+
+		ShutdownTimeout: DefaultShutdownTimeout,
+
+		TraceExporter:    "none",
+		TraceSampleRatio: 1,
+	}
+}
+
+// setting is one tunable. It is read from the config file under name, from
+// the environment variable of the same name in upper case and from the flag
+// of the same name with dashes, each overriding the one before.
+type setting struct {
+	name  string
+	usage string
+	set   func(c *Config, raw string) error
+	get   func(c *Config) string
+	// aliases are further environment variables read when the main one is
+	// unset.
+	aliases []string
+	secret  bool
+	// boolean settings can be given as a bare flag, e.g. -debug.
+	boolean bool
+	// reloadable settings take effect on a running node; see reload.go.
+	reloadable bool
+}
+
+func (s setting) env() string {
+	return strings.ToUpper(s.name)
+}
+
+func (s setting) flag() string {
+	return strings.ReplaceAll(s.name, "_", "-")
+}
+
+var settings = []setting{
+	stringSetting("self_url", "URL other nodes reach this node at (required)", func(c *Config) *string { return &c.SelfURL }),
+	stringSetting("port", "port to listen on (required)", func(c *Config) *string { return &c.Port }),
+	{
+		name:    "seeds",
+		usage:   "comma separated addresses of existing members",
+		aliases: []string{"PEERS"},
+		set: func(c *Config, raw string) error {
+			c.Seeds.Addresses = nil
+			for _, address := range strings.Split(raw, ",") {
+				if address = strings.TrimSpace(address); address != "" {
+					c.Seeds.Addresses = append(c.Seeds.Addresses, address)
+				}
+			}
+			return nil
+		},
+		get: func(c *Config) string { return strings.Join(c.Seeds.Addresses, ",") },
+	},
+	stringSetting("seeds_dns", "host:port whose DNS records point at seeds", func(c *Config) *string { return &c.Seeds.DNSName }),
+	stringSetting("seeds_file", "file listing one seed address per line", func(c *Config) *string { return &c.Seeds.File }),
+	stringSetting("data_dir", "directory for the node id and data (required)", func(c *Config) *string { return &c.DataDir }),
+	intSetting("vnodes", "virtual nodes per unit of weight", func(c *Config) *int { return &c.Vnodes }),
+	floatSetting("weight", "relative capacity of this node", func(c *Config) *float64 { return &c.Weight }),
+	stringSetting("zone", "failure zone of this node", func(c *Config) *string { return &c.Zone }),
+	// placement and load_epsilon must be the same on every node for
+	// placement to agree.
+	stringSetting("placement", "placement strategy: "+strings.Join(hash.Strategies, ", "), func(c *Config) *string { return &c.Placement }),
+	floatSetting("load_epsilon", "bounded load factor of the ring placement, 0 to disable", func(c *Config) *float64 { return &c.LoadEpsilon }),
+	// replicas is fixed for the life of the node, since changing it would
+	// change every key's preference list; the quorums are checked against it.
+	intSetting("replicas", "default replicas per key", func(c *Config) *int { return &c.Replicas }),
+	reloadable(intSetting("read_quorum", "default replicas that must answer a read", func(c *Config) *int { return &c.ReadQuorum })),
+	reloadable(intSetting("write_quorum", "default replicas that must acknowledge a write", func(c *Config) *int { return &c.WriteQuorum })),
+	reloadable(durationSetting("gossip_interval", "period of gossip and failure detection", func(c *Config) *time.Duration { return &c.GossipInterval })),
+	reloadable(durationSetting("peer_timeout", "how long a suspect without heartbeat history stays suspected", func(c *Config) *time.Duration { return &c.PeerTimeout })),
+	reloadable(floatSetting("phi_threshold", "phi at which a suspect is declared dead", func(c *Config) *float64 { return &c.PhiThreshold })),
+	intSetting("history_max_versions", "versions kept per key, 0 for no limit", func(c *Config) *int { return &c.Retention.MaxVersions }),
+	durationSetting("history_max_age", "age after which old versions are dropped, 0 for no limit", func(c *Config) *time.Duration { return &c.Retention.MaxAge }),
+	reloadable(int64Setting("rebalance_rate", "rebalancing traffic cap in bytes per second, 0 for no limit", func(c *Config) *int64 { return &c.RebalanceRate })),
+	reloadable(durationSetting("cleanup_delay", "how long a key must stay unowned before it is removed", func(c *Config) *time.Duration { return &c.CleanupDelay })),
+	reloadable(boolSetting("cleanup_dry_run", "only report keys cleanup would remove", func(c *Config) *bool { return &c.CleanupDryRun })),
+	secretSetting("admin_token", "bearer token required on /admin endpoints", func(c *Config) *string { return &c.AdminToken }),
+	boolSetting("admin_insecure", "serve /admin endpoints without authentication when admin_token is unset", func(c *Config) *bool { return &c.AdminInsecure }),
+	durationSetting("shutdown_timeout", "how long in-flight requests may take to finish on shutdown", func(c *Config) *time.Duration { return &c.ShutdownTimeout }),
+	stringSetting("trace_exporter", "where spans are written: none, stdout or file", func(c *Config) *string { return &c.TraceExporter }),
+	stringSetting("trace_file", "file the file trace exporter appends to (default <data_dir>/traces.jsonl)", func(c *Config) *string { return &c.TraceFile }),
+	reloadable(floatSetting("trace_sample_ratio", "share of new traces that are recorded, 0 to 1", func(c *Config) *float64 { return &c.TraceSampleRatio })),
+	reloadable(boolSetting("debug", "log at debug level", func(c *Config) *bool { return &c.Debug })),
+}
+
+func reloadable(s setting) setting {
+	s.reloadable = true
+	return s
+}
+
+func stringSetting(name string, usage string, field func(*Config) *string) setting {
+	return setting{
+		name:  name,
+		usage: usage,
+		set:   func(c *Config, raw string) error { *field(c) = raw; return nil },
+		get:   func(c *Config) string { return *field(c) },
+	}
+}
+
+func secretSetting(name string, usage string, field func(*Config) *string) setting {
+	s := stringSetting(name, usage, field)
+	s.secret = true
+	return s
+}
+
+func intSetting(name string, usage string, field func(*Config) *int) setting {
+	return setting{
+		name:  name,
+		usage: usage,
+		set: func(c *Config, raw string) error {
+			parsed, err := strconv.Atoi(raw)
+			*field(c) = parsed
+			return err
+		},
+		get: func(c *Config) string { return strconv.Itoa(*field(c)) },
+	}
+}
+
+func int64Setting(name string, usage string, field func(*Config) *int64) setting {
+	return setting{
+		name:  name,
+		usage: usage,
+		set: func(c *Config, raw string) error {
+			parsed, err := strconv.ParseInt(raw, 10, 64)
+			*field(c) = parsed
+			return err
+		},
+		get: func(c *Config) string { return strconv.FormatInt(*field(c), 10) },
+	}
+}
+
+func floatSetting(name string, usage string, field func(*Config) *float64) setting {
+	return setting{
+		name:  name,
+		usage: usage,
+		set: func(c *Config, raw string) error {
+			parsed, err := strconv.ParseFloat(raw, 64)
+			*field(c) = parsed
+			return err
+		},
+		get: func(c *Config) string { return strconv.FormatFloat(*field(c), 'g', -1, 64) },
+	}
+}
+
+func durationSetting(name string, usage string, field func(*Config) *time.Duration) setting {
+	return setting{
+		name:  name,
+		usage: usage,
+		set: func(c *Config, raw string) error {
+			parsed, err := time.ParseDuration(raw)
+			*field(c) = parsed
+			return err
+		},
+		get: func(c *Config) string { return field(c).String() },
+	}
+}
+
+func boolSetting(name string, usage string, field func(*Config) *bool) setting {
+	return setting{
+		name:  name,
+		usage: usage,
+		set: func(c *Config, raw string) error {
+			parsed, err := strconv.ParseBool(raw)
+			*field(c) = parsed
+			return err
+		},
+		get:     func(c *Config) string { return strconv.FormatBool(*field(c)) },
+		boolean: true,
+	}
+}
+
+// configLoader remembers where the configuration came from so it can be
+// loaded again while the node runs.
+type configLoader struct {
+	file       string
+	flagValues map[string]string
+	// overrides were posted to /admin/reload and take precedence over every
+	// other source until the node restarts.
+	overrides map[string]string
+}
+
+// configError lists every problem found in a configuration.
+type configError []string
+
+func (e configError) Error() string {
+	return strings.Join(e, "; ")
+}
+
+// loadConfig builds the configuration from the defaults, the config file
+// given by -config or CONFIG_FILE, the environment and the command line, in
+// increasing order of precedence. It exits on invalid input. sources maps
+// each setting that is not a default to where it came from.
+func loadConfig(args []string) (config Config, sources map[string]string, loader *configLoader) {
+	flags := flag.NewFlagSet("kvstore", flag.ExitOnError)
+	configFile := flags.String("config", os.Getenv("CONFIG_FILE"), "YAML or TOML style `file` of settings (env CONFIG_FILE)")
+	printConfig := flags.Bool("print-config", false, "print the effective configuration and exit")
+	loader = &configLoader{flagValues: make(map[string]string), overrides: make(map[string]string)}
+	for _, s := range settings {
+		name := s.name
+		usage := fmt.Sprintf("%s (env %s)", s.usage, s.env())
+		record := func(raw string) error {
+			loader.flagValues[name] = raw
+			return nil
+		}
+		if s.boolean {
+			flags.BoolFunc(s.flag(), usage, record)
+		} else {
+			flags.Func(s.flag(), usage, record)
+		}
+	}
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		fmt.Println("Unexpected arguments:", flags.Args())
+		os.Exit(1)
+	}
+	loader.file = *configFile
+
+	config, sources, err := loader.load()
+	if problems, ok := err.(configError); ok {
+		fmt.Println("Invalid configuration:")
+		for _, problem := range problems {
+			fmt.Println("  " + problem)
+		}
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if *printConfig {
+		for _, line := range config.describe(sources) {
+			fmt.Println(line)
+		}
+		os.Exit(0)
+	}
+	return config, sources, loader
+}
+
+func (l *configLoader) load() (Config, map[string]string, error) {
+	fileValues := make(map[string]string)
+	if l.file != "" {
+		var err error
+		if fileValues, err = readConfigFile(l.file); err != nil {
+			return Config{}, nil, fmt.Errorf("Invalid config file: %w", err)
+		}
+	}
+
+	config := defaultConfig()
+	sources := make(map[string]string)
+	for _, s := range settings {
+		var layers [][2]string
+		if raw, ok := fileValues[s.name]; ok {
+			layers = append(layers, [2]string{raw, l.file})
+		}
+		for _, env := range append([]string{s.env()}, s.aliases...) {
+			if raw := os.Getenv(env); raw != "" {
+				layers = append(layers, [2]string{raw, "env " + env})
+				break
+			}
+		}
+		if raw, ok := l.flagValues[s.name]; ok {
+			layers = append(layers, [2]string{raw, "flag -" + s.flag()})
+		}
+		if raw, ok := l.overrides[s.name]; ok {
+			layers = append(layers, [2]string{raw, "reload"})
+		}
+		for _, layer := range layers {
+			if err := s.set(&config, strings.TrimSpace(layer[0])); err != nil {
+				return Config{}, nil, fmt.Errorf("Invalid %s from %s: %q", s.name, layer[1], layer[0])
+			}
+			sources[s.name] = layer[1]
+		}
+	}
+	if config.TraceFile == "" && config.TraceExporter == "file" && config.DataDir != "" {
+		config.TraceFile = filepath.Join(config.DataDir, "traces.jsonl")
+	}
+	if problems := config.validate(); len(problems) > 0 {
+		return Config{}, nil, configError(problems)
+	}
+	return config, sources, nil
+}
+
+// validate returns every problem with the configuration.
+func (c Config) validate() []string {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+	check(c.SelfURL != "", "self_url is required")
+	port, err := strconv.Atoi(c.Port)
+	check(c.Port != "", "port is required")
+	check(c.Port == "" || (err == nil && port > 0 && port < 65536), "port %q is not a valid port", c.Port)
+	check(c.DataDir != "", "data_dir is required, since it holds the node id")
+	check(c.Vnodes >= 1, "vnodes must be at least 1")
+	check(c.Weight > 0, "weight must be positive")
+	_, err = hash.NewPlacement(c.Placement, 1)
+	check(err == nil, "placement must be one of %s", strings.Join(hash.Strategies, ", "))
+	check(c.LoadEpsilon >= 0, "load_epsilon must not be negative")
+	check(c.LoadEpsilon == 0 || c.Placement == hash.StrategyRing, "load_epsilon is only supported with the ring placement")
+	check(c.Replicas >= 1, "replicas must be at least 1")
+	check(c.ReadQuorum >= 1 && c.ReadQuorum <= c.Replicas, "read_quorum must be between 1 and replicas (%d)", c.Replicas)
+	check(c.WriteQuorum >= 1 && c.WriteQuorum <= c.Replicas, "write_quorum must be between 1 and replicas (%d)", c.Replicas)
+	check(c.ReadQuorum+c.WriteQuorum > c.Replicas, "read_quorum + write_quorum (%d) must exceed replicas (%d) for reads to see the latest write",
+		c.ReadQuorum+c.WriteQuorum, c.Replicas)
+	check(c.GossipInterval > 0, "gossip_interval must be positive")
+	check(c.PeerTimeout > c.GossipInterval, "peer_timeout must be longer than gossip_interval")
+	check(c.PhiThreshold > 0, "phi_threshold must be positive")
+	check(c.Retention.MaxVersions >= 0, "history_max_versions must not be negative")
+	check(c.Retention.MaxAge >= 0, "history_max_age must not be negative")
+	check(c.RebalanceRate >= 0, "rebalance_rate must not be negative")
+	check(c.CleanupDelay > 0, "cleanup_delay must be positive")
+	check(c.AdminToken != "" || c.AdminInsecure, "admin_token is required, or set admin_insecure to serve the admin API without authentication")
+	check(c.ShutdownTimeout > 0, "shutdown_timeout must be positive")
+	check(c.TraceExporter == "none" || c.TraceExporter == "stdout" || c.TraceExporter == "file",
+		"trace_exporter must be none, stdout or file")
+	check(c.TraceSampleRatio >= 0 && c.TraceSampleRatio <= 1, "trace_sample_ratio must be between 0 and 1")
+	return problems
+}
+
+// describe lists every setting with its effective value and where it came
+// from. Secrets are only shown as set or not.
+func (c Config) describe(sources map[string]string) []string {
+	lines := make([]string, 0, len(settings))
+	for _, s := range settings {
+		value := s.get(&c)
+		if s.secret && value != "" {
+			value = "<set>"
+		}
+		source, ok := sources[s.name]
+		if !ok {
+			source = "default"
+		}
+		lines = append(lines, fmt.Sprintf("%-20s = %-28s (%s)", s.name, value, source))
+	}
+	return lines
+}
+
+// readConfigFile reads flat "key: value" (YAML) or "key = value" (TOML)
+// settings. Values may be quoted, and lists may be written inline as
+// [a, b] or as a YAML block of "- item" lines. Keys use the setting names,
+// with dashes or underscores.
+func readConfigFile(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	known := make(map[string]bool)
+	for _, s := range settings {
+		known[s.name] = true
+	}
+	values := make(map[string]string)
+	var listKey string
+	var list []string
+	endList := func() {
+		if listKey != "" {
+			values[listKey] = strings.Join(list, ",")
+			listKey, list = "", nil
+		}
+	}
+
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if line == "" || line == "---" {
+			continue
+		}
+		if listKey != "" && strings.HasPrefix(line, "-") {
+			list = append(list, unquote(strings.TrimSpace(line[1:])))
+			continue
+		}
+		endList()
+		if strings.HasPrefix(line, "[") {
+			return nil, fmt.Errorf("%s:%d: sections are not supported", path, lineNo)
+		}
+
+		sep := strings.IndexAny(line, ":=")
+		if sep < 0 {
+			return nil, fmt.Errorf("%s:%d: expected key: value", path, lineNo)
+		}
+		key := strings.ReplaceAll(strings.ToLower(strings.TrimSpace(line[:sep])), "-", "_")
+		value := strings.TrimSpace(line[sep+1:])
+		if !known[key] {
+			return nil, fmt.Errorf("%s:%d: unknown setting %q", path, lineNo, key)
+		}
+		if _, ok := values[key]; ok {
+			return nil, fmt.Errorf("%s:%d: %s is set twice", path, lineNo, key)
+		}
+		switch {
+		case value == "":
+			listKey = key
+		case strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]"):
+			var items []string
+			for _, item := range strings.Split(value[1:len(value)-1], ",") {
+				if item = unquote(strings.TrimSpace(item)); item != "" {
+					items = append(items, item)
+				}
+			}
+			values[key] = strings.Join(items, ",")
+		default:
+			values[key] = unquote(value)
+		}
+	}
+	endList()
+	return values, scanner.Err()
+}
+
+// stripComment removes a # comment that starts the line or follows
+// whitespace, leaving # inside values such as URLs alone.
+func stripComment(line string) string {
+	for i := 0; i < len(line); i++ {
+		if line[i] == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t') {
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func unquote(value string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadConfigFile(t *testing.T) {
+	cases := []struct {
+		name    string
+		content string
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name:    "yaml",
+			content: "---\n# node settings\nport: 8001\nself-url: \"http://localhost:8001\" # quoted\nadmin_token: 'a#b'\n",
+			want:    map[string]string{"port": "8001", "self_url": "http://localhost:8001", "admin_token": "a#b"},
+		},
+		{
+			name:    "toml",
+			content: "port = \"8001\"\ndebug = true\n",
+			want:    map[string]string{"port": "8001", "debug": "true"},
+		},
+		{
+			name:    "inline list",
+			content: "seeds: [localhost:8001, \"localhost:8002\"]\n",
+			want:    map[string]string{"seeds": "localhost:8001,localhost:8002"},
+		},
+		{
+			name:    "block list",
+			content: "seeds:\n  - localhost:8001\n  - localhost:8002\nport: 8003\n",
+			want:    map[string]string{"seeds": "localhost:8001,localhost:8002", "port": "8003"},
+		},
+		{
+			name:    "unknown setting",
+			content: "port: 8001\nbogus: 1\n",
+			wantErr: `:2: unknown setting "bogus"`,
+		},
+		{
+			name:    "set twice",
+			content: "port: 8001\nport: 8002\n",
+			wantErr: ":2: port is set twice",
+		},
+		{
+			name:    "sections",
+			content: "[node]\nport = 8001\n",
+			wantErr: ":1: sections are not supported",
+		},
+		{
+			name:    "missing separator",
+			content: "port 8001\n",
+			wantErr: ":1: expected key: value",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "kvstore.yaml")
+			if err := os.WriteFile(path, []byte(tc.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			got, err := readConfigFile(path)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("readConfigFile error = %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("readConfigFile = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func validConfig() Config {
+	c := defaultConfig()
+	c.SelfURL = "http://localhost:8001"
+	c.Port = "8001"
+	c.DataDir = "data-1"
+	c.AdminToken = "secret"
+	return c
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		name   string
+		modify func(c *Config)
+		want   []string
+	}{
+		{
+			name:   "valid",
+			modify: func(c *Config) {},
+		},
+		{
+			name: "missing required settings",
+			modify: func(c *Config) {
+				c.SelfURL, c.Port, c.DataDir = "", "", ""
+			},
+			want: []string{"self_url is required", "port is required", "data_dir is required, since it holds the node id"},
+		},
+		{
+			name:   "port out of range",
+			modify: func(c *Config) { c.Port = "70000" },
+			want:   []string{`port "70000" is not a valid port`},
+		},
+		{
+			name:   "unknown placement",
+			modify: func(c *Config) { c.Placement = "random" },
+			want:   []string{"placement must be one of"},
+		},
+		{
+			name: "quorums that do not overlap",
+			modify: func(c *Config) {
+				c.Replicas, c.ReadQuorum, c.WriteQuorum = 3, 1, 2
+			},
+			want: []string{"read_quorum + write_quorum (3) must exceed replicas (3)"},
+		},
+		{
+			name:   "quorum above replicas",
+			modify: func(c *Config) { c.Replicas, c.ReadQuorum, c.WriteQuorum = 1, 2, 1 },
+			want:   []string{"read_quorum must be between 1 and replicas (1)"},
+		},
+		{
+			name:   "peer timeout not above gossip interval",
+			modify: func(c *Config) { c.GossipInterval, c.PeerTimeout = time.Second, time.Second },
+			want:   []string{"peer_timeout must be longer than gossip_interval"},
+		},
+		{
+			name:   "admin api without token",
+			modify: func(c *Config) { c.AdminToken = "" },
+			want:   []string{"admin_token is required"},
+		},
+		{
+			name:   "insecure admin api",
+			modify: func(c *Config) { c.AdminToken, c.AdminInsecure = "", true },
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := validConfig()
+			tc.modify(&c)
+			problems := c.validate()
+			if len(problems) != len(tc.want) {
+				t.Fatalf("validate = %q, want %d problems matching %q", problems, len(tc.want), tc.want)
+			}
+			for i, want := range tc.want {
+				if !strings.HasPrefix(problems[i], want) {
+					t.Errorf("problem %d = %q, want prefix %q", i, problems[i], want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package conflict
+
+import (
+	"encoding/json"
+	"kvstore/model"
+)
+
+// jsonMerge merges two JSON objects field by field. Where both sides set the
+// same leaf the newer version wins; values that are not objects fall back to
+// last-writer-wins. A merged value does not record which version each field
+// came from, so a later write that replaced one of the merged versions but
+// raced the other does not remove the fields it dropped.
+func jsonMerge(a model.ValueVersion, b model.ValueVersion) model.ValueVersion {
+	var left, right map[string]interface{}
+	if json.Unmarshal([]byte(a.Value), &left) != nil || json.Unmarshal([]byte(b.Value), &right) != nil {
+		return lastWriterWins(a, b)
+	}
+	winner, loser := a, b
+	older, newest := right, left
+	if newer(b, a) {
+		winner, loser = b, a
+		older, newest = left, right
+	}
+	merged, err := json.Marshal(deepMerge(older, newest))
+	if err != nil {
+		return winner
+	}
+	result := winner
+	result.Value = string(merged)
+	if loser.ExpiresAt == 0 || (result.ExpiresAt != 0 && loser.ExpiresAt > result.ExpiresAt) {
+		result.ExpiresAt = loser.ExpiresAt
+	}
+	return result
+}
+
+func deepMerge(base map[string]interface{}, overlay map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(base)+len(overlay))
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range overlay {
+		baseChild, baseIsObject := merged[k].(map[string]interface{})
+		overlayChild, overlayIsObject := v.(map[string]interface{})
+		if baseIsObject && overlayIsObject {
+			merged[k] = deepMerge(baseChild, overlayChild)
+			continue
+		}
+		merged[k] = v
+	}
+	return merged
+}
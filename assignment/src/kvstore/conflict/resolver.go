@@ -0,0 +1,91 @@
+// Package conflict decides which version of a key survives when replicas
+// disagree. Resolvers are looked up by name, so buckets can pick one in their
+// configuration and applications can register their own at startup.
+package conflict
+
+import (
+	"fmt"
+	"kvstore/model"
+	"sort"
+	"sync"
+)
+
+const (
+	LastWriterWins = "lww"
+	HighestNode    = "highest-node"
+	JSONMerge      = "json-merge"
+)
+
+// Resolver combines two versions of the same key that were written
+// concurrently, i.e. neither coordinator had seen the other version; a write
+// that had seen the other replaces it without a resolver. It must be
+// deterministic and commutative so every node converges on the same result.
+type Resolver func(a model.ValueVersion, b model.ValueVersion) model.ValueVersion
+
+var (
+	mu        sync.RWMutex
+	resolvers = map[string]Resolver{
+		LastWriterWins: lastWriterWins,
+		HighestNode:    highestNode,
+		JSONMerge:      jsonMerge,
+	}
+)
+
+func Register(name string, resolver Resolver) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, exists := resolvers[name]; exists {
+		return fmt.Errorf("resolver %q already registered", name)
+	}
+	resolvers[name] = resolver
+	return nil
+}
+
+// Get returns the named resolver; an empty name selects last-writer-wins.
+func Get(name string) (Resolver, bool) {
+	if name == "" {
+		name = LastWriterWins
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	resolver, ok := resolvers[name]
+	return resolver, ok
+}
+
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(resolvers))
+	for name := range resolvers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func newer(a model.ValueVersion, b model.ValueVersion) bool {
+	if a.Timestamp != b.Timestamp {
+		return a.Timestamp > b.Timestamp
+	}
+	if a.Node != b.Node {
+		return a.Node > b.Node
+	}
+	return a.Value > b.Value
+}
+
+func lastWriterWins(a model.ValueVersion, b model.ValueVersion) model.ValueVersion {
+	if newer(b, a) {
+		return b
+	}
+	return a
+}
+
+func highestNode(a model.ValueVersion, b model.ValueVersion) model.ValueVersion {
+	if a.Node != b.Node {
+		if b.Node > a.Node {
+			return b
+		}
+		return a
+	}
+	return lastWriterWins(a, b)
+}
@@ -0,0 +1,105 @@
+package conflict
+
+import (
+	"kvstore/model"
+	"testing"
+)
+
+func TestResolvers(t *testing.T) {
+	cases := []struct {
+		name     string
+		resolver string
+		a        model.ValueVersion
+		b        model.ValueVersion
+		want     model.ValueVersion
+	}{
+		{
+			name:     "newer write wins",
+			resolver: LastWriterWins,
+			a:        model.ValueVersion{Value: "old", Timestamp: 1, Node: "n2"},
+			b:        model.ValueVersion{Value: "new", Timestamp: 2, Node: "n1"},
+			want:     model.ValueVersion{Value: "new", Timestamp: 2, Node: "n1"},
+		},
+		{
+			name:     "timestamp tie broken by node",
+			resolver: LastWriterWins,
+			a:        model.ValueVersion{Value: "a", Timestamp: 1, Node: "n1"},
+			b:        model.ValueVersion{Value: "b", Timestamp: 1, Node: "n2"},
+			want:     model.ValueVersion{Value: "b", Timestamp: 1, Node: "n2"},
+		},
+		{
+			name:     "full tie broken by value",
+			resolver: LastWriterWins,
+			a:        model.ValueVersion{Value: "a", Timestamp: 1, Node: "n1"},
+			b:        model.ValueVersion{Value: "b", Timestamp: 1, Node: "n1"},
+			want:     model.ValueVersion{Value: "b", Timestamp: 1, Node: "n1"},
+		},
+		{
+			name:     "highest node wins over a newer write",
+			resolver: HighestNode,
+			a:        model.ValueVersion{Value: "a", Timestamp: 1, Node: "n2"},
+			b:        model.ValueVersion{Value: "b", Timestamp: 2, Node: "n1"},
+			want:     model.ValueVersion{Value: "a", Timestamp: 1, Node: "n2"},
+		},
+		{
+			name:     "same node falls back to last writer",
+			resolver: HighestNode,
+			a:        model.ValueVersion{Value: "a", Timestamp: 1, Node: "n1"},
+			b:        model.ValueVersion{Value: "b", Timestamp: 2, Node: "n1"},
+			want:     model.ValueVersion{Value: "b", Timestamp: 2, Node: "n1"},
+		},
+		{
+			name:     "objects merged field by field",
+			resolver: JSONMerge,
+			a:        model.ValueVersion{Value: `{"x":1,"nested":{"p":1,"q":1}}`, Timestamp: 1, Node: "n1"},
+			b:        model.ValueVersion{Value: `{"y":2,"nested":{"q":2}}`, Timestamp: 2, Node: "n2"},
+			want:     model.ValueVersion{Value: `{"nested":{"p":1,"q":2},"x":1,"y":2}`, Timestamp: 2, Node: "n2"},
+		},
+		{
+			name:     "merged value keeps the later expiry",
+			resolver: JSONMerge,
+			a:        model.ValueVersion{Value: `{"x":1}`, Timestamp: 2, ExpiresAt: 10, Node: "n1"},
+			b:        model.ValueVersion{Value: `{"y":1}`, Timestamp: 1, ExpiresAt: 20, Node: "n1"},
+			want:     model.ValueVersion{Value: `{"x":1,"y":1}`, Timestamp: 2, ExpiresAt: 20, Node: "n1"},
+		},
+		{
+			name:     "non-objects fall back to last writer",
+			resolver: JSONMerge,
+			a:        model.ValueVersion{Value: `{"x":1}`, Timestamp: 1, Node: "n1"},
+			b:        model.ValueVersion{Value: `plain`, Timestamp: 2, Node: "n1"},
+			want:     model.ValueVersion{Value: `plain`, Timestamp: 2, Node: "n1"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			resolve, ok := Get(tc.resolver)
+			if !ok {
+				t.Fatalf("resolver %q not registered", tc.resolver)
+			}
+			if got := resolve(tc.a, tc.b); got != tc.want {
+				t.Errorf("resolve(a, b) = %+v, want %+v", got, tc.want)
+			}
+			if got := resolve(tc.b, tc.a); got != tc.want {
+				t.Errorf("resolve(b, a) = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGetDefaultsToLastWriterWins(t *testing.T) {
+	resolve, ok := Get("")
+	if !ok {
+		t.Fatal("no default resolver")
+	}
+	a := model.ValueVersion{Value: "a", Timestamp: 1}
+	b := model.ValueVersion{Value: "b", Timestamp: 2}
+	if got := resolve(a, b); got != b {
+		t.Errorf("resolve(a, b) = %+v, want %+v", got, b)
+	}
+}
+
+func TestRegisterRejectsDuplicates(t *testing.T) {
+	if err := Register(LastWriterWins, lastWriterWins); err == nil {
+		t.Error("registering an existing name succeeded")
+	}
+}
@@ -0,0 +1,66 @@
+package crdt
+
+type PNCounter struct {
+	P map[string]int64 `json:"p"`
+	N map[string]int64 `json:"n"`
+}
+
+func NewPNCounter() *PNCounter {
+	return &PNCounter{
+		P: make(map[string]int64),
+		N: make(map[string]int64),
+	}
+}
+
+func (c *PNCounter) Type() string {
+	return PNCounterType
+}
+
+func (c *PNCounter) Increment(node string, delta int64) {
+	if c.P == nil {
+		c.P = make(map[string]int64)
+	}
+	if c.N == nil {
+		c.N = make(map[string]int64)
+	}
+	if delta >= 0 {
+		c.P[node] += delta
+	} else {
+		c.N[node] -= delta
+	}
+}
+
+func (c *PNCounter) Merge(other CRDT) error {
+	o, ok := other.(*PNCounter)
+	if !ok {
+		return typeMismatch(c, other)
+	}
+	if c.P == nil {
+		c.P = make(map[string]int64)
+	}
+	if c.N == nil {
+		c.N = make(map[string]int64)
+	}
+	for node, v := range o.P {
+		if v > c.P[node] {
+			c.P[node] = v
+		}
+	}
+	for node, v := range o.N {
+		if v > c.N[node] {
+			c.N[node] = v
+		}
+	}
+	return nil
+}
+
+func (c *PNCounter) Value() interface{} {
+	var total int64
+	for _, v := range c.P {
+		total += v
+	}
+	for _, v := range c.N {
+		total -= v
+	}
+	return total
+}
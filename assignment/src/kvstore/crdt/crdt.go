@@ -0,0 +1,76 @@
+package crdt
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	PNCounterType   = "pn-counter"
+	ORSetType       = "or-set"
+	LWWRegisterType = "lww-register"
+	ORMapType       = "or-map"
+)
+
+type CRDT interface {
+	Type() string
+	Merge(other CRDT) error
+	Value() interface{}
+}
+
+func New(typ string) (CRDT, error) {
+	switch typ {
+	case PNCounterType:
+		return NewPNCounter(), nil
+	case ORSetType:
+		return NewORSet(), nil
+	case LWWRegisterType:
+		return &LWWRegister{}, nil
+	case ORMapType:
+		return NewORMap(), nil
+	default:
+		return nil, fmt.Errorf("unknown crdt type %q", typ)
+	}
+}
+
+func Decode(typ string, raw string) (CRDT, error) {
+	c, err := New(typ)
+	if err != nil {
+		return nil, err
+	}
+	if raw == "" {
+		return c, nil
+	}
+	if err := json.Unmarshal([]byte(raw), c); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", typ, err)
+	}
+	return c, nil
+}
+
+func Encode(c CRDT) (string, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", fmt.Errorf("encode %s: %w", c.Type(), err)
+	}
+	return string(data), nil
+}
+
+// Merge combines two encoded states of the same type into one.
+func Merge(typ string, a string, b string) (string, error) {
+	left, err := Decode(typ, a)
+	if err != nil {
+		return "", err
+	}
+	right, err := Decode(typ, b)
+	if err != nil {
+		return "", err
+	}
+	if err := left.Merge(right); err != nil {
+		return "", err
+	}
+	return Encode(left)
+}
+
+func typeMismatch(c CRDT, other CRDT) error {
+	return fmt.Errorf("cannot merge %s with %s", c.Type(), other.Type())
+}
@@ -0,0 +1,161 @@
+package crdt
+
+import (
+	"reflect"
+	"testing"
+)
+
+func counter(p map[string]int64, n map[string]int64) *PNCounter {
+	c := NewPNCounter()
+	for node, v := range p {
+		c.Increment(node, v)
+	}
+	for node, v := range n {
+		c.Increment(node, -v)
+	}
+	return c
+}
+
+func set(adds map[string]string, removes ...string) *ORSet {
+	s := NewORSet()
+	for tag, element := range adds {
+		s.Add(element, tag)
+	}
+	for _, element := range removes {
+		s.Remove(element)
+	}
+	return s
+}
+
+func orMap(ops func(m *ORMap)) *ORMap {
+	m := NewORMap()
+	ops(m)
+	return m
+}
+
+var mergeCases = []struct {
+	name string
+	typ  string
+	a    CRDT
+	b    CRDT
+	want interface{}
+}{
+	{
+		name: "counters on different nodes",
+		typ:  PNCounterType,
+		a:    counter(map[string]int64{"n1": 3}, nil),
+		b:    counter(map[string]int64{"n2": 2}, map[string]int64{"n2": 1}),
+		want: int64(4),
+	},
+	{
+		name: "counter seen twice",
+		typ:  PNCounterType,
+		a:    counter(map[string]int64{"n1": 3}, nil),
+		b:    counter(map[string]int64{"n1": 5}, map[string]int64{"n1": 1}),
+		want: int64(4),
+	},
+	{
+		name: "add survives a concurrent remove",
+		typ:  ORSetType,
+		a:    set(map[string]string{"t1": "x"}, "x"),
+		b:    set(map[string]string{"t1": "x", "t2": "x", "t3": "y"}),
+		want: []string{"x", "y"},
+	},
+	{
+		name: "observed remove",
+		typ:  ORSetType,
+		a:    set(map[string]string{"t1": "x", "t2": "y"}, "x"),
+		b:    set(map[string]string{"t1": "x"}),
+		want: []string{"y"},
+	},
+	{
+		name: "later register write wins",
+		typ:  LWWRegisterType,
+		a:    &LWWRegister{Current: "old", Timestamp: 1, Node: "n2"},
+		b:    &LWWRegister{Current: "new", Timestamp: 2, Node: "n1"},
+		want: "new",
+	},
+	{
+		name: "register tie broken by node",
+		typ:  LWWRegisterType,
+		a:    &LWWRegister{Current: "a", Timestamp: 1, Node: "n1"},
+		b:    &LWWRegister{Current: "b", Timestamp: 1, Node: "n2"},
+		want: "b",
+	},
+	{
+		name: "register tie broken by value",
+		typ:  LWWRegisterType,
+		a:    &LWWRegister{Current: "b", Timestamp: 1, Node: "n1"},
+		b:    &LWWRegister{Current: "a", Timestamp: 1, Node: "n1"},
+		want: "b",
+	},
+	{
+		name: "map fields and removes",
+		typ:  ORMapType,
+		a: orMap(func(m *ORMap) {
+			m.Set("f", "1", "t1", 1, "n1")
+			m.Set("g", "1", "t2", 1, "n1")
+			m.Remove("g")
+		}),
+		b: orMap(func(m *ORMap) {
+			m.Set("f", "2", "t3", 2, "n2")
+			m.Set("g", "1", "t2", 1, "n1")
+		}),
+		want: map[string]string{"f": "2"},
+	},
+}
+
+// merged decodes the encoded states and merges them left to right.
+func merged(t *testing.T, typ string, states ...string) CRDT {
+	t.Helper()
+	result, err := New(typ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, state := range states {
+		next, err := Merge(typ, mustEncode(t, result), state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result, err = Decode(typ, next); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return result
+}
+
+func mustEncode(t *testing.T, c CRDT) string {
+	t.Helper()
+	encoded, err := Encode(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encoded
+}
+
+func TestMerge(t *testing.T) {
+	for _, tc := range mergeCases {
+		t.Run(tc.name, func(t *testing.T) {
+			a, b := mustEncode(t, tc.a), mustEncode(t, tc.b)
+			ab := merged(t, tc.typ, a, b)
+			if got := ab.Value(); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("merged value = %v, want %v", got, tc.want)
+			}
+			if ba := merged(t, tc.typ, b, a); mustEncode(t, ba) != mustEncode(t, ab) {
+				t.Errorf("merge is not commutative: %s != %s", mustEncode(t, ba), mustEncode(t, ab))
+			}
+			if aa := merged(t, tc.typ, a, a); mustEncode(t, aa) != mustEncode(t, merged(t, tc.typ, a)) {
+				t.Errorf("merging a state with itself changed it: %s", mustEncode(t, aa))
+			}
+			if abb := merged(t, tc.typ, a, b, b); mustEncode(t, abb) != mustEncode(t, ab) {
+				t.Errorf("merging b again changed the result: %s != %s", mustEncode(t, abb), mustEncode(t, ab))
+			}
+		})
+	}
+}
+
+func TestMergeTypeMismatch(t *testing.T) {
+	if err := NewPNCounter().Merge(NewORSet()); err == nil {
+		t.Error("merging a set into a counter succeeded")
+	}
+}
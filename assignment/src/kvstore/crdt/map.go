@@ -0,0 +1,75 @@
+package crdt
+
+// ORMap tracks its fields with an OR-set and stores each field value in a
+// last-writer-wins register.
+type ORMap struct {
+	Keys   *ORSet                  `json:"keys"`
+	Values map[string]*LWWRegister `json:"values"`
+}
+
+func NewORMap() *ORMap {
+	return &ORMap{
+		Keys:   NewORSet(),
+		Values: make(map[string]*LWWRegister),
+	}
+}
+
+func (m *ORMap) Type() string {
+	return ORMapType
+}
+
+func (m *ORMap) init() {
+	if m.Keys == nil {
+		m.Keys = NewORSet()
+	}
+	if m.Values == nil {
+		m.Values = make(map[string]*LWWRegister)
+	}
+}
+
+func (m *ORMap) Set(field string, value string, tag string, timestamp int64, node string) {
+	m.init()
+	m.Keys.Add(field, tag)
+	if m.Values[field] == nil {
+		m.Values[field] = &LWWRegister{}
+	}
+	m.Values[field].Set(value, timestamp, node)
+}
+
+func (m *ORMap) Remove(field string) {
+	m.init()
+	m.Keys.Remove(field)
+}
+
+func (m *ORMap) Merge(other CRDT) error {
+	o, ok := other.(*ORMap)
+	if !ok {
+		return typeMismatch(m, other)
+	}
+	m.init()
+	if o.Keys != nil {
+		if err := m.Keys.Merge(o.Keys); err != nil {
+			return err
+		}
+	}
+	for field, register := range o.Values {
+		if m.Values[field] == nil {
+			m.Values[field] = &LWWRegister{}
+		}
+		if err := m.Values[field].Merge(register); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *ORMap) Value() interface{} {
+	m.init()
+	values := make(map[string]string)
+	for _, field := range m.Keys.Elements() {
+		if register, ok := m.Values[field]; ok {
+			values[field] = register.Current
+		}
+	}
+	return values
+}
@@ -0,0 +1,38 @@
+package crdt
+
+type LWWRegister struct {
+	Current   string `json:"value"`
+	Timestamp int64  `json:"timestamp"`
+	Node      string `json:"node"`
+}
+
+func (r *LWWRegister) Type() string {
+	return LWWRegisterType
+}
+
+func (r *LWWRegister) Set(value string, timestamp int64, node string) {
+	r.Merge(&LWWRegister{Current: value, Timestamp: timestamp, Node: node})
+}
+
+// Merge keeps the latest write, breaking timestamp ties by node and then by
+// value so every replica picks the same winner.
+func (r *LWWRegister) Merge(other CRDT) error {
+	o, ok := other.(*LWWRegister)
+	if !ok {
+		return typeMismatch(r, other)
+	}
+	if o.Timestamp != r.Timestamp {
+		if o.Timestamp > r.Timestamp {
+			*r = *o
+		}
+		return nil
+	}
+	if o.Node > r.Node || (o.Node == r.Node && o.Current > r.Current) {
+		*r = *o
+	}
+	return nil
+}
+
+func (r *LWWRegister) Value() interface{} {
+	return r.Current
+}
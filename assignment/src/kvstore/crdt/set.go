@@ -0,0 +1,95 @@
+package crdt
+
+import "sort"
+
+// ORSet is an observed-remove set. Every add is recorded under a unique tag and
+// a remove only tombstones the tags it has observed, so an add concurrent with
+// a remove survives the merge.
+type ORSet struct {
+	Adds    map[string]map[string]bool `json:"adds"`
+	Removes map[string]map[string]bool `json:"removes"`
+}
+
+func NewORSet() *ORSet {
+	return &ORSet{
+		Adds:    make(map[string]map[string]bool),
+		Removes: make(map[string]map[string]bool),
+	}
+}
+
+func (s *ORSet) Type() string {
+	return ORSetType
+}
+
+func (s *ORSet) init() {
+	if s.Adds == nil {
+		s.Adds = make(map[string]map[string]bool)
+	}
+	if s.Removes == nil {
+		s.Removes = make(map[string]map[string]bool)
+	}
+}
+
+func (s *ORSet) Add(element string, tag string) {
+	s.init()
+	if s.Adds[element] == nil {
+		s.Adds[element] = make(map[string]bool)
+	}
+	s.Adds[element][tag] = true
+}
+
+func (s *ORSet) Remove(element string) {
+	s.init()
+	for tag := range s.Adds[element] {
+		if s.Removes[element] == nil {
+			s.Removes[element] = make(map[string]bool)
+		}
+		s.Removes[element][tag] = true
+	}
+}
+
+func (s *ORSet) Contains(element string) bool {
+	for tag := range s.Adds[element] {
+		if !s.Removes[element][tag] {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *ORSet) Elements() []string {
+	elements := []string{}
+	for element := range s.Adds {
+		if s.Contains(element) {
+			elements = append(elements, element)
+		}
+	}
+	sort.Strings(elements)
+	return elements
+}
+
+func (s *ORSet) Merge(other CRDT) error {
+	o, ok := other.(*ORSet)
+	if !ok {
+		return typeMismatch(s, other)
+	}
+	s.init()
+	mergeTags(s.Adds, o.Adds)
+	mergeTags(s.Removes, o.Removes)
+	return nil
+}
+
+func (s *ORSet) Value() interface{} {
+	return s.Elements()
+}
+
+func mergeTags(dst map[string]map[string]bool, src map[string]map[string]bool) {
+	for element, tags := range src {
+		if dst[element] == nil {
+			dst[element] = make(map[string]bool, len(tags))
+		}
+		for tag := range tags {
+			dst[element][tag] = true
+		}
+	}
+}
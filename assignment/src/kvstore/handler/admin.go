@@ -0,0 +1,262 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"kvstore/hash"
+	"kvstore/logging"
+	"kvstore/model"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+type MemberStatus struct {
+	ID          string  `json:"id"`
+	URL         string  `json:"url"`
+	Self        bool    `json:"self,omitempty"`
+	State       string  `json:"state"`
+	Incarnation uint64  `json:"incarnation"`
+	Zone        string  `json:"zone,omitempty"`
+	Vnodes      int     `json:"vnodes"`
+	InRing      bool    `json:"in_ring"`
+	Evicted     bool    `json:"evicted,omitempty"`
+	Phi         float64 `json:"phi,omitempty"`
+	LastSeen    string  `json:"last_seen,omitempty"`
+}
+
+type VnodeResponse struct {
+	Token     uint32  `json:"token"`
+	Node      string  `json:"node"`
+	Ownership float64 `json:"ownership_percent"`
+}
+
+type PreferenceResponse struct {
+	Bucket   string         `json:"bucket"`
+	Key      string         `json:"key"`
+	Token    uint32         `json:"token"`
+	Replicas []MemberStatus `json:"replicas"`
+}
+
+type MemberActionRequest struct {
+	ID     string `json:"id"`
+	Action string `json:"action"`
+}
+
+// RequireAdmin protects an admin endpoint with the AdminToken bearer
+// credential. Without a configured token the admin API is closed, unless
+// AdminInsecure explicitly opens it.
+func (h *Handler) RequireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.AdminToken == "" && !h.AdminInsecure {
+			logging.Infof("Rejected %v %v from %v, no admin token is configured", r.Method, r.URL.Path, r.RemoteAddr)
+			writeJSONError(w, http.StatusForbidden, "Admin API is disabled, no admin token is configured")
+			return
+		}
+		if h.AdminToken != "" {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(h.AdminToken)) != 1 {
+				logging.Infof("Rejected unauthorized %v %v from %v", r.Method, r.URL.Path, r.RemoteAddr)
+				w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+				writeJSONError(w, http.StatusUnauthorized, "Unauthorized")
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// memberStatus describes a member as this node sees it. The caller holds h.Mu
+// or passes a copy of the peer.
+func (h *Handler) memberStatus(peer *model.PeerInfo, ring *model.RingState, now time.Time) MemberStatus {
+	status := MemberStatus{
+		ID:          peer.ID,
+		URL:         peer.URL,
+		Self:        peer.ID == h.SelfID,
+		State:       string(peer.State),
+		Incarnation: peer.Incarnation,
+		Zone:        peer.Zone,
+		Vnodes:      peer.Vnodes,
+		InRing:      ring.IsActive(peer.ID),
+		Evicted:     ring.IsEvicted(peer.ID),
+	}
+	if !status.Self {
+		status.Phi, _ = peer.Phi(now)
+		status.LastSeen = peer.LastSeen.Format(time.RFC3339Nano)
+	}
+	return status
+}
+
+// PeersHandler lists every known member with its liveness and ring status.
+func (h *Handler) PeersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not supported")
+		return
+	}
+	ring := h.ringSnapshot()
+	now := time.Now()
+	var resp []MemberStatus
+	h.Mu.Lock()
+	for _, peer := range h.Peers {
+		resp = append(resp, h.memberStatus(peer, &ring, now))
+	}
+	h.Mu.Unlock()
+	sort.Slice(resp, func(i, j int) bool {
+		return resp[i].URL < resp[j].URL
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		logging.Errorf("Error encoding response: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Error encoding response")
+	}
+}
+
+// TokensHandler lists the ring's vnodes in token order with the share of the
+// hash space each one owns, optionally only those of ?node=.
+func (h *Handler) TokensHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not supported")
+		return
+	}
+	ranged, ok := h.Placement.(hash.Ranged)
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "Placement has no tokens")
+		return
+	}
+	node := r.URL.Query().Get("node")
+	tokens := ranged.Tokens()
+	resp := []VnodeResponse{}
+	for i, token := range tokens {
+		owners := ranged.GetNodesForToken(token, 1)
+		if len(owners) == 0 || (node != "" && owners[0] != node) {
+			continue
+		}
+		// A vnode owns the arc from the previous token up to its own.
+		previous := tokens[(i+len(tokens)-1)%len(tokens)]
+		arc := float64(token - previous)
+		if len(tokens) == 1 {
+			arc = 1 << 32
+		}
+		resp = append(resp, VnodeResponse{
+			Token:     token,
+			Node:      owners[0],
+			Ownership: arc / (1 << 32) * 100,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		logging.Errorf("Error encoding response: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Error encoding response")
+	}
+}
+
+// PreferenceHandler shows the replicas of ?key= in ?bucket=, in the order
+// coordinators contact them.
+func (h *Handler) PreferenceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not supported")
+		return
+	}
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		writeJSONError(w, http.StatusBadRequest, "Missing key")
+		return
+	}
+	bucket, ok := h.getBucket(r.URL.Query().Get("bucket"))
+	if !ok {
+		writeJSONErrorCode(w, http.StatusNotFound, ErrorCodeBucketNotFound, "Bucket not found")
+		return
+	}
+	ring := h.ringSnapshot()
+	now := time.Now()
+	resp := PreferenceResponse{
+		Bucket: bucket.Name,
+		Key:    key,
+		Token:  hash.Token(placementKey(bucket.Name, key)),
+	}
+	nodes := h.getResponsibleNodes(bucket, key)
+	h.Mu.Lock()
+	for _, id := range nodes {
+		peer, ok := h.Peers[id]
+		if !ok {
+			peer = &model.PeerInfo{ID: id}
+		}
+		resp.Replicas = append(resp.Replicas, h.memberStatus(peer, &ring, now))
+	}
+	h.Mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		logging.Errorf("Error encoding response: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Error encoding response")
+	}
+}
+
+// MembersHandler lets an operator force a node out of the ring ("remove")
+// or put an evicted node back ("add"). A removed node stays out even if it
+// is alive until it is added again; its data is moved like for a failed node.
+func (h *Handler) MembersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not supported")
+		return
+	}
+	var req MemberActionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Error decoding request")
+		return
+	}
+	peer, ok := h.memberState(req.ID)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "Unknown node")
+		return
+	}
+	var changed bool
+	switch req.Action {
+	case "remove":
+		if req.ID == h.SelfID {
+			writeJSONError(w, http.StatusBadRequest, "Use /admin/decommission to remove this node")
+			return
+		}
+		logging.Infof("Operator removing node %v (%v) from the ring", req.ID, peer.URL)
+		h.updateRing(func(state *model.RingState) bool {
+			changed = state.Evict(req.ID)
+			return changed
+		})
+	case "add":
+		alive := peer.IsAlive()
+		if req.ID == h.SelfID {
+			alive = h.selfState() == model.PeerAlive
+		}
+		logging.Infof("Operator readmitting node %v (%v) to the ring", req.ID, peer.URL)
+		h.updateRing(func(state *model.RingState) bool {
+			changed = state.Readmit(req.ID, alive)
+			return changed
+		})
+	default:
+		writeJSONError(w, http.StatusBadRequest, "Action must be remove or add")
+		return
+	}
+	if !changed && req.Action == "remove" {
+		writeJSONError(w, http.StatusConflict, "Node is already removed")
+		return
+	}
+	if !changed {
+		writeJSONError(w, http.StatusConflict, "Node was not removed")
+		return
+	}
+
+	ring := h.ringSnapshot()
+	status := h.memberStatus(&peer, &ring, time.Now())
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(status)
+	if err != nil {
+		logging.Errorf("Error encoding response: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Error encoding response")
+	}
+}
@@ -0,0 +1,154 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"kvstore/conflict"
+	"kvstore/logging"
+	"kvstore/model"
+	"net/http"
+	"sort"
+	"time"
+)
+
+func (h *Handler) getBucket(name string) (model.Bucket, bool) {
+	if name == "" {
+		name = model.DefaultBucket
+	}
+	h.bucketsMu.RLock()
+	bucket, ok := h.Buckets[name]
+	h.bucketsMu.RUnlock()
+	if ok {
+		return *bucket, true
+	}
+	if name == model.DefaultBucket {
+		settings := h.settings()
+		return model.Bucket{
+			Name:        model.DefaultBucket,
+			Replicas:    h.Replicas,
+			ReadQuorum:  settings.ReadQuorum,
+			WriteQuorum: settings.WriteQuorum,
+		}, true
+	}
+	return model.Bucket{}, false
+}
+
+func (h *Handler) listBuckets() []model.Bucket {
+	h.bucketsMu.RLock()
+	buckets := make([]model.Bucket, 0, len(h.Buckets)+1)
+	for _, bucket := range h.Buckets {
+		buckets = append(buckets, *bucket)
+	}
+	_, hasDefault := h.Buckets[model.DefaultBucket]
+	h.bucketsMu.RUnlock()
+	if !hasDefault {
+		bucket, _ := h.getBucket(model.DefaultBucket)
+		buckets = append(buckets, bucket)
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].Name < buckets[j].Name
+	})
+	return buckets
+}
+
+// mergeBuckets applies bucket definitions learned from a peer, keeping the
+// most recently updated definition of each bucket.
+func (h *Handler) mergeBuckets(incoming map[string]*model.Bucket) {
+	h.bucketsMu.Lock()
+	defer h.bucketsMu.Unlock()
+	for name, bucket := range incoming {
+		if bucket == nil {
+			continue
+		}
+		local, exists := h.Buckets[name]
+		if exists && bucket.UpdatedAt <= local.UpdatedAt {
+			continue
+		}
+		if h.Buckets == nil {
+			h.Buckets = make(map[string]*model.Bucket)
+		}
+		copied := *bucket
+		h.Buckets[name] = &copied
+		logging.Infof("Bucket %v updated from gossip: %+v", name, copied)
+	}
+}
+
+func (h *Handler) bucketSnapshot() map[string]*model.Bucket {
+	h.bucketsMu.RLock()
+	defer h.bucketsMu.RUnlock()
+	buckets := make(map[string]*model.Bucket, len(h.Buckets))
+	for name, bucket := range h.Buckets {
+		copied := *bucket
+		buckets[name] = &copied
+	}
+	return buckets
+}
+
+func validateBucket(bucket model.Bucket) error {
+	if bucket.Name == "" {
+		return fmt.Errorf("missing bucket name")
+	}
+	if bucket.Replicas < 1 {
+		return fmt.Errorf("replicas must be at least 1")
+	}
+	if bucket.ReadQuorum < 1 || bucket.ReadQuorum > bucket.Replicas {
+		return fmt.Errorf("read_quorum must be between 1 and replicas")
+	}
+	if bucket.WriteQuorum < 1 || bucket.WriteQuorum > bucket.Replicas {
+		return fmt.Errorf("write_quorum must be between 1 and replicas")
+	}
+	if bucket.DefaultTTL < 0 {
+		return fmt.Errorf("default_ttl must not be negative")
+	}
+	if bucket.MaxValueSize < 0 {
+		return fmt.Errorf("max_value_size must not be negative")
+	}
+	if _, ok := conflict.Get(bucket.Resolver); !ok {
+		return fmt.Errorf("unknown resolver %q, available: %v", bucket.Resolver, conflict.Names())
+	}
+	for prefix, name := range bucket.PrefixResolvers {
+		if _, ok := conflict.Get(name); !ok {
+			return fmt.Errorf("unknown resolver %q for prefix %q, available: %v", name, prefix, conflict.Names())
+		}
+	}
+	return nil
+}
+
+func (h *Handler) BucketsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case http.MethodGet:
+		err := json.NewEncoder(w).Encode(h.listBuckets())
+		if err != nil {
+			logging.Errorf("Error encoding response: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "Error encoding response")
+			return
+		}
+	case http.MethodPost:
+		var bucket model.Bucket
+		err := json.NewDecoder(r.Body).Decode(&bucket)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "Error decoding request")
+			return
+		}
+		if err := validateBucket(bucket); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		bucket.UpdatedAt = time.Now().UnixNano()
+		h.mergeBuckets(map[string]*model.Bucket{bucket.Name: &bucket})
+		logging.Infof("Bucket %v created: %+v", bucket.Name, bucket)
+		// Replicas answer "bucket not found" to forwarded requests until they
+		// know the bucket, so tell every member before the caller writes.
+		h.broadcastGossip()
+		err = json.NewEncoder(w).Encode(bucket)
+		if err != nil {
+			logging.Errorf("Error encoding response: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "Error encoding response")
+			return
+		}
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not supported")
+		return
+	}
+}
@@ -0,0 +1,370 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"kvstore/logging"
+	"kvstore/model"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Cleanup removes local copies of keys this node is no longer a replica for.
+// A key is only removed after it has been unowned for at least CleanupDelay,
+// no transfer is still running, and every current owner confirmed it holds
+// the key at least as new as the local copy.
+const CleanupInterval = time.Minute
+const DefaultCleanupDelay = 5 * time.Minute
+const CleanupBatchSize = 500
+
+// Tombstones are kept for TombstoneTTL so that every replica, including ones
+// that were down when the key was deleted, learns about the delete before
+// the tombstone is purged.
+const TombstoneTTL = 24 * time.Hour
+
+type CleanupReport struct {
+	DryRun      bool      `json:"dry_run"`
+	Delay       string    `json:"delay"`
+	StartedAt   time.Time `json:"started_at"`
+	Duration    string    `json:"duration"`
+	Skipped     string    `json:"skipped,omitempty"`
+	Scanned     int       `json:"scanned"`
+	Unowned     int       `json:"unowned"`
+	Waiting     int       `json:"waiting"`
+	Unconfirmed int       `json:"unconfirmed"`
+	Removed     int       `json:"removed"`
+	WouldRemove []string  `json:"would_remove,omitempty"`
+	Tombstones  int       `json:"tombstones_purged"`
+}
+
+type ConfirmEntry struct {
+	Bucket    string `json:"bucket"`
+	Key       string `json:"key"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+type ConfirmRequest struct {
+	Sender  string         `json:"sender"`
+	Entries []ConfirmEntry `json:"entries"`
+}
+
+// ConfirmResponse has one entry per requested key, true if the node holds
+// the key at the requested timestamp or newer.
+type ConfirmResponse struct {
+	Held []bool `json:"held"`
+}
+
+type cleanupState struct {
+	mu      sync.Mutex
+	running bool
+	lastRun time.Time
+	// unownedSince records when each key was first seen without this node
+	// among its replicas.
+	unownedSince map[string]time.Time
+	last         *CleanupReport
+}
+
+type cleanupCandidate struct {
+	bucket    string
+	key       string
+	timestamp int64
+	owners    []string
+}
+
+// maybeCleanup starts a cleanup run once every CleanupInterval.
+func (h *Handler) maybeCleanup() {
+	h.cleanup.mu.Lock()
+	due := !h.cleanup.running && time.Since(h.cleanup.lastRun) >= CleanupInterval
+	h.cleanup.mu.Unlock()
+	if due {
+		go h.runCleanup()
+	}
+}
+
+func (h *Handler) runCleanup() *CleanupReport {
+	h.cleanup.mu.Lock()
+	if h.cleanup.running {
+		h.cleanup.mu.Unlock()
+		return nil
+	}
+	h.cleanup.running = true
+	if h.cleanup.unownedSince == nil {
+		h.cleanup.unownedSince = make(map[string]time.Time)
+	}
+	h.cleanup.mu.Unlock()
+
+	report := h.cleanupUnowned()
+
+	h.cleanup.mu.Lock()
+	h.cleanup.running = false
+	h.cleanup.lastRun = report.StartedAt
+	h.cleanup.last = report
+	h.cleanup.mu.Unlock()
+	return report
+}
+
+func (h *Handler) cleanupUnowned() *CleanupReport {
+	delay := h.cleanupDelay()
+	dryRun := h.settings().CleanupDryRun
+	report := &CleanupReport{DryRun: dryRun, Delay: delay.String(), StartedAt: time.Now()}
+	defer func() {
+		report.Duration = time.Since(report.StartedAt).String()
+	}()
+	if h.selfState() != model.PeerAlive {
+		report.Skipped = "node is not alive"
+		return report
+	}
+	if h.transfersRunning() {
+		report.Skipped = "transfers are still running"
+		return report
+	}
+
+	now := time.Now()
+	seen := make(map[string]bool)
+	var due []cleanupCandidate
+	for bucketName, keys := range h.Store.All() {
+		bucket, ok := h.getBucket(bucketName)
+		if !ok {
+			continue
+		}
+		for key, value := range keys {
+			report.Scanned++
+			if value.Deleted && now.Sub(time.Unix(0, value.Timestamp)) > TombstoneTTL {
+				report.Tombstones++
+				if !dryRun {
+					h.Store.Delete(bucketName, key)
+				}
+				continue
+			}
+			owners := h.getResponsibleNodes(bucket, key)
+			if containsNode(owners, h.SelfID) || len(owners) == 0 {
+				continue
+			}
+			report.Unowned++
+			id := bucketName + "/" + key
+			seen[id] = true
+			h.cleanup.mu.Lock()
+			since, ok := h.cleanup.unownedSince[id]
+			if !ok {
+				since = now
+				h.cleanup.unownedSince[id] = now
+			}
+			h.cleanup.mu.Unlock()
+			if now.Sub(since) < delay {
+				report.Waiting++
+				continue
+			}
+			due = append(due, cleanupCandidate{bucket: bucketName, key: key, timestamp: value.Timestamp, owners: owners})
+		}
+	}
+	// Keys this node owns again, or that are gone, start over.
+	h.cleanup.mu.Lock()
+	for id := range h.cleanup.unownedSince {
+		if !seen[id] {
+			delete(h.cleanup.unownedSince, id)
+		}
+	}
+	h.cleanup.mu.Unlock()
+
+	confirmed := h.confirmWithOwners(due)
+	for i, candidate := range due {
+		if !confirmed[i] {
+			report.Unconfirmed++
+			continue
+		}
+		if dryRun {
+			report.WouldRemove = append(report.WouldRemove, candidate.bucket+"/"+candidate.key)
+			continue
+		}
+		// A write that reached this node after the confirmation keeps the key
+		// until the next run.
+		if current, ok := h.Store.Get(candidate.bucket, candidate.key); !ok || current.Timestamp != candidate.timestamp {
+			report.Unconfirmed++
+			continue
+		}
+		h.Store.Delete(candidate.bucket, candidate.key)
+		h.cleanup.mu.Lock()
+		delete(h.cleanup.unownedSince, candidate.bucket+"/"+candidate.key)
+		h.cleanup.mu.Unlock()
+		report.Removed++
+		migratedKeys.Inc("cleanup")
+	}
+	if report.Unowned > 0 {
+		if dryRun {
+			logging.Infof("Cleanup dry run: %d unowned keys, %d would be removed, %d waiting for the safety delay, %d unconfirmed",
+				report.Unowned, len(report.WouldRemove), report.Waiting, report.Unconfirmed)
+		} else {
+			logging.Infof("Cleanup: %d unowned keys, %d removed, %d waiting for the safety delay, %d unconfirmed",
+				report.Unowned, report.Removed, report.Waiting, report.Unconfirmed)
+		}
+	}
+	return report
+}
+
+func (h *Handler) cleanupDelay() time.Duration {
+	if delay := h.settings().CleanupDelay; delay > 0 {
+		return delay
+	}
+	return DefaultCleanupDelay
+}
+
+func (h *Handler) transfersRunning() bool {
+	h.rebalancing.mu.Lock()
+	defer h.rebalancing.mu.Unlock()
+	for _, t := range h.rebalancing.transfers {
+		if !t.finished() {
+			return true
+		}
+	}
+	return false
+}
+
+// confirmWithOwners asks every owner of the candidates which keys it holds
+// and reports, per candidate, whether all of its owners confirmed it. An
+// owner that cannot be reached confirms nothing.
+func (h *Handler) confirmWithOwners(candidates []cleanupCandidate) []bool {
+	byOwner := make(map[string][]int)
+	for i, candidate := range candidates {
+		for _, owner := range candidate.owners {
+			byOwner[owner] = append(byOwner[owner], i)
+		}
+	}
+	confirmations := make([]int, len(candidates))
+	for owner, indexes := range byOwner {
+		for start := 0; start < len(indexes); start += CleanupBatchSize {
+			end := start + CleanupBatchSize
+			if end > len(indexes) {
+				end = len(indexes)
+			}
+			req := ConfirmRequest{Sender: h.SelfID}
+			for _, i := range indexes[start:end] {
+				req.Entries = append(req.Entries, ConfirmEntry{
+					Bucket:    candidates[i].bucket,
+					Key:       candidates[i].key,
+					Timestamp: candidates[i].timestamp,
+				})
+			}
+			held, err := h.sendConfirm(owner, req)
+			if err != nil {
+				logging.Errorf("Cleanup could not confirm %d keys with %v: %v", len(req.Entries), owner, err)
+				continue
+			}
+			for j, i := range indexes[start:end] {
+				if j < len(held) && held[j] {
+					confirmations[i]++
+				}
+			}
+		}
+	}
+	confirmed := make([]bool, len(candidates))
+	for i, candidate := range candidates {
+		confirmed[i] = confirmations[i] == len(candidate.owners)
+	}
+	return confirmed
+}
+
+func (h *Handler) sendConfirm(owner string, confirm ConfirmRequest) ([]bool, error) {
+	address, err := h.addressOf(owner)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(confirm)
+	if err != nil {
+		return nil, fmt.Errorf("marshal confirm request: %w", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, address+"/kv/internal/confirm", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("create request failed: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	h.setRingHeaders(req.Header)
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("post to %s: %w", address, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusConflict {
+		return nil, h.handleStaleRing(resp)
+	}
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("node %s returned status %d: %s", owner, resp.StatusCode, string(respBody))
+	}
+	var confirmResp ConfirmResponse
+	if err := json.NewDecoder(resp.Body).Decode(&confirmResp); err != nil {
+		return nil, fmt.Errorf("decode confirm response: %w", err)
+	}
+	return confirmResp.Held, nil
+}
+
+func containsNode(nodes []string, id string) bool {
+	for _, node := range nodes {
+		if node == id {
+			return true
+		}
+	}
+	return false
+}
+
+// InternalConfirmHandler tells a node cleaning up which of its keys this node
+// holds. A caller with an older ring is rejected so it never deletes based on
+// outdated ownership.
+func (h *Handler) InternalConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not supported")
+		return
+	}
+	if !h.checkRingEpoch(w, r) {
+		return
+	}
+	var req ConfirmRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Error decoding request")
+		return
+	}
+	resp := ConfirmResponse{Held: make([]bool, len(req.Entries))}
+	for i, entry := range req.Entries {
+		value, ok := h.Store.Get(entry.Bucket, entry.Key)
+		resp.Held[i] = ok && value.Timestamp >= entry.Timestamp
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		logging.Errorf("Error encoding response: %v", err)
+	}
+}
+
+// CleanupHandler shows the last cleanup run; POST starts a run right away.
+// The safety delay still applies to keys that only just became unowned.
+func (h *Handler) CleanupHandler(w http.ResponseWriter, r *http.Request) {
+	var report *CleanupReport
+	switch r.Method {
+	case http.MethodGet:
+		h.cleanup.mu.Lock()
+		report = h.cleanup.last
+		h.cleanup.mu.Unlock()
+		if report == nil {
+			writeJSONError(w, http.StatusNotFound, "Cleanup has not run yet")
+			return
+		}
+	case http.MethodPost:
+		report = h.runCleanup()
+		if report == nil {
+			writeJSONError(w, http.StatusConflict, "Cleanup is already running")
+			return
+		}
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not supported")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(report)
+	if err != nil {
+		logging.Errorf("Error encoding response: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Error encoding response")
+	}
+}
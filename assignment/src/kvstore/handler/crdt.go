@@ -0,0 +1,340 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kvstore/crdt"
+	"kvstore/logging"
+	"kvstore/model"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// keyLocks hands out one mutex per key, dropped again once nobody holds or
+// waits for it.
+type keyLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lock locks key and returns the function that unlocks it.
+func (k *keyLocks) lock(key string) func() {
+	k.mu.Lock()
+	if k.locks == nil {
+		k.locks = make(map[string]*keyLock)
+	}
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyLock{}
+		k.locks[key] = l
+	}
+	l.refs++
+	k.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		k.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.mu.Unlock()
+	}
+}
+
+type CRDTResponse struct {
+	Bucket string      `json:"bucket"`
+	Key    string      `json:"key"`
+	Type   string      `json:"type"`
+	Value  interface{} `json:"value"`
+}
+
+func (h *Handler) fetchReplica(ctx context.Context, target string, bucket string, key string) (model.ValueVersion, bool, error) {
+	query := url.Values{}
+	query.Set("bucket", bucket)
+	query.Set("key", key)
+	address, err := h.addressOf(target)
+	if err != nil {
+		return model.ValueVersion{}, false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, address+"/kv?"+query.Encode(), nil)
+	if err != nil {
+		return model.ValueVersion{}, false, fmt.Errorf("create request failed: %v", err)
+	}
+	ctx, span := startPeerSpan(ctx, "fetchReplica", target, req.Header)
+	defer span.End()
+	req = req.WithContext(ctx)
+	req.Header.Set("X-From-Node", "true")
+	h.setRingHeaders(req.Header)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return model.ValueVersion{}, false, fmt.Errorf("do request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusConflict {
+		return model.ValueVersion{}, false, h.handleStaleRing(resp)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var errResp ErrorResponse
+		if json.NewDecoder(resp.Body).Decode(&errResp) == nil && errResp.Code == ErrorCodeKeyNotFound {
+			return model.ValueVersion{}, false, nil
+		}
+		return model.ValueVersion{}, false, fmt.Errorf("request failed: %v", resp.Status)
+	}
+	var valueVersion model.ValueVersion
+	if err := json.NewDecoder(resp.Body).Decode(&valueVersion); err != nil {
+		return model.ValueVersion{}, false, fmt.Errorf("decode response failed: %v", err)
+	}
+	return valueVersion, true, nil
+}
+
+// typeMismatchError reports a key that already holds a value of another type
+// than the request works on.
+type typeMismatchError struct {
+	key      string
+	existing string
+	want     string
+}
+
+func (e *typeMismatchError) Error() string {
+	existing := e.existing
+	if existing == "" {
+		existing = "plain"
+	}
+	return fmt.Sprintf("Key %v holds a %s value, not a %s", e.key, existing, e.want)
+}
+
+// readCRDT collects the state of a key from a read quorum of its replicas and
+// merges it into a single value.
+func (h *Handler) readCRDT(ctx context.Context, bucket model.Bucket, key string, typ string) (crdt.CRDT, error) {
+	merged, err := crdt.New(typ)
+	if err != nil {
+		return nil, err
+	}
+	var successNodes []string
+	for _, target := range h.getResponsibleNodes(bucket, key) {
+		var value model.ValueVersion
+		var found bool
+		if target == h.SelfID {
+			value, found = h.getLocal(ctx, bucket.Name, key, 0)
+		} else {
+			value, found, err = h.fetchReplica(ctx, target, bucket.Name, key)
+			if err != nil {
+				logging.Errorf("Error reading %v from %v: %v", key, target, err)
+				continue
+			}
+		}
+		successNodes = append(successNodes, target)
+		if !found || value.Deleted {
+			continue
+		}
+		if value.Type != typ {
+			return nil, &typeMismatchError{key: key, existing: value.Type, want: typ}
+		}
+		replica, err := crdt.Decode(typ, value.Value)
+		if err != nil {
+			return nil, err
+		}
+		if err := merged.Merge(replica); err != nil {
+			return nil, err
+		}
+	}
+	if len(successNodes) < bucket.ReadQuorum {
+		quorumFailures.Inc("crdt_read")
+		return nil, fmt.Errorf("read quorum not met: %d < %d, success nodes: %v", len(successNodes), bucket.ReadQuorum, successNodes)
+	}
+	return merged, nil
+}
+
+func (h *Handler) writeCRDT(ctx context.Context, bucket model.Bucket, key string, value crdt.CRDT) error {
+	encoded, err := crdt.Encode(value)
+	if err != nil {
+		return err
+	}
+	valueVersion := model.ValueVersion{
+		Value:     encoded,
+		Timestamp: time.Now().UnixNano(),
+		Type:      value.Type(),
+		Node:      h.SelfID,
+	}
+	var successNodes []string
+	for _, target := range h.getResponsibleNodes(bucket, key) {
+		if target == h.SelfID {
+			h.putLocal(ctx, bucket, key, valueVersion)
+			successNodes = append(successNodes, target)
+			continue
+		}
+		if err := h.sendKeyValue(ctx, target, bucket.Name, key, valueVersion); err != nil {
+			logging.Errorf("Error writing %v to %v: %v", key, target, err)
+			continue
+		}
+		successNodes = append(successNodes, target)
+	}
+	if len(successNodes) < bucket.WriteQuorum {
+		quorumFailures.Inc("crdt_write")
+		return fmt.Errorf("write quorum not met: %d < %d, success nodes: %v", len(successNodes), bucket.WriteQuorum, successNodes)
+	}
+	return nil
+}
+
+// crdtTag returns a tag unique to this coordinator and moment, used to
+// identify OR-set additions.
+func (h *Handler) crdtTag() string {
+	return h.SelfID + "@" + strconv.FormatInt(time.Now().UnixNano(), 10)
+}
+
+func (h *Handler) serveCRDT(w http.ResponseWriter, r *http.Request, typ string, apply func(c crdt.CRDT) error) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		writeJSONError(w, http.StatusBadRequest, "Missing key")
+		return
+	}
+	bucket, ok := h.getBucket(r.URL.Query().Get("bucket"))
+	if !ok {
+		writeJSONErrorCode(w, http.StatusNotFound, ErrorCodeBucketNotFound, "Bucket not found")
+		return
+	}
+	// An update builds on the state read from R replicas and is written to
+	// W of them; only when every read quorum overlaps every write quorum is
+	// the previous update certain to be part of that state.
+	if bucket.ReadQuorum+bucket.WriteQuorum <= bucket.Replicas {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("CRDTs need read_quorum + write_quorum > replicas, bucket %v has %d + %d <= %d",
+			bucket.Name, bucket.ReadQuorum, bucket.WriteQuorum, bucket.Replicas))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		// Mutations are read-modify-write on this coordinator; serialize them
+		// per key so two local requests never build on the same observed
+		// state.
+		unlock := h.crdtLocks.lock(bucket.Name + "/" + key)
+		defer unlock()
+	}
+	value, err := h.readCRDT(r.Context(), bucket, key, typ)
+	var mismatch *typeMismatchError
+	if errors.As(err, &mismatch) {
+		writeJSONErrorCode(w, http.StatusConflict, ErrorCodeTypeMismatch, mismatch.Error())
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if r.Method != http.MethodGet {
+		if err := apply(value); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := h.writeCRDT(r.Context(), bucket, key, value); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		logging.Infof("CRDT %v %v [%v/%v -> %v]", r.Method, typ, bucket.Name, key, value.Value())
+	}
+	err = json.NewEncoder(w).Encode(CRDTResponse{
+		Bucket: bucket.Name,
+		Key:    key,
+		Type:   typ,
+		Value:  value.Value(),
+	})
+	if err != nil {
+		logging.Errorf("Error encoding response: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Error encoding response")
+	}
+}
+
+func (h *Handler) CounterHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodPost:
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not supported")
+		return
+	}
+	h.serveCRDT(w, r, crdt.PNCounterType, func(c crdt.CRDT) error {
+		delta := int64(1)
+		if raw := r.URL.Query().Get("delta"); raw != "" {
+			parsed, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid delta")
+			}
+			delta = parsed
+		}
+		c.(*crdt.PNCounter).Increment(h.SelfID, delta)
+		return nil
+	})
+}
+
+func (h *Handler) SetHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodPost, http.MethodDelete:
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not supported")
+		return
+	}
+	h.serveCRDT(w, r, crdt.ORSetType, func(c crdt.CRDT) error {
+		element := r.URL.Query().Get("element")
+		if element == "" {
+			return fmt.Errorf("missing element")
+		}
+		if r.Method == http.MethodDelete {
+			c.(*crdt.ORSet).Remove(element)
+		} else {
+			c.(*crdt.ORSet).Add(element, h.crdtTag())
+		}
+		return nil
+	})
+}
+
+func (h *Handler) RegisterHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodPost:
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not supported")
+		return
+	}
+	h.serveCRDT(w, r, crdt.LWWRegisterType, func(c crdt.CRDT) error {
+		value := r.URL.Query().Get("value")
+		if value == "" {
+			return fmt.Errorf("missing value")
+		}
+		c.(*crdt.LWWRegister).Set(value, time.Now().UnixNano(), h.SelfID)
+		return nil
+	})
+}
+
+func (h *Handler) MapHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodPost, http.MethodDelete:
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not supported")
+		return
+	}
+	h.serveCRDT(w, r, crdt.ORMapType, func(c crdt.CRDT) error {
+		field := r.URL.Query().Get("field")
+		if field == "" {
+			return fmt.Errorf("missing field")
+		}
+		if r.Method == http.MethodDelete {
+			c.(*crdt.ORMap).Remove(field)
+			return nil
+		}
+		value := r.URL.Query().Get("value")
+		if value == "" {
+			return fmt.Errorf("missing value")
+		}
+		c.(*crdt.ORMap).Set(field, value, h.crdtTag(), time.Now().UnixNano(), h.SelfID)
+		return nil
+	})
+}
@@ -0,0 +1,249 @@
+package handler
+
+import (
+	"encoding/json"
+	"kvstore/hash"
+	"kvstore/logging"
+	"kvstore/model"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type DecommissionStatus struct {
+	State     model.PeerState `json:"state"`
+	StartedAt time.Time       `json:"started_at,omitempty"`
+	KeysSent  int             `json:"keys_sent"`
+	Errors    int             `json:"errors"`
+}
+
+// handOffReason is the reason of the transfers a leaving node hands its
+// keys off with.
+const handOffReason = "decommission"
+
+// decommissionCatchUpPasses bounds how often keys written during a hand-off
+// are sent again before the node announces that it left.
+const decommissionCatchUpPasses = 5
+
+type decommissionState struct {
+	mu     sync.Mutex
+	status DecommissionStatus
+	// changed holds the keys written locally while the node hands off its
+	// data, by bucket. It is nil outside of a hand-off.
+	changed map[string]map[string]bool
+	// left is closed once a decommission announced that the node left.
+	left chan struct{}
+}
+
+func (h *Handler) decommissionStatus() DecommissionStatus {
+	h.leave.mu.Lock()
+	defer h.leave.mu.Unlock()
+	status := h.leave.status
+	status.State = h.selfState()
+	return status
+}
+
+// broadcastGossip pushes our membership view to every member at once instead
+// of waiting for it to spread, so state changes of this node take effect
+// cluster-wide immediately. It returns once every member was tried.
+func (h *Handler) broadcastGossip() {
+	var wg sync.WaitGroup
+	for id, peer := range h.peerSnapshot() {
+		if id == h.SelfID || peer.IsGone() {
+			continue
+		}
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			h.SendGossip(id)
+		}(id)
+	}
+	wg.Wait()
+}
+
+// decommission takes a leaving node out of the cluster: it hands every key
+// it holds to the nodes that own it once this node is gone, announces that it
+// left and finally shuts down.
+func (h *Handler) decommission(start time.Time) {
+	h.handOffKeys(start)
+	h.announceLeft()
+	close(h.leave.left)
+
+	if h.ShutdownFunc != nil {
+		h.ShutdownFunc()
+	}
+}
+
+// handOffKeys sends every key this node holds to the nodes that own it once
+// this node is gone, then sends the keys written meanwhile again. Writes
+// stay tracked until FinishHandOff.
+func (h *Handler) handOffKeys(start time.Time) {
+	h.broadcastGossip()
+
+	h.leave.mu.Lock()
+	h.leave.changed = make(map[string]map[string]bool)
+	h.leave.mu.Unlock()
+	before := h.Placement.Clone()
+	plan, keys := h.planRebalance(before, h.remainingPlacement(), true)
+	h.handOff(plan, keys)
+	h.catchUp(decommissionCatchUpPasses)
+
+	status := h.decommissionStatus()
+	logging.Infof("Decommission handed off %d keys with %d errors in %v", status.KeysSent, status.Errors, time.Since(start))
+}
+
+// catchUp sends the keys written since the previous pass to all of their
+// replicas once this node is gone, since a write may have reached only some
+// of them, pass by pass until one finds none. The keys are tracked here
+// rather than picked by their timestamps, which other nodes set with their
+// own clocks.
+func (h *Handler) catchUp(passes int) {
+	for pass := 0; pass < passes; pass++ {
+		h.leave.mu.Lock()
+		changed := h.leave.changed
+		h.leave.changed = make(map[string]map[string]bool)
+		h.leave.mu.Unlock()
+		if len(changed) == 0 {
+			return
+		}
+		remaining := h.remainingPlacement()
+		plan := make(map[string][]transferSegment)
+		keys := make(map[string]int)
+		for bucketName, changedKeys := range changed {
+			bucket, ok := h.getBucket(bucketName)
+			if !ok {
+				continue
+			}
+			bucketKeys := make([]string, 0, len(changedKeys))
+			for key := range changedKeys {
+				bucketKeys = append(bucketKeys, key)
+			}
+			h.planKeys(plan, keys, nil, remaining, bucket, bucketKeys, true)
+		}
+		h.handOff(plan, keys)
+	}
+}
+
+// FinishHandOff sends the keys written by requests that were still running
+// when the node announced that it left, and stops tracking writes. Call it
+// once the server stopped taking requests.
+func (h *Handler) FinishHandOff() {
+	h.leave.mu.Lock()
+	tracking := h.leave.changed != nil
+	h.leave.mu.Unlock()
+	if !tracking {
+		return
+	}
+	h.catchUp(1)
+	h.leave.mu.Lock()
+	h.leave.changed = nil
+	h.leave.mu.Unlock()
+}
+
+// remainingPlacement returns the placement without this node.
+func (h *Handler) remainingPlacement() hash.Placement {
+	remaining := h.Placement.Clone()
+	remaining.RemoveNode(h.SelfID)
+	return remaining
+}
+
+// trackChange records a key written locally while the node hands off its
+// data, so a catch-up pass sends it again.
+func (h *Handler) trackChange(bucket string, key string) {
+	h.leave.mu.Lock()
+	defer h.leave.mu.Unlock()
+	if h.leave.changed == nil {
+		return
+	}
+	if h.leave.changed[bucket] == nil {
+		h.leave.changed[bucket] = make(map[string]bool)
+	}
+	h.leave.changed[bucket][key] = true
+}
+
+// announceLeft tells every member at once that this node left, so they take
+// it out of the ring without waiting for failure detection.
+func (h *Handler) announceLeft() {
+	h.announceSelf(model.PeerLeft, 0)
+	h.setRingMember(h.SelfID, false, 0)
+	h.broadcastGossip()
+}
+
+// Leave takes the node out of the cluster before it shuts down the same way
+// a decommission does: it hands off its keys and then announces that it
+// left. If a decommission is running it waits for it instead.
+func (h *Handler) Leave() {
+	switch h.selfState() {
+	case model.PeerLeft:
+		return
+	case model.PeerLeaving:
+		h.leave.mu.Lock()
+		left := h.leave.left
+		h.leave.mu.Unlock()
+		if left != nil {
+			<-left
+			return
+		}
+	}
+	start := time.Now()
+	h.leave.mu.Lock()
+	h.leave.status = DecommissionStatus{StartedAt: start}
+	h.leave.mu.Unlock()
+	logging.Infof("Leaving the cluster, handing off keys")
+	h.announceSelf(model.PeerLeaving, 0)
+	h.handOffKeys(start)
+	h.announceLeft()
+}
+
+// handOff runs a planned transfer to every target through the rebalancing
+// machinery, so keys stream range by range and resume from their checkpoint
+// after errors, and waits for all of them to finish.
+func (h *Handler) handOff(plan map[string][]transferSegment, keys map[string]int) {
+	var wg sync.WaitGroup
+	for target, segments := range plan {
+		t := h.newTransfer(target, handOffReason, segments, keys[target])
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.runTransfer(t)
+			h.rebalancing.mu.Lock()
+			sent, failed := t.KeysSent, t.State == TransferFailed
+			h.rebalancing.mu.Unlock()
+			h.leave.mu.Lock()
+			h.leave.status.KeysSent += sent
+			if failed {
+				h.leave.status.Errors++
+			}
+			h.leave.mu.Unlock()
+		}()
+	}
+	wg.Wait()
+}
+
+func (h *Handler) DecommissionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if h.selfState() != model.PeerAlive {
+			writeJSONError(w, http.StatusConflict, "Node is already leaving")
+			return
+		}
+		start := time.Now()
+		h.leave.mu.Lock()
+		h.leave.status = DecommissionStatus{StartedAt: start}
+		h.leave.left = make(chan struct{})
+		h.leave.mu.Unlock()
+		logging.Infof("Decommission of %v (%v) requested", h.SelfID, h.SelfURL)
+		h.announceSelf(model.PeerLeaving, 0)
+		go h.decommission(start)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not supported")
+		return
+	}
+	err := json.NewEncoder(w).Encode(h.decommissionStatus())
+	if err != nil {
+		logging.Errorf("Error encoding response: %v", err)
+	}
+}
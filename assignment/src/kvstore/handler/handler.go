@@ -2,61 +2,162 @@ package handler
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"kvstore/hash"
 	"kvstore/logging"
 	"kvstore/model"
+	"kvstore/seed"
 	"kvstore/store"
-	"math/rand"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 )
 
-const GossipInterval = 3 * time.Second
-const PeerTimeout = 15 * time.Second
+const DefaultGossipInterval = 3 * time.Second
+const DefaultPeerTimeout = 15 * time.Second
 
 type Handler struct {
+	SelfID      string
 	SelfURL     string
-	HashRing    *hash.HashRing
+	Vnodes      int
+	Zone        string
+	LoadEpsilon float64
+	Placement   hash.Placement
 	Store       store.KeyValueStore
+	// Replicas is the default bucket's replica count. Unlike the quorums
+	// it cannot be reloaded.
 	Replicas    int
 	WriteQuorum int
 	ReadQuorum  int
 
-	Peers map[string]*model.PeerInfo
-	Mu    sync.Mutex
+	// PlacementStrategy names the strategy Placement implements, for clients
+	// that place keys themselves.
+	PlacementStrategy string
+
+	Seeds        seed.Source
+	Peers        map[string]*model.PeerInfo
+	Mu           sync.Mutex
+	PhiThreshold float64
+
+	// GossipInterval is the period of the gossip loop; PeerTimeout is how
+	// long a suspect without heartbeat history stays suspected.
+	GossipInterval time.Duration
+	PeerTimeout    time.Duration
+
+	Buckets   map[string]*model.Bucket
+	bucketsMu sync.RWMutex
+
+	Indexes   map[string]*model.Index
+	indexesMu sync.RWMutex
+
+	crdtLocks   keyLocks
+	swim        swimState
+	ring        ringView
+	leave       decommissionState
+	rebalancing rebalanceState
+	cleanup     cleanupState
+
+	// RebalanceRate caps rebalancing traffic in bytes per second, 0 for no
+	// limit.
+	RebalanceRate int64
+
+	// CleanupDelay is how long a key must stay unowned before it is removed;
+	// with CleanupDryRun removals are only reported.
+	CleanupDelay  time.Duration
+	CleanupDryRun bool
+
+	// AdminToken is the bearer token required on /admin endpoints. Without
+	// one the admin API is refused unless AdminInsecure is set.
+	AdminToken    string
+	AdminInsecure bool
+
+	// settingsMu guards the fields listed in Settings.
+	settingsMu sync.RWMutex
+
+	gossipStop chan struct{}
+	gossipDone chan struct{}
+	stopGossip sync.Once
+
+	ShutdownFunc func()
+	// ReloadFunc reloads the configuration with the given settings on top.
+	ReloadFunc func(overrides map[string]string) (ReloadResponse, error)
 }
 
 type KVResponse struct {
+	Bucket    string `json:"bucket"`
 	Key       string `json:"key"`
 	Value     string `json:"value"`
 	Timestamp int64  `json:"timestamp"`
+	ExpiresAt int64  `json:"expires_at,omitempty"`
+	Type      string `json:"type,omitempty"`
+	Node      string `json:"node,omitempty"`
+	Base      int64  `json:"base,omitempty"`
+	Deleted   bool   `json:"deleted,omitempty"`
 }
 
 type ErrorResponse struct {
 	Error string `json:"error"`
+	Code  string `json:"code,omitempty"`
 }
 
+// Error codes let clients tell errors with the same status apart.
+// ErrorCodeQuorum marks a request that failed because too few replicas
+// answered; the client may retry it.
+const (
+	ErrorCodeQuorum         = "quorum_not_met"
+	ErrorCodeKeyNotFound    = "key_not_found"
+	ErrorCodeBucketNotFound = "bucket_not_found"
+	ErrorCodeTypeMismatch   = "type_mismatch"
+)
+
+// errKeyNotFound is returned by forward when a replica does not hold the key.
+var errKeyNotFound = errors.New("key not found on replica")
+
 type GossipMessage struct {
-	Sender string                     `json:"sender"`
-	Peers  map[string]*model.PeerInfo `json:"peers"`
+	Sender  string                     `json:"sender"`
+	Peers   map[string]*model.PeerInfo `json:"peers"`
+	Buckets map[string]*model.Bucket   `json:"buckets,omitempty"`
+	Indexes map[string]*model.Index    `json:"indexes,omitempty"`
+	Ring    *model.RingState           `json:"ring,omitempty"`
+}
+
+// writeQuorumError answers 503 rather than 500: this node works, but too few
+// replicas answered, and a retry may find enough of them.
+func writeQuorumError(w http.ResponseWriter, op string, msg string) {
+	quorumFailures.Inc(op)
+	writeJSONErrorCode(w, http.StatusServiceUnavailable, ErrorCodeQuorum, msg)
 }
 
 func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSONErrorCode(w, status, "", msg)
+}
+
+func writeJSONErrorCode(w http.ResponseWriter, status int, code string, msg string) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
-	err := json.NewEncoder(w).Encode(ErrorResponse{Error: msg})
+	err := json.NewEncoder(w).Encode(ErrorResponse{Error: msg, Code: code})
 	if err != nil {
 		logging.Errorf("Error encoding error response: %v", err)
 		return
 	}
 }
 
-func (h *Handler) getResponsibleNodes(key string) []string {
-	return h.HashRing.GetNodesForKey(key, h.Replicas)
+// placementKey keeps keys of the default bucket on the same nodes as before
+// buckets existed, and spreads other buckets independently.
+func placementKey(bucket string, key string) string {
+	if bucket == "" || bucket == model.DefaultBucket {
+		return key
+	}
+	return bucket + "/" + key
+}
+
+func (h *Handler) getResponsibleNodes(bucket model.Bucket, key string) []string {
+	return h.Placement.GetNodesForKey(placementKey(bucket.Name, key), bucket.Replicas)
 }
 
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -65,36 +166,85 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		writeJSONError(w, http.StatusInternalServerError, "Missing key")
 		return
 	}
+	bucket, ok := h.getBucket(r.URL.Query().Get("bucket"))
+	if !ok {
+		writeJSONErrorCode(w, http.StatusNotFound, ErrorCodeBucketNotFound, "Bucket not found")
+		return
+	}
 	isForwarded := r.Header.Get("X-From-Node") == "true"
-	targets := h.getResponsibleNodes(key)
+	if isForwarded && !h.checkRingEpoch(w, r) {
+		return
+	}
+	targets := h.getResponsibleNodes(bucket, key)
 
+	// Clients routing by their own copy of the ring refresh it when they see
+	// a newer epoch.
+	w.Header().Set(RingEpochHeader, strconv.FormatUint(h.ringEpoch(), 10))
 	w.Header().Set("Content-Type", "application/json")
 	switch r.Method {
 	case http.MethodPost:
 		value := r.URL.Query().Get("value")
-		h.handlePost(isForwarded, targets, key, value, r, w)
+		h.handlePost(isForwarded, targets, bucket, key, value, r, w)
 	case http.MethodGet:
-		h.handleGet(isForwarded, targets, key, r, w)
+		h.handleGet(isForwarded, targets, bucket, key, r, w)
+	case http.MethodDelete:
+		h.handleDelete(isForwarded, targets, bucket, key, r, w)
 	default:
 		writeJSONError(w, http.StatusMethodNotAllowed, "Method not supported")
 		return
 	}
 }
 
-func (h *Handler) handleGet(isForwarded bool, targets []string, key string, r *http.Request, w http.ResponseWriter) {
+// parseTimestamp accepts either unix nanoseconds or an RFC 3339 time.
+func parseTimestamp(raw string) (int64, error) {
+	if ts, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		return ts, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, raw)
+	if err != nil {
+		return 0, err
+	}
+	return t.UnixNano(), nil
+}
+
+func (h *Handler) getLocal(ctx context.Context, bucket string, key string, asOf int64) (model.ValueVersion, bool) {
+	span := startStoreSpan(ctx, "store.get", bucket, key)
+	defer span.End()
+	if asOf > 0 {
+		return h.Store.GetAt(bucket, key, asOf)
+	}
+	return h.Store.Get(bucket, key)
+}
+
+func (h *Handler) handleGet(isForwarded bool, targets []string, bucket model.Bucket, key string, r *http.Request, w http.ResponseWriter) {
+	var asOf int64
+	if raw := r.URL.Query().Get("as_of"); raw != "" {
+		parsed, err := parseTimestamp(raw)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "Invalid as_of")
+			return
+		}
+		asOf = parsed
+	}
 	var valueVersion model.ValueVersion
 	if isForwarded {
-		valueVersion, ok := h.Store.Get(key)
+		valueVersion, ok := h.getLocal(r.Context(), bucket.Name, key, asOf)
 		if !ok {
 			errorMsg := fmt.Sprintf("Key %v not found on node %v", key, h.SelfURL)
-			writeJSONError(w, http.StatusNotFound, errorMsg)
+			writeJSONErrorCode(w, http.StatusNotFound, ErrorCodeKeyNotFound, errorMsg)
 			return
 		}
 		logging.Infof("GET [%v -> %v] local", key, valueVersion)
 		resp := KVResponse{
+			Bucket:    bucket.Name,
 			Key:       key,
 			Value:     valueVersion.Value,
 			Timestamp: valueVersion.Timestamp,
+			ExpiresAt: valueVersion.ExpiresAt,
+			Type:      valueVersion.Type,
+			Node:      valueVersion.Node,
+			Base:      valueVersion.Base,
+			Deleted:   valueVersion.Deleted,
 		}
 		err := json.NewEncoder(w).Encode(resp)
 		if err != nil {
@@ -103,52 +253,62 @@ func (h *Handler) handleGet(isForwarded bool, targets []string, key string, r *h
 			return
 		}
 	} else {
-		latestValue := ""
-		latestTimestamp := int64(0)
-
 		var successNodes []string
-		for _, target := range targets {
-			var val string
-			var ts int64
-			if target == h.SelfURL {
-				value, ok := h.Store.Get(key)
-				if !ok {
-					logging.Errorf("Key %v not found on node %v", key, h.SelfURL)
-					continue
-				}
-				val = value.Value
-				ts = value.Timestamp
+		replicaValues := make(map[string]model.ValueVersion)
+		redirected := false
+		for i := 0; i < len(targets); i++ {
+			target := targets[i]
+			var value model.ValueVersion
+			// A replica that answers it does not have the key still counts
+			// towards the quorum: it took part in the read, and read repair
+			// sends it the value if another replica has one. Otherwise a key
+			// missing on one of two replicas could not be read at R=2.
+			if target == h.SelfID {
+				value, _ = h.getLocal(r.Context(), bucket.Name, key, asOf)
 				successNodes = append(successNodes, target)
 			} else {
-				value, err := h.forward(target, r)
-				val = value.Value
-				ts = value.Timestamp
+				remote, err := h.forward(target, r)
+				if errors.Is(err, errKeyNotFound) {
+					err = nil
+				}
 				if err != nil {
 					logging.Errorf("Error forwarding request to %v: %v", target, err)
+					if errors.Is(err, errStaleRing) && !redirected {
+						redirected = true
+						targets = h.redirectTargets(bucket, key, targets, target)
+					}
 					continue
 				}
+				value = remote
 				successNodes = append(successNodes, target)
 			}
-			if ts > latestTimestamp {
-				latestValue = val
-				latestTimestamp = ts
+			replicaValues[target] = value
+			if value.Timestamp != 0 {
+				valueVersion = h.mergeVersions(bucket, key, valueVersion, value)
 			}
 		}
-		if len(successNodes) < h.ReadQuorum {
-			errorMsg := fmt.Sprintf("Read quorum not met: %d < %d, success nodes: %v", len(successNodes), h.ReadQuorum, successNodes)
-			writeJSONError(w, http.StatusInternalServerError, errorMsg)
+		if len(successNodes) < bucket.ReadQuorum {
+			errorMsg := fmt.Sprintf("Read quorum not met: %d < %d, success nodes: %v", len(successNodes), bucket.ReadQuorum, successNodes)
+			writeQuorumError(w, "get", errorMsg)
 			return
 		}
-		valueVersion = model.ValueVersion{
-			Value:     latestValue,
-			Timestamp: latestTimestamp,
+		if asOf == 0 {
+			go h.readRepair(context.WithoutCancel(r.Context()), bucket, key, valueVersion, replicaValues)
 		}
 		logging.Infof("GET [%v -> %v] from %v nodes: %v", key, valueVersion, len(successNodes), successNodes)
+		if valueVersion.Deleted || valueVersion.Timestamp == 0 {
+			writeJSONErrorCode(w, http.StatusNotFound, ErrorCodeKeyNotFound, fmt.Sprintf("Key %v not found", key))
+			return
+		}
 	}
 	resp := KVResponse{
+		Bucket:    bucket.Name,
 		Key:       key,
 		Value:     valueVersion.Value,
 		Timestamp: valueVersion.Timestamp,
+		ExpiresAt: valueVersion.ExpiresAt,
+		Type:      valueVersion.Type,
+		Node:      valueVersion.Node,
 	}
 	err := json.NewEncoder(w).Encode(resp)
 	if err != nil {
@@ -159,44 +319,139 @@ func (h *Handler) handleGet(isForwarded bool, targets []string, key string, r *h
 
 }
 
-func (h *Handler) handlePost(isForwarded bool, targets []string, key string, value string, r *http.Request, w http.ResponseWriter) {
+func (h *Handler) handlePost(isForwarded bool, targets []string, bucket model.Bucket, key string, value string, r *http.Request, w http.ResponseWriter) {
 	if value == "" {
 		writeJSONError(w, http.StatusBadRequest, "Missing value")
 		return
 	}
+	if bucket.MaxValueSize > 0 && len(value) > bucket.MaxValueSize {
+		errorMsg := fmt.Sprintf("Value size %d exceeds bucket limit %d", len(value), bucket.MaxValueSize)
+		writeJSONError(w, http.StatusRequestEntityTooLarge, errorMsg)
+		return
+	}
+	ttl := bucket.DefaultTTL
+	if rawTTL := r.URL.Query().Get("ttl"); rawTTL != "" {
+		parsed, err := strconv.ParseInt(rawTTL, 10, 64)
+		if err != nil || parsed < 0 {
+			writeJSONError(w, http.StatusBadRequest, "Invalid ttl")
+			return
+		}
+		ttl = parsed
+	}
+	now := time.Now()
 	valueVersion := model.ValueVersion{
 		Value:     value,
-		Timestamp: time.Now().UnixNano(),
+		Timestamp: now.UnixNano(),
+		Node:      h.SelfID,
+	}
+	if ttl > 0 {
+		valueVersion.ExpiresAt = now.Add(time.Duration(ttl) * time.Second).UnixNano()
 	}
 	if isForwarded {
-		h.Store.Put(key, valueVersion)
+		// Replicas store the coordinator's version so every copy of a
+		// write, and therefore every key history, is identical.
+		query := r.URL.Query()
+		if ts, err := strconv.ParseInt(query.Get("timestamp"), 10, 64); err == nil {
+			valueVersion.Timestamp = ts
+			valueVersion.ExpiresAt, _ = strconv.ParseInt(query.Get("expires_at"), 10, 64)
+			valueVersion.Node = query.Get("node")
+			valueVersion.Base, _ = strconv.ParseInt(query.Get("base"), 10, 64)
+		}
+		h.putLocal(r.Context(), bucket, key, valueVersion)
 		logging.Infof("PUT [%v -> %v] from forwarded request", key, value)
 	} else {
-		var successNodes []string
-		for _, target := range targets {
-			if target == h.SelfURL {
-				h.Store.Put(key, valueVersion)
-				successNodes = append(successNodes, target)
-			} else {
-				_, err := h.forward(target, r)
-				if err != nil {
-					logging.Errorf("Error forwarding request to %v: %v", target, err)
-					continue
-				}
-				successNodes = append(successNodes, target)
-			}
+		if local, ok := h.Store.Get(bucket.Name, key); ok {
+			valueVersion.Base = local.Timestamp
 		}
-		if len(successNodes) < h.WriteQuorum {
-			errorMsg := fmt.Sprintf("Write quorum not met: %d < %d, success nodes: %v", len(successNodes), h.WriteQuorum, successNodes)
-			writeJSONError(w, http.StatusInternalServerError, errorMsg)
+		successNodes := h.replicate(targets, bucket, key, valueVersion, r)
+		if len(successNodes) < bucket.WriteQuorum {
+			errorMsg := fmt.Sprintf("Write quorum not met: %d < %d, success nodes: %v", len(successNodes), bucket.WriteQuorum, successNodes)
+			writeQuorumError(w, "put", errorMsg)
 			return
 		}
 		logging.Infof("PUT [%v -> %v] to %d nodes: %v", key, value, len(successNodes), successNodes)
 	}
 	resp := KVResponse{
+		Bucket:    bucket.Name,
 		Key:       key,
 		Value:     valueVersion.Value,
 		Timestamp: valueVersion.Timestamp,
+		ExpiresAt: valueVersion.ExpiresAt,
+		Type:      valueVersion.Type,
+		Node:      valueVersion.Node,
+	}
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		logging.Errorf("Error encoding response: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Error encoding response")
+		return
+	}
+}
+
+// replicate stores a coordinator's version of a key on every target and
+// returns the nodes that accepted it. Remote replicas get the request with
+// the version's timestamp and node added.
+func (h *Handler) replicate(targets []string, bucket model.Bucket, key string, valueVersion model.ValueVersion, r *http.Request) []string {
+	query := r.URL.Query()
+	query.Set("timestamp", strconv.FormatInt(valueVersion.Timestamp, 10))
+	query.Set("expires_at", strconv.FormatInt(valueVersion.ExpiresAt, 10))
+	query.Set("node", valueVersion.Node)
+	query.Set("base", strconv.FormatInt(valueVersion.Base, 10))
+	r.URL.RawQuery = query.Encode()
+
+	var successNodes []string
+	redirected := false
+	for i := 0; i < len(targets); i++ {
+		target := targets[i]
+		if target == h.SelfID {
+			h.putLocal(r.Context(), bucket, key, valueVersion)
+			successNodes = append(successNodes, target)
+			continue
+		}
+		_, err := h.forward(target, r)
+		if err != nil {
+			logging.Errorf("Error forwarding request to %v: %v", target, err)
+			if errors.Is(err, errStaleRing) && !redirected {
+				redirected = true
+				targets = h.redirectTargets(bucket, key, targets, target)
+			}
+			continue
+		}
+		successNodes = append(successNodes, target)
+	}
+	return successNodes
+}
+
+// handleDelete replaces the key with a tombstone on its replicas.
+func (h *Handler) handleDelete(isForwarded bool, targets []string, bucket model.Bucket, key string, r *http.Request, w http.ResponseWriter) {
+	tombstone := model.ValueVersion{
+		Timestamp: time.Now().UnixNano(),
+		Node:      h.SelfID,
+		Deleted:   true,
+	}
+	if isForwarded {
+		query := r.URL.Query()
+		if ts, err := strconv.ParseInt(query.Get("timestamp"), 10, 64); err == nil {
+			tombstone.Timestamp = ts
+			tombstone.Node = query.Get("node")
+		}
+		h.putLocal(r.Context(), bucket, key, tombstone)
+		logging.Infof("DELETE [%v] from forwarded request", key)
+	} else {
+		successNodes := h.replicate(targets, bucket, key, tombstone, r)
+		if len(successNodes) < bucket.WriteQuorum {
+			errorMsg := fmt.Sprintf("Write quorum not met: %d < %d, success nodes: %v", len(successNodes), bucket.WriteQuorum, successNodes)
+			writeQuorumError(w, "delete", errorMsg)
+			return
+		}
+		logging.Infof("DELETE [%v] on %d nodes: %v", key, len(successNodes), successNodes)
+	}
+	resp := KVResponse{
+		Bucket:    bucket.Name,
+		Key:       key,
+		Timestamp: tombstone.Timestamp,
+		Node:      tombstone.Node,
+		Deleted:   true,
 	}
 	err := json.NewEncoder(w).Encode(resp)
 	if err != nil {
@@ -207,38 +462,81 @@ func (h *Handler) handlePost(isForwarded bool, targets []string, key string, val
 }
 
 func (h *Handler) forward(target string, r *http.Request) (model.ValueVersion, error) {
+	var valueVersion model.ValueVersion
+	if err := h.forwardJSON(target, r, &valueVersion); err != nil {
+		return model.ValueVersion{}, err
+	}
+	return valueVersion, nil
+}
+
+func (h *Handler) forwardJSON(target string, r *http.Request, out interface{}) (err error) {
+	header := r.Header.Clone()
+	// A client that hangs up must not stop the hop half way, or replicas
+	// would diverge from what the coordinator already stored.
+	ctx, span := startPeerSpan(context.WithoutCancel(r.Context()), "forward", target, header)
+	span.SetAttribute("url.path", r.URL.Path)
+	defer func() {
+		if err != nil && err != errKeyNotFound {
+			forwardErrors.Inc(target)
+			span.SetError(err)
+		}
+		span.End()
+	}()
+	address, err := h.addressOf(target)
+	if err != nil {
+		return err
+	}
 	client := &http.Client{}
-	targetURL := target + r.URL.Path
+	targetURL := address + r.URL.Path
 	if r.URL.RawQuery != "" {
 		targetURL += "?" + r.URL.RawQuery
 	}
-	req, err := http.NewRequest(r.Method, targetURL, nil)
+	req, err := http.NewRequestWithContext(ctx, r.Method, targetURL, nil)
 	if err != nil {
-		return model.ValueVersion{}, fmt.Errorf("create request failed: %v", err)
+		return fmt.Errorf("create request failed: %v", err)
 	}
-	req.Header = r.Header
+	req.Header = header
 	req.Header.Set("X-From-Node", "true")
+	h.setRingHeaders(req.Header)
 	resp, err := client.Do(req)
 	if err != nil {
-		return model.ValueVersion{}, fmt.Errorf("do request failed: %v", err)
+		return fmt.Errorf("do request failed: %v", err)
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusConflict {
+		return h.handleStaleRing(resp)
+	}
 	if resp.StatusCode != http.StatusOK {
-		return model.ValueVersion{}, fmt.Errorf("request failed: %v", resp.Status)
+		var errResp ErrorResponse
+		if json.NewDecoder(resp.Body).Decode(&errResp) == nil && errResp.Code == ErrorCodeKeyNotFound {
+			return errKeyNotFound
+		}
+		return fmt.Errorf("request failed: %v", resp.Status)
 	}
-	var valueVersion model.ValueVersion
-	if err := json.NewDecoder(resp.Body).Decode(&valueVersion); err != nil {
-		return model.ValueVersion{}, fmt.Errorf("decode response failed: %v", err)
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decode response failed: %v", err)
 	}
-	return valueVersion, nil
+	return nil
 }
 
 func (h *Handler) GetAllHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
 		all := h.Store.All()
+		for _, keys := range all {
+			for key, value := range keys {
+				if value.Deleted {
+					delete(keys, key)
+				}
+			}
+		}
 		w.Header().Set("Content-Type", "application/json")
-		err := json.NewEncoder(w).Encode(all)
+		var err error
+		if bucket := r.URL.Query().Get("bucket"); bucket != "" {
+			err = json.NewEncoder(w).Encode(all[bucket])
+		} else {
+			err = json.NewEncoder(w).Encode(all)
+		}
 		if err != nil {
 			logging.Errorf("Error encoding response: %v", err)
 			writeJSONError(w, http.StatusInternalServerError, "Error encoding response")
@@ -260,18 +558,8 @@ func (h *Handler) GossipHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		logging.Debugf("Gossip received from %v", msg.Sender)
-
-		for url, incomingPeer := range msg.Peers {
-			local, exists := h.Peers[url]
-			if !exists || incomingPeer.LastSeen.After(local.LastSeen) {
-				h.Peers[url] = &model.PeerInfo{
-					URL:      url,
-					LastSeen: incomingPeer.LastSeen,
-				}
-			}
-		}
-		h.updateHashRingPeers()
-		h.Peers[msg.Sender].LastSeen = time.Now()
+		h.applyGossip(msg)
+		h.markSeen(msg.Sender)
 
 	default:
 		writeJSONError(w, http.StatusMethodNotAllowed, "Method not supported")
@@ -279,37 +567,59 @@ func (h *Handler) GossipHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (h *Handler) SendGossip(target string) {
-	alivePeers := make(map[string]*model.PeerInfo)
-	now := time.Now()
-
-	for url, peer := range h.Peers {
-		if now.Sub(peer.LastSeen) < PeerTimeout {
-			alivePeers[url] = peer
-		}
+func (h *Handler) applyGossip(msg GossipMessage) {
+	for id, incomingPeer := range msg.Peers {
+		h.applyMemberUpdate(MemberUpdate{
+			ID:          id,
+			URL:         incomingPeer.URL,
+			State:       incomingPeer.State,
+			Incarnation: incomingPeer.Incarnation,
+			Vnodes:      incomingPeer.Vnodes,
+			Zone:        incomingPeer.Zone,
+		})
 	}
+	h.mergeRing(msg.Ring)
+	h.mergeBuckets(msg.Buckets)
+	h.mergeIndexes(msg.Indexes)
+}
 
-	msg := GossipMessage{
-		Sender: h.SelfURL,
-		Peers:  alivePeers,
+func (h *Handler) gossipSnapshot() GossipMessage {
+	ring := h.ringSnapshot()
+	return GossipMessage{
+		Sender:  h.SelfID,
+		Peers:   h.peerSnapshot(),
+		Buckets: h.bucketSnapshot(),
+		Indexes: h.indexSnapshot(),
+		Ring:    &ring,
 	}
-	jsonData, err := json.Marshal(msg)
+}
+
+// SendGossip pushes the full membership table and cluster metadata to a
+// peer. Liveness itself is decided by the SWIM probes; this periodic full
+// sync repairs anything the piggybacked updates missed.
+func (h *Handler) SendGossip(target string) {
+	jsonData, err := json.Marshal(h.gossipSnapshot())
 	if err != nil {
 		logging.Errorf("Error encoding gossip message: %v", err)
 		return
 	}
+	targetURL, err := h.addressOf(target)
+	if err != nil {
+		logging.Errorf("Error sending gossip to %s: %v", target, err)
+		return
+	}
 	client := &http.Client{Timeout: 1 * time.Second}
-	resp, err := client.Post(target+"/kv/gossip", "application/json", bytes.NewBuffer(jsonData))
+	resp, err := client.Post(targetURL+"/kv/gossip", "application/json", bytes.NewBuffer(jsonData))
 	if err != nil {
 		logging.Errorf("Error sending gossip to %s: %v", target, err)
+		gossipMessages.Inc("error")
 		return
 	}
 	defer resp.Body.Close()
 	logging.Debugf("Sent gossip to %s, status: %s", target, resp.Status)
+	gossipMessages.Inc("ok")
 
-	h.Mu.Lock()
-	h.Peers[target].LastSeen = time.Now()
-	h.Mu.Unlock()
+	h.markSeen(target)
 }
 
 func (h *Handler) HealthHandler(w http.ResponseWriter, r *http.Request) {
@@ -320,113 +630,95 @@ func (h *Handler) HealthHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (h *Handler) updateHashRingPeers() {
-	newNodes := []string{}
-	now := time.Now()
-	for _, peer := range h.Peers {
-		if now.Sub(peer.LastSeen) > PeerTimeout {
-			continue
-		}
-		if !h.HashRing.ContainsPeer(peer.URL) {
-			h.HashRing.AddNode(peer.URL)
-			newNodes = append(newNodes, peer.URL)
-		}
-	}
-	if len(newNodes) > 0 {
-		logging.Debugf("Gossip updated new peers: %v", h.Peers)
-	}
-	for _, node := range newNodes {
-		go h.migrateKeysToNode(node)
-	}
-}
-
 func (h *Handler) StartGossiping() {
+	h.initSelf()
+	h.gossipStop = make(chan struct{})
+	h.gossipDone = make(chan struct{})
 	go func() {
-		ticker := time.NewTicker(GossipInterval)
+		defer close(h.gossipDone)
+		interval := h.settings().GossipInterval
+		ticker := time.NewTicker(interval)
 		defer ticker.Stop()
 
-		for range ticker.C {
-			if peerURL, ok := h.PickRandomPeerToGossip(); ok {
-				h.SendGossip(peerURL)
+		for {
+			select {
+			case <-ticker.C:
+			case <-h.gossipStop:
+				return
 			}
-			deadNodes := []string{}
-			for _, peer := range h.Peers {
-				if !(peer.URL == h.SelfURL) && time.Since(peer.LastSeen) >= PeerTimeout && h.HashRing.ContainsPeer(peer.URL) {
-					h.HashRing.RemoveNode(peer.URL)
-					deadNodes = append(deadNodes, peer.URL)
-					continue
-				}
+			if current := h.settings().GossipInterval; current != interval {
+				interval = current
+				ticker.Reset(interval)
 			}
-			for _, node := range deadNodes {
-				go h.migrateKeysFromDeadNode(node)
+			gossipRounds.Inc()
+			if peerID, ok := h.PickRandomPeerToGossip(); ok {
+				h.SendGossip(peerID)
 			}
+			h.contactSeeds()
+			h.probe()
+			h.expireSuspects()
+			h.maybeCleanup()
 		}
 	}()
 }
 
-func (h *Handler) PickRandomPeerToGossip() (string, bool) {
-	var candidates []string
-	for url, peer := range h.Peers {
-		if url == h.SelfURL {
-			continue
-		}
-		if time.Since(peer.LastSeen) <= PeerTimeout {
-			candidates = append(candidates, url)
-		}
-	}
-	if len(candidates) == 0 {
-		return "", false
-	}
-	randomIndex := rand.Intn(len(candidates))
-	return candidates[randomIndex], true
-}
-
-func (h *Handler) migrateKeysToNode(nodeURL string) {
-	allData := h.Store.All()
-	for key, valueVersion := range allData {
-		nodes := h.HashRing.GetNodesForKey(key, h.Replicas)
-		for _, n := range nodes {
-			if n == nodeURL && nodeURL != h.SelfURL {
-				err := h.sendKeyValue(nodeURL, key, valueVersion)
-				if err != nil {
-					return
-				}
-				break
-			}
-		}
+// StopGossiping stops the loop started by StartGossiping and waits for the
+// round in progress to finish.
+func (h *Handler) StopGossiping() {
+	if h.gossipStop == nil {
+		return
 	}
+	h.stopGossip.Do(func() { close(h.gossipStop) })
+	<-h.gossipDone
 }
 
-func (h *Handler) migrateKeysFromDeadNode(deadNodeURL string) {
-	allData := h.Store.All()
-	for key, valueVersion := range allData {
-		nodes := h.HashRing.GetNodesForKey(key, h.Replicas)
-
-		logging.Infof("Migrating key %s from dead node %s", key, deadNodeURL)
-		for _, newNode := range nodes {
-			if newNode != h.SelfURL {
-				if err := h.sendKeyValue(newNode, key, valueVersion); err != nil {
-					logging.Errorf("Error migrating key %s to %s: %v", key, newNode, err)
-				}
-			}
-		}
-
+func (h *Handler) PickRandomPeerToGossip() (string, bool) {
+	candidates := h.randomMembers(1)
+	if len(candidates) == 0 {
+		return "", false
 	}
+	return candidates[0], true
 }
 
 type InternalPutRequest struct {
 	Sender    string `json:"sender"`
+	Bucket    string `json:"bucket"`
 	Key       string `json:"key"`
 	Value     string `json:"value"`
 	Timestamp int64  `json:"timestamp"`
+	ExpiresAt int64  `json:"expires_at,omitempty"`
+	Type      string `json:"type,omitempty"`
+	Node      string `json:"node,omitempty"`
+	Base      int64  `json:"base,omitempty"`
+	Deleted   bool   `json:"deleted,omitempty"`
+
+	History []model.ValueVersion `json:"history,omitempty"`
 }
 
-func (h *Handler) sendKeyValue(targetNode string, key string, value model.ValueVersion) error {
+func (h *Handler) sendKeyValue(ctx context.Context, targetNode string, bucket string, key string, value model.ValueVersion) (err error) {
+	header := make(http.Header)
+	ctx, span := startPeerSpan(context.WithoutCancel(ctx), "sendKeyValue", targetNode, header)
+	span.SetAttribute("kvstore.bucket", bucket)
+	span.SetAttribute("kvstore.key", key)
+	defer func() {
+		if err != nil {
+			forwardErrors.Inc(targetNode)
+			span.SetError(err)
+		}
+		span.End()
+	}()
 	reqBody := InternalPutRequest{
-		Sender:    h.SelfURL,
+		Sender:    h.SelfID,
+		Bucket:    bucket,
 		Key:       key,
 		Value:     value.Value,
 		Timestamp: value.Timestamp,
+		ExpiresAt: value.ExpiresAt,
+		Type:      value.Type,
+		Node:      value.Node,
+		Base:      value.Base,
+		Deleted:   value.Deleted,
+		History:   h.Store.History(bucket, key),
 	}
 
 	body, err := json.Marshal(reqBody)
@@ -434,13 +726,27 @@ func (h *Handler) sendKeyValue(targetNode string, key string, value model.ValueV
 		return fmt.Errorf("marshal payload: %w", err)
 	}
 
-	url := fmt.Sprintf("%s/kv/internal", targetNode)
-	resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+	targetURL, err := h.addressOf(targetNode)
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("%s/kv/internal", targetURL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("create request failed: %v", err)
+	}
+	req.Header = header
+	req.Header.Set("Content-Type", "application/json")
+	h.setRingHeaders(req.Header)
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("post to %s: %w", url, err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusConflict {
+		return h.handleStaleRing(resp)
+	}
 	if resp.StatusCode != http.StatusOK {
 		respBody, _ := io.ReadAll(resp.Body)
 		return fmt.Errorf("sendKeyValue: node %s returned status %d: %s",
@@ -454,18 +760,43 @@ func (h *Handler) sendKeyValue(targetNode string, key string, value model.ValueV
 func (h *Handler) InternalPutHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodPost:
+		// Like forwarded requests, a write from a node with an older ring
+		// could land in a range this node no longer holds.
+		if !h.checkRingEpoch(w, r) {
+			return
+		}
 		var req InternalPutRequest
 		err := json.NewDecoder(r.Body).Decode(&req)
 		if err != nil {
 			writeJSONError(w, http.StatusInternalServerError, "Error decoding request")
 			return
 		}
-		logging.Infof("Internal put received key %v from %v", req.Key, req.Sender)
-		h.Store.Put(req.Key, model.ValueVersion{
-			Value:     req.Value,
-			Timestamp: req.Timestamp,
-		})
+		logging.Infof("Internal put received key %v/%v from %v", req.Bucket, req.Key, req.Sender)
+		h.applyInternalPut(r.Context(), req)
 		w.WriteHeader(http.StatusOK)
 	}
 
 }
+
+func (h *Handler) applyInternalPut(ctx context.Context, req InternalPutRequest) {
+	if req.Bucket == "" {
+		req.Bucket = model.DefaultBucket
+	}
+	incoming := model.ValueVersion{
+		Value:     req.Value,
+		Timestamp: req.Timestamp,
+		ExpiresAt: req.ExpiresAt,
+		Type:      req.Type,
+		Node:      req.Node,
+		Base:      req.Base,
+		Deleted:   req.Deleted,
+	}
+	bucket, ok := h.getBucket(req.Bucket)
+	if !ok {
+		bucket = model.Bucket{Name: req.Bucket}
+	}
+	if len(req.History) > 0 {
+		h.Store.PutHistory(req.Bucket, req.Key, req.History)
+	}
+	h.putLocal(ctx, bucket, req.Key, incoming)
+}
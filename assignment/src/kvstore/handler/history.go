@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"kvstore/logging"
+	"kvstore/model"
+	"net/http"
+	"sort"
+)
+
+type HistoryResponse struct {
+	Bucket   string               `json:"bucket"`
+	Key      string               `json:"key"`
+	Versions []model.ValueVersion `json:"versions"`
+}
+
+func (h *Handler) HistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not supported")
+		return
+	}
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		writeJSONError(w, http.StatusBadRequest, "Missing key")
+		return
+	}
+	bucket, ok := h.getBucket(r.URL.Query().Get("bucket"))
+	if !ok {
+		writeJSONErrorCode(w, http.StatusNotFound, ErrorCodeBucketNotFound, "Bucket not found")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	resp := HistoryResponse{Bucket: bucket.Name, Key: key}
+	if r.Header.Get("X-From-Node") == "true" {
+		if !h.checkRingEpoch(w, r) {
+			return
+		}
+		resp.Versions = h.Store.History(bucket.Name, key)
+	} else {
+		// Versions are keyed by the coordinator's timestamp, so the union of
+		// a read quorum contains every version acknowledged by a write quorum.
+		versions := make(map[int64]model.ValueVersion)
+		var successNodes []string
+		for _, target := range h.getResponsibleNodes(bucket, key) {
+			var history HistoryResponse
+			if target == h.SelfID {
+				history.Versions = h.Store.History(bucket.Name, key)
+			} else if err := h.forwardJSON(target, r, &history); err != nil {
+				logging.Errorf("Error forwarding request to %v: %v", target, err)
+				continue
+			}
+			successNodes = append(successNodes, target)
+			for _, version := range history.Versions {
+				if existing, ok := versions[version.Timestamp]; ok {
+					version = h.mergeVersions(bucket, key, existing, version)
+				}
+				versions[version.Timestamp] = version
+			}
+		}
+		if len(successNodes) < bucket.ReadQuorum {
+			errorMsg := fmt.Sprintf("Read quorum not met: %d < %d, success nodes: %v", len(successNodes), bucket.ReadQuorum, successNodes)
+			writeQuorumError(w, "history", errorMsg)
+			return
+		}
+		for _, version := range versions {
+			resp.Versions = append(resp.Versions, version)
+		}
+		sort.Slice(resp.Versions, func(i, j int) bool {
+			return resp.Versions[i].Timestamp < resp.Versions[j].Timestamp
+		})
+	}
+	if resp.Versions == nil {
+		resp.Versions = []model.ValueVersion{}
+	}
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		logging.Errorf("Error encoding response: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Error encoding response")
+	}
+}
@@ -0,0 +1,255 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"kvstore/logging"
+	"kvstore/model"
+	"kvstore/store"
+	"net/http"
+	"sort"
+	"time"
+)
+
+type QueryResponse struct {
+	Index       string       `json:"index"`
+	Value       string       `json:"value"`
+	Results     []KVResponse `json:"results"`
+	Nodes       []string     `json:"nodes"`
+	FailedNodes []string     `json:"failed_nodes,omitempty"`
+}
+
+// mergeIndexes applies index definitions learned from a peer and builds the
+// local index for each new or changed definition.
+func (h *Handler) mergeIndexes(incoming map[string]*model.Index) {
+	h.indexesMu.Lock()
+	defer h.indexesMu.Unlock()
+	for name, index := range incoming {
+		if index == nil {
+			continue
+		}
+		local, exists := h.Indexes[name]
+		if exists && index.UpdatedAt <= local.UpdatedAt {
+			continue
+		}
+		if h.Indexes == nil {
+			h.Indexes = make(map[string]*model.Index)
+		}
+		copied := *index
+		h.Indexes[name] = &copied
+		h.Store.DefineIndex(copied)
+		logging.Infof("Index %v defined on path %v (bucket %q, prefix %q)", name, copied.Path, copied.Bucket, copied.Prefix)
+	}
+}
+
+func (h *Handler) indexSnapshot() map[string]*model.Index {
+	h.indexesMu.RLock()
+	defer h.indexesMu.RUnlock()
+	indexes := make(map[string]*model.Index, len(h.Indexes))
+	for name, index := range h.Indexes {
+		copied := *index
+		indexes[name] = &copied
+	}
+	return indexes
+}
+
+func (h *Handler) IndexesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case http.MethodGet:
+		snapshot := h.indexSnapshot()
+		indexes := make([]*model.Index, 0, len(snapshot))
+		for _, index := range snapshot {
+			indexes = append(indexes, index)
+		}
+		sort.Slice(indexes, func(i, j int) bool {
+			return indexes[i].Name < indexes[j].Name
+		})
+		err := json.NewEncoder(w).Encode(indexes)
+		if err != nil {
+			logging.Errorf("Error encoding response: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "Error encoding response")
+			return
+		}
+	case http.MethodPost:
+		var index model.Index
+		err := json.NewDecoder(r.Body).Decode(&index)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "Error decoding request")
+			return
+		}
+		if index.Name == "" || index.Path == "" {
+			writeJSONError(w, http.StatusBadRequest, "Index name and path are required")
+			return
+		}
+		if index.Bucket != "" {
+			if _, ok := h.getBucket(index.Bucket); !ok {
+				writeJSONErrorCode(w, http.StatusNotFound, ErrorCodeBucketNotFound, "Bucket not found")
+				return
+			}
+		}
+		index.UpdatedAt = time.Now().UnixNano()
+		h.mergeIndexes(map[string]*model.Index{index.Name: &index})
+		err = json.NewEncoder(w).Encode(index)
+		if err != nil {
+			logging.Errorf("Error encoding response: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "Error encoding response")
+			return
+		}
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not supported")
+		return
+	}
+}
+
+func (h *Handler) QueryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not supported")
+		return
+	}
+	index := r.URL.Query().Get("index")
+	value := r.URL.Query().Get("value")
+	if index == "" {
+		writeJSONError(w, http.StatusBadRequest, "Missing index")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Header.Get("X-From-Node") == "true" {
+		results, ok := h.localLookup(index, value)
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, fmt.Sprintf("Index %v not found on node %v", index, h.SelfURL))
+			return
+		}
+		err := json.NewEncoder(w).Encode(results)
+		if err != nil {
+			logging.Errorf("Error encoding response: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "Error encoding response")
+		}
+		return
+	}
+
+	resp := QueryResponse{Index: index, Value: value}
+	latest := make(map[string]KVResponse)
+	collect := func(results []KVResponse) {
+		for _, result := range results {
+			id := result.Bucket + "/" + result.Key
+			if current, ok := latest[id]; !ok || result.Timestamp > current.Timestamp {
+				latest[id] = result
+			}
+		}
+	}
+	for _, target := range h.Placement.GetAllPeers() {
+		if target == h.SelfID {
+			results, ok := h.localLookup(index, value)
+			if !ok {
+				resp.FailedNodes = append(resp.FailedNodes, target)
+				continue
+			}
+			collect(results)
+			resp.Nodes = append(resp.Nodes, target)
+			continue
+		}
+		var results []KVResponse
+		if err := h.forwardJSON(target, r, &results); err != nil {
+			logging.Errorf("Error querying index %v on %v: %v", index, target, err)
+			resp.FailedNodes = append(resp.FailedNodes, target)
+			continue
+		}
+		collect(results)
+		resp.Nodes = append(resp.Nodes, target)
+	}
+	if len(resp.Nodes) == 0 {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Index query failed on all nodes: %v", resp.FailedNodes))
+		return
+	}
+
+	def, defined := h.indexSnapshot()[index]
+	resp.Results = make([]KVResponse, 0, len(latest))
+	for _, result := range latest {
+		if defined {
+			var ok bool
+			if result, ok = h.recheckMatch(r.Context(), *def, value, result); !ok {
+				continue
+			}
+		}
+		resp.Results = append(resp.Results, result)
+	}
+	sort.Slice(resp.Results, func(i, j int) bool {
+		if resp.Results[i].Bucket != resp.Results[j].Bucket {
+			return resp.Results[i].Bucket < resp.Results[j].Bucket
+		}
+		return resp.Results[i].Key < resp.Results[j].Key
+	})
+	logging.Infof("QUERY [%v = %v] matched %d keys from %d nodes", index, value, len(resp.Results), len(resp.Nodes))
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		logging.Errorf("Error encoding response: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Error encoding response")
+	}
+}
+
+// recheckMatch reads the latest version of a matched key from its replicas.
+// A replica may still index an old version that matched while a newer one no
+// longer does, or the key was deleted since; such hits are dropped. A hit no
+// replica could be asked about is kept as it is.
+func (h *Handler) recheckMatch(ctx context.Context, index model.Index, value string, result KVResponse) (KVResponse, bool) {
+	bucket, ok := h.getBucket(result.Bucket)
+	if !ok {
+		return result, false
+	}
+	var latest model.ValueVersion
+	answered := false
+	for _, target := range h.getResponsibleNodes(bucket, result.Key) {
+		var version model.ValueVersion
+		var found bool
+		if target == h.SelfID {
+			version, found = h.getLocal(ctx, bucket.Name, result.Key, 0)
+		} else {
+			var err error
+			version, found, err = h.fetchReplica(ctx, target, bucket.Name, result.Key)
+			if err != nil {
+				logging.Errorf("Error reading %v from %v: %v", result.Key, target, err)
+				continue
+			}
+		}
+		answered = true
+		if found && version.Timestamp != 0 {
+			latest = h.mergeVersions(bucket, result.Key, latest, version)
+		}
+	}
+	if !answered {
+		return result, true
+	}
+	if latest.Timestamp == 0 || latest.Deleted || latest.Expired(time.Now().UnixNano()) {
+		return result, false
+	}
+	if field, ok := store.ExtractJSONPath(latest.Value, index.Path); !ok || field != value {
+		return result, false
+	}
+	result.Value = latest.Value
+	result.Timestamp = latest.Timestamp
+	result.ExpiresAt = latest.ExpiresAt
+	return result, true
+}
+
+func (h *Handler) localLookup(index string, value string) ([]KVResponse, bool) {
+	matches, ok := h.Store.Lookup(index, value)
+	if !ok {
+		return nil, false
+	}
+	results := []KVResponse{}
+	for bucket, keys := range matches {
+		for key, valueVersion := range keys {
+			results = append(results, KVResponse{
+				Bucket:    bucket,
+				Key:       key,
+				Value:     valueVersion.Value,
+				Timestamp: valueVersion.Timestamp,
+				ExpiresAt: valueVersion.ExpiresAt,
+			})
+		}
+	}
+	return results, true
+}
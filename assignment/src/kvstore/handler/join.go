@@ -0,0 +1,106 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"kvstore/logging"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+const JoinInitialBackoff = 500 * time.Millisecond
+const JoinMaxBackoff = 30 * time.Second
+
+// JoinCluster performs the join handshake with the configured seeds,
+// retrying with exponential backoff until one of them answers. A node without
+// seeds starts a new cluster on its own.
+func (h *Handler) JoinCluster() {
+	if h.Seeds.Empty() {
+		logging.Infof("No seeds configured, starting a new cluster")
+		return
+	}
+	backoff := JoinInitialBackoff
+	for attempt := 1; ; attempt++ {
+		seeds, err := h.Seeds.Resolve()
+		if err != nil {
+			logging.Errorf("Error resolving seeds: %v", err)
+		}
+		for _, seed := range seeds {
+			if seed == h.SelfURL {
+				continue
+			}
+			if err := h.join(seed); err != nil {
+				logging.Infof("Join via %v failed: %v", seed, err)
+				continue
+			}
+			logging.Infof("Joined cluster via %v after %d attempts", seed, attempt)
+			return
+		}
+		// Jitter keeps nodes started together from retrying in lockstep.
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+		logging.Infof("No seed reachable (attempt %d), retrying in %v", attempt, wait)
+		time.Sleep(wait)
+		backoff *= 2
+		if backoff > JoinMaxBackoff {
+			backoff = JoinMaxBackoff
+		}
+	}
+}
+
+// join announces this node to a seed and adopts the membership, ring and
+// cluster metadata the seed answers with.
+func (h *Handler) join(seed string) error {
+	body, err := json.Marshal(h.selfUpdate())
+	if err != nil {
+		return fmt.Errorf("marshal join request: %w", err)
+	}
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Post(seed+"/cluster/join", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("post to %s: %w", seed, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d", seed, resp.StatusCode)
+	}
+	var msg GossipMessage
+	if err := json.NewDecoder(resp.Body).Decode(&msg); err != nil {
+		return fmt.Errorf("decode join response: %w", err)
+	}
+	// A seed list naming this node under another address, e.g. 127.0.0.1
+	// instead of localhost, must not count as joining a cluster.
+	if msg.Sender == h.SelfID {
+		return fmt.Errorf("%s is this node", seed)
+	}
+	h.applyGossip(msg)
+	h.markSeen(msg.Sender)
+	return nil
+}
+
+func (h *Handler) JoinHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not supported")
+		return
+	}
+	var joiner MemberUpdate
+	if err := json.NewDecoder(r.Body).Decode(&joiner); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Error decoding request")
+		return
+	}
+	if joiner.ID == "" || joiner.URL == "" {
+		writeJSONError(w, http.StatusBadRequest, "Joining node must send its id and url")
+		return
+	}
+	logging.Infof("Node %v joining from %v", joiner.ID, joiner.URL)
+	h.applyMemberUpdate(joiner)
+	h.markSeen(joiner.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(h.gossipSnapshot())
+	if err != nil {
+		logging.Errorf("Error encoding response: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Error encoding response")
+	}
+}
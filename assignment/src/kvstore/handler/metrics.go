@@ -0,0 +1,109 @@
+package handler
+
+import (
+	"kvstore/metrics"
+	"kvstore/model"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	httpRequests = metrics.NewCounterVec("kvstore_http_requests_total",
+		"HTTP requests served, by route, method and status code.", "route", "method", "code")
+	httpDuration = metrics.NewHistogramVec("kvstore_http_request_duration_seconds",
+		"Latency of HTTP requests served, by route, method and status code.", metrics.DefaultBuckets, "route", "method", "code")
+	quorumFailures = metrics.NewCounterVec("kvstore_quorum_failures_total",
+		"Requests that failed because too few replicas answered, by operation.", "op")
+	forwardErrors = metrics.NewCounterVec("kvstore_forward_errors_total",
+		"Failed requests to other nodes, by peer id.", "peer")
+	gossipRounds = metrics.NewCounterVec("kvstore_gossip_rounds_total",
+		"Rounds of the gossip loop.")
+	gossipMessages = metrics.NewCounterVec("kvstore_gossip_messages_total",
+		"Gossip messages sent, by result.", "result")
+	migratedKeys = metrics.NewCounterVec("kvstore_migrated_keys_total",
+		"Keys this node sent to new owners or removed as unowned, by reason.", "reason")
+	transfersFinished = metrics.NewCounterVec("kvstore_transfers_total",
+		"Rebalancing transfers that finished, by state.", "state")
+
+	peerUp = metrics.NewGaugeVec("kvstore_peer_up",
+		"1 if the member is alive or suspected, 0 otherwise, by peer id.", "peer")
+	peersByState = metrics.NewGaugeVec("kvstore_peers",
+		"Known members by state, this node included.", "state")
+	ringMembers = metrics.NewGaugeVec("kvstore_ring_members",
+		"Members in the ring.")
+	ringEpoch = metrics.NewGaugeVec("kvstore_ring_epoch",
+		"Epoch of this node's ring state.")
+	transfersRunning = metrics.NewGaugeVec("kvstore_transfers_running",
+		"Rebalancing transfers in progress, including queued ones.")
+)
+
+// Instrument counts every request to next and measures its latency. Routes
+// are labelled with the pattern they matched, so next must be a ServeMux.
+func Instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		code := strconv.Itoa(recorder.status)
+		httpRequests.Inc(route, r.Method, code)
+		httpDuration.Observe(time.Since(start).Seconds(), route, r.Method, code)
+	})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if !s.wroteHeader {
+		s.status = status
+		s.wroteHeader = true
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// RegisterMetrics reports membership, ring and transfer gauges on every
+// scrape.
+func (h *Handler) RegisterMetrics() {
+	metrics.OnScrape(h.collectMetrics)
+}
+
+func (h *Handler) collectMetrics() {
+	peerUp.Reset()
+	peersByState.Reset()
+	for _, state := range []model.PeerState{model.PeerAlive, model.PeerSuspect, model.PeerDead, model.PeerLeft} {
+		peersByState.Set(0, string(state))
+	}
+	for id, peer := range h.peerSnapshot() {
+		peersByState.Add(1, string(peer.State))
+		if id == h.SelfID {
+			continue
+		}
+		up := 0.0
+		if !peer.IsGone() {
+			up = 1
+		}
+		peerUp.Set(up, id)
+	}
+
+	ring := h.ringSnapshot()
+	ringMembers.Set(float64(len(ring.ActiveMembers())))
+	ringEpoch.Set(float64(ring.Epoch))
+
+	h.rebalancing.mu.Lock()
+	running := 0
+	for _, t := range h.rebalancing.transfers {
+		if !t.finished() {
+			running++
+		}
+	}
+	h.rebalancing.mu.Unlock()
+	transfersRunning.Set(float64(running))
+}
@@ -0,0 +1,76 @@
+package handler
+
+import (
+	"encoding/json"
+	"kvstore/logging"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const DefaultPhiThreshold = 8.0
+
+type PhiResponse struct {
+	ID           string  `json:"id"`
+	URL          string  `json:"url"`
+	State        string  `json:"state"`
+	Incarnation  uint64  `json:"incarnation"`
+	Phi          float64 `json:"phi"`
+	Available    bool    `json:"available"`
+	Threshold    float64 `json:"threshold"`
+	Samples      int     `json:"samples"`
+	MeanInterval string  `json:"mean_interval"`
+	StdDev       string  `json:"std_dev"`
+	LastSeen     string  `json:"last_seen"`
+}
+
+func (h *Handler) phiThreshold() float64 {
+	threshold := h.settings().PhiThreshold
+	if threshold <= 0 {
+		return DefaultPhiThreshold
+	}
+	return threshold
+}
+
+func (h *Handler) PhiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not supported")
+		return
+	}
+	now := time.Now()
+	threshold := h.phiThreshold()
+	h.Mu.Lock()
+	// An empty list encodes as [] rather than null.
+	resp := make([]PhiResponse, 0, len(h.Peers))
+	for id, peer := range h.Peers {
+		if id == h.SelfID {
+			continue
+		}
+		phi, ok := peer.Phi(now)
+		mean, stdDev := peer.HeartbeatStats()
+		resp = append(resp, PhiResponse{
+			ID:           id,
+			URL:          peer.URL,
+			State:        string(peer.State),
+			Incarnation:  peer.Incarnation,
+			Phi:          phi,
+			Available:    ok,
+			Threshold:    threshold,
+			Samples:      len(peer.Intervals),
+			MeanInterval: mean.String(),
+			StdDev:       stdDev.String(),
+			LastSeen:     peer.LastSeen.Format(time.RFC3339Nano),
+		})
+	}
+	h.Mu.Unlock()
+	sort.Slice(resp, func(i, j int) bool {
+		return resp[i].URL < resp[j].URL
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		logging.Errorf("Error encoding response: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Error encoding response")
+	}
+}
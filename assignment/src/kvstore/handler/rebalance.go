@@ -0,0 +1,518 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"kvstore/hash"
+	"kvstore/logging"
+	"kvstore/model"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Rebalancing streams the keys whose replicas changed to their new owners.
+// Each target gets one transfer that sends its keys range by range in token
+// order, in batches, remembering the last acknowledged key so a failed
+// transfer resumes where it stopped. A transfer that keeps failing is queued
+// and resumed from its checkpoint after RebalanceRequeueDelay, until the
+// target leaves the ring.
+const RebalanceBatchSize = 100
+const RebalanceMaxAttempts = 8
+const RebalanceRetryBackoff = time.Second
+const RebalanceRequeueDelay = time.Minute
+const maxFinishedTransfers = 100
+
+type TransferState string
+
+const (
+	TransferRunning TransferState = "running"
+	TransferQueued  TransferState = "queued"
+	TransferDone    TransferState = "done"
+	TransferFailed  TransferState = "failed"
+)
+
+type Transfer struct {
+	ID         string            `json:"id"`
+	Target     string            `json:"target"`
+	Reason     string            `json:"reason"`
+	State      TransferState     `json:"state"`
+	Ranges     []hash.TokenRange `json:"ranges,omitempty"`
+	KeysTotal  int               `json:"keys_total"`
+	KeysSent   int               `json:"keys_sent"`
+	BytesSent  int64             `json:"bytes_sent"`
+	Batches    int               `json:"batches"`
+	Checkpoint string            `json:"checkpoint,omitempty"`
+	Attempts   int               `json:"attempts"`
+	Error      string            `json:"error,omitempty"`
+	StartedAt  time.Time         `json:"started_at"`
+	UpdatedAt  time.Time         `json:"updated_at"`
+
+	segments []transferSegment
+}
+
+// transferSegment is what a transfer sends of one bucket: the keys in a
+// token range, or the listed keys for placements without token ranges.
+type transferSegment struct {
+	bucket string
+	keys   []string
+	r      hash.TokenRange
+}
+
+type InternalBatchRequest struct {
+	Sender   string               `json:"sender"`
+	Transfer string               `json:"transfer"`
+	Entries  []InternalPutRequest `json:"entries"`
+}
+
+type transferEntry struct {
+	token  uint32
+	bucket string
+	key    string
+}
+
+type rebalanceState struct {
+	mu        sync.Mutex
+	seq       int
+	transfers map[string]*Transfer
+	order     []string
+
+	// limiter spreads all transfers of this node over RebalanceRate.
+	limiterMu sync.Mutex
+	nextSend  time.Time
+}
+
+// KeyToken returns the ring position of a key in a bucket.
+func KeyToken(bucket string, key string) uint32 {
+	return hash.Token(placementKey(bucket, key))
+}
+
+// rebalance starts a transfer to every node that gained replicas of local
+// keys between two placements.
+func (h *Handler) rebalance(before hash.Placement, after hash.Placement, reason string) {
+	plan, keys := h.planRebalance(before, after, false)
+	for target, segments := range plan {
+		go h.runTransfer(h.newTransfer(target, reason, segments, keys[target]))
+	}
+}
+
+// planRebalance works out which local keys gained a replica between two
+// placements and returns what to send to every new replica, with the number
+// of keys. Of the nodes that held a key before, only the first one still in
+// the cluster sends it, so each key crosses the network once per new
+// replica; a node handing off its data before it leaves sends every key it
+// holds instead. With token ranges only the keys of the ranges that changed
+// are looked at.
+func (h *Handler) planRebalance(before hash.Placement, after hash.Placement, handOff bool) (map[string][]transferSegment, map[string]int) {
+	beforeRanged, okBefore := before.(hash.Ranged)
+	afterRanged, okAfter := after.(hash.Ranged)
+	changedRanges := make(map[int][]hash.TokenRange)
+
+	plan := make(map[string][]transferSegment)
+	keys := make(map[string]int)
+	for _, bucketName := range h.Store.Buckets() {
+		bucket, ok := h.getBucket(bucketName)
+		if !ok {
+			continue
+		}
+		if !okBefore || !okAfter {
+			bucketKeys := make([]string, 0, len(h.Store.All()[bucketName]))
+			for key := range h.Store.All()[bucketName] {
+				bucketKeys = append(bucketKeys, key)
+			}
+			h.planKeys(plan, keys, before, after, bucket, bucketKeys, handOff)
+			continue
+		}
+		ranges, computed := changedRanges[bucket.Replicas]
+		if !computed {
+			ranges = hash.ChangedRanges(beforeRanged, afterRanged, bucket.Replicas)
+			changedRanges[bucket.Replicas] = ranges
+		}
+		for _, r := range ranges {
+			// Every token of a range has the same replicas as its end.
+			targets := h.newReplicas(beforeRanged.GetNodesForToken(r.End, bucket.Replicas),
+				afterRanged.GetNodesForToken(r.End, bucket.Replicas), after, handOff)
+			if len(targets) == 0 {
+				continue
+			}
+			n := len(h.Store.KeysInRange(bucketName, r))
+			if n == 0 {
+				continue
+			}
+			for _, target := range targets {
+				plan[target] = append(plan[target], transferSegment{bucket: bucketName, r: r})
+				keys[target] += n
+			}
+		}
+	}
+	return plan, keys
+}
+
+// planKeys plans the given keys of a bucket one by one, for placements that
+// do not assign whole token ranges. Without a before placement the keys are
+// planned for all of their replicas after.
+func (h *Handler) planKeys(plan map[string][]transferSegment, keys map[string]int, before hash.Placement, after hash.Placement, bucket model.Bucket, bucketKeys []string, handOff bool) {
+	byTarget := make(map[string][]string)
+	for _, key := range bucketKeys {
+		placement := placementKey(bucket.Name, key)
+		var oldNodes []string
+		if before != nil {
+			oldNodes = before.GetNodesForKey(placement, bucket.Replicas)
+		}
+		targets := h.newReplicas(oldNodes, after.GetNodesForKey(placement, bucket.Replicas), after, handOff)
+		for _, target := range targets {
+			byTarget[target] = append(byTarget[target], key)
+		}
+	}
+	for target, targetKeys := range byTarget {
+		sort.Slice(targetKeys, func(i, j int) bool {
+			a, b := KeyToken(bucket.Name, targetKeys[i]), KeyToken(bucket.Name, targetKeys[j])
+			if a != b {
+				return a < b
+			}
+			return targetKeys[i] < targetKeys[j]
+		})
+		plan[target] = append(plan[target], transferSegment{bucket: bucket.Name, keys: targetKeys})
+		keys[target] += len(targetKeys)
+	}
+}
+
+// newReplicas returns the nodes that hold a key after but not before a ring
+// change, if this node is the one to send it to them or hands off its keys.
+func (h *Handler) newReplicas(oldNodes []string, newNodes []string, after hash.Placement, handOff bool) []string {
+	if !handOff && !h.isRebalanceSender(oldNodes, after) {
+		return nil
+	}
+	held := make(map[string]bool, len(oldNodes))
+	for _, node := range oldNodes {
+		held[node] = true
+	}
+	var targets []string
+	for _, node := range newNodes {
+		if !held[node] && node != h.SelfID {
+			targets = append(targets, node)
+		}
+	}
+	return targets
+}
+
+// isRebalanceSender reports whether this node is responsible for sending a
+// key that the given nodes held: the first of them still in the cluster, or
+// every holder if none of them is left.
+func (h *Handler) isRebalanceSender(oldNodes []string, after hash.Placement) bool {
+	for _, node := range oldNodes {
+		if after.ContainsPeer(node) {
+			return node == h.SelfID
+		}
+	}
+	return true
+}
+
+func (h *Handler) newTransfer(target string, reason string, segments []transferSegment, keys int) *Transfer {
+	h.rebalancing.mu.Lock()
+	defer h.rebalancing.mu.Unlock()
+	if h.rebalancing.transfers == nil {
+		h.rebalancing.transfers = make(map[string]*Transfer)
+	}
+	h.rebalancing.seq++
+	now := time.Now()
+	t := &Transfer{
+		ID:        "t" + strconv.Itoa(h.rebalancing.seq),
+		Target:    target,
+		Reason:    reason,
+		State:     TransferRunning,
+		KeysTotal: keys,
+		StartedAt: now,
+		UpdatedAt: now,
+		segments:  segments,
+	}
+	seen := make(map[hash.TokenRange]bool)
+	for _, segment := range segments {
+		if segment.keys == nil && !seen[segment.r] {
+			seen[segment.r] = true
+			t.Ranges = append(t.Ranges, segment.r)
+		}
+	}
+	sort.Slice(t.Ranges, func(i, j int) bool {
+		return t.Ranges[i].End < t.Ranges[j].End
+	})
+	h.rebalancing.transfers[t.ID] = t
+	h.rebalancing.order = append(h.rebalancing.order, t.ID)
+	h.pruneTransfers()
+	logging.Infof("Transfer %v of %d keys in %d ranges to %v started (%v)", t.ID, keys, len(t.Ranges), target, reason)
+	return t
+}
+
+// pruneTransfers forgets the oldest finished transfers beyond
+// maxFinishedTransfers. The caller holds h.rebalancing.mu.
+func (h *Handler) pruneTransfers() {
+	finished := 0
+	for i := len(h.rebalancing.order) - 1; i >= 0; i-- {
+		id := h.rebalancing.order[i]
+		if !h.rebalancing.transfers[id].finished() {
+			continue
+		}
+		finished++
+		if finished > maxFinishedTransfers {
+			delete(h.rebalancing.transfers, id)
+			h.rebalancing.order = append(h.rebalancing.order[:i], h.rebalancing.order[i+1:]...)
+		}
+	}
+}
+
+// metricReason labels the keys a transfer sent in the migrated keys metric.
+func (t *Transfer) metricReason() string {
+	if t.Reason == handOffReason {
+		return handOffReason
+	}
+	return "rebalance"
+}
+
+func (t *Transfer) finished() bool {
+	return t.State == TransferDone || t.State == TransferFailed
+}
+
+func (h *Handler) updateTransfer(t *Transfer, update func(t *Transfer)) {
+	h.rebalancing.mu.Lock()
+	defer h.rebalancing.mu.Unlock()
+	update(t)
+	t.UpdatedAt = time.Now()
+}
+
+// segmentEntries lists the keys of a segment in the order they are sent,
+// leaving out those up to and including after.
+func (h *Handler) segmentEntries(segment transferSegment, after *transferEntry) []transferEntry {
+	keys := segment.keys
+	if keys == nil {
+		keys = h.Store.KeysInRange(segment.bucket, segment.r)
+	}
+	entries := make([]transferEntry, 0, len(keys))
+	for _, key := range keys {
+		entry := transferEntry{token: KeyToken(segment.bucket, key), bucket: segment.bucket, key: key}
+		if after != nil && !segment.sendsAfter(entry, *after) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// sendsAfter reports whether a segment sends entry after other. Tokens are
+// compared by their distance from the start of the range, so a range that
+// wraps around the ring is ordered the way it is walked.
+func (s transferSegment) sendsAfter(entry transferEntry, other transferEntry) bool {
+	a, b := entry.token-s.r.Start, other.token-s.r.Start
+	if a != b {
+		return a > b
+	}
+	return entry.key > other.key
+}
+
+// runTransfer streams a transfer's segments to the target in batches. After
+// a failed batch it backs off and resumes from the last acknowledged key;
+// after RebalanceMaxAttempts consecutive failures the transfer waits in the
+// queued state before trying again. It only gives up once the target left
+// the ring.
+func (h *Handler) runTransfer(t *Transfer) {
+	failures := 0
+	segment := 0
+	pending := h.segmentEntries(t.segments[0], nil)
+	// acked is the last key of the current segment the target acknowledged.
+	var acked *transferEntry
+	for {
+		for len(pending) == 0 && segment+1 < len(t.segments) {
+			segment++
+			acked = nil
+			pending = h.segmentEntries(t.segments[segment], nil)
+		}
+		if len(pending) == 0 {
+			break
+		}
+		if !h.Placement.ContainsPeer(t.Target) {
+			h.updateTransfer(t, func(t *Transfer) {
+				t.State = TransferFailed
+				t.Error = "target is no longer in the ring"
+			})
+			logging.Infof("Transfer %v to %v abandoned, target left the ring", t.ID, t.Target)
+			transfersFinished.Inc(string(TransferFailed))
+			return
+		}
+		end := RebalanceBatchSize
+		if end > len(pending) {
+			end = len(pending)
+		}
+		batch := h.buildBatch(t.ID, pending[:end])
+		body, err := json.Marshal(batch)
+		if err == nil {
+			h.throttle(len(body))
+			err = h.sendBatch(t.Target, body)
+		}
+		if err != nil {
+			failures++
+			forwardErrors.Inc(t.Target)
+			requeue := failures >= RebalanceMaxAttempts
+			h.updateTransfer(t, func(t *Transfer) {
+				t.Attempts++
+				t.Error = err.Error()
+				if requeue {
+					t.State = TransferQueued
+				}
+			})
+			if requeue {
+				logging.Errorf("Transfer %v to %v failed %d times, resuming from %q in %v: %v",
+					t.ID, t.Target, failures, t.Checkpoint, RebalanceRequeueDelay, err)
+				time.Sleep(RebalanceRequeueDelay)
+				failures = 0
+				h.updateTransfer(t, func(t *Transfer) {
+					t.State = TransferRunning
+				})
+				// Keys written or removed while the transfer waited are
+				// picked up by listing the segment again.
+				pending = h.segmentEntries(t.segments[segment], acked)
+				continue
+			}
+			logging.Errorf("Transfer %v to %v batch failed, resuming after %q: %v", t.ID, t.Target, t.Checkpoint, err)
+			time.Sleep(RebalanceRetryBackoff * time.Duration(1<<(failures-1)))
+			continue
+		}
+		failures = 0
+		migratedKeys.Add(float64(end), t.metricReason())
+		last := pending[end-1]
+		acked = &last
+		h.updateTransfer(t, func(t *Transfer) {
+			t.KeysSent += end
+			t.BytesSent += int64(len(body))
+			t.Batches++
+			t.Checkpoint = fmt.Sprintf("%d/%s/%s", last.token, last.bucket, last.key)
+			t.Error = ""
+		})
+		pending = pending[end:]
+	}
+	h.updateTransfer(t, func(t *Transfer) {
+		t.State = TransferDone
+	})
+	transfersFinished.Inc(string(TransferDone))
+	logging.Infof("Transfer %v of %d keys to %v done in %v", t.ID, t.KeysTotal, t.Target, time.Since(t.StartedAt))
+}
+
+// buildBatch reads the current value and history of every entry; keys that
+// were deleted or expired in the meantime are left out.
+func (h *Handler) buildBatch(transferID string, entries []transferEntry) InternalBatchRequest {
+	batch := InternalBatchRequest{Sender: h.SelfID, Transfer: transferID}
+	for _, entry := range entries {
+		value, ok := h.Store.Get(entry.bucket, entry.key)
+		if !ok {
+			continue
+		}
+		batch.Entries = append(batch.Entries, InternalPutRequest{
+			Sender:    h.SelfID,
+			Bucket:    entry.bucket,
+			Key:       entry.key,
+			Value:     value.Value,
+			Timestamp: value.Timestamp,
+			ExpiresAt: value.ExpiresAt,
+			Type:      value.Type,
+			Node:      value.Node,
+			Deleted:   value.Deleted,
+			History:   h.Store.History(entry.bucket, entry.key),
+		})
+	}
+	return batch
+}
+
+// throttle blocks until sending n more bytes keeps this node's transfers
+// within RebalanceRate bytes per second.
+func (h *Handler) throttle(n int) {
+	rate := h.settings().RebalanceRate
+	if rate <= 0 {
+		return
+	}
+	h.rebalancing.limiterMu.Lock()
+	now := time.Now()
+	start := h.rebalancing.nextSend
+	if start.Before(now) {
+		start = now
+	}
+	h.rebalancing.nextSend = start.Add(time.Duration(float64(n) / float64(rate) * float64(time.Second)))
+	h.rebalancing.limiterMu.Unlock()
+	time.Sleep(time.Until(start))
+}
+
+func (h *Handler) sendBatch(target string, body []byte) error {
+	targetURL, err := h.addressOf(target)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, targetURL+"/kv/internal/batch", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("create request failed: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	h.setRingHeaders(req.Header)
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("post to %s: %w", targetURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusConflict {
+		return h.handleStaleRing(resp)
+	}
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("node %s returned status %d: %s", target, resp.StatusCode, string(respBody))
+	}
+	return nil
+}
+
+func (h *Handler) InternalBatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not supported")
+		return
+	}
+	if !h.checkRingEpoch(w, r) {
+		return
+	}
+	var batch InternalBatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Error decoding request")
+		return
+	}
+	for _, entry := range batch.Entries {
+		h.applyInternalPut(r.Context(), entry)
+	}
+	logging.Debugf("Applied batch of %d keys from transfer %v of %v", len(batch.Entries), batch.Transfer, batch.Sender)
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(map[string]int{"applied": len(batch.Entries)})
+	if err != nil {
+		logging.Errorf("Error encoding response: %v", err)
+	}
+}
+
+func (h *Handler) TransfersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not supported")
+		return
+	}
+	state := TransferState(r.URL.Query().Get("state"))
+	h.rebalancing.mu.Lock()
+	transfers := make([]Transfer, 0, len(h.rebalancing.order))
+	for i := len(h.rebalancing.order) - 1; i >= 0; i-- {
+		t := h.rebalancing.transfers[h.rebalancing.order[i]]
+		if state == "" || t.State == state {
+			transfers = append(transfers, *t)
+		}
+	}
+	h.rebalancing.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(transfers)
+	if err != nil {
+		logging.Errorf("Error encoding response: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Error encoding response")
+	}
+}
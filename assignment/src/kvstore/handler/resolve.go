@@ -0,0 +1,105 @@
+package handler
+
+import (
+	"context"
+	"kvstore/conflict"
+	"kvstore/crdt"
+	"kvstore/logging"
+	"kvstore/model"
+	"strings"
+)
+
+func (h *Handler) resolverFor(bucket model.Bucket, key string) conflict.Resolver {
+	name := bucket.Resolver
+	longest := -1
+	for prefix, prefixResolver := range bucket.PrefixResolvers {
+		if strings.HasPrefix(key, prefix) && len(prefix) > longest {
+			name = prefixResolver
+			longest = len(prefix)
+		}
+	}
+	resolver, ok := conflict.Get(name)
+	if !ok {
+		logging.Errorf("Unknown resolver %q for %v/%v, using %v", name, bucket.Name, key, conflict.LastWriterWins)
+		resolver, _ = conflict.Get(conflict.LastWriterWins)
+	}
+	return resolver
+}
+
+// mergeVersions reconciles two replicas of the same key. Values of the same
+// crdt type are merged so no concurrent update is lost. A write made by a
+// coordinator that had already seen the other version replaces it; only
+// versions written without knowing of each other go through the resolver
+// configured for the key. The outcome depends on the two versions alone, so
+// replication, reads, read repair and hand-off all store the same value.
+func (h *Handler) mergeVersions(bucket model.Bucket, key string, current model.ValueVersion, incoming model.ValueVersion) model.ValueVersion {
+	if current.Timestamp == 0 && current.Value == "" {
+		return incoming
+	}
+	// A delete and a write are ordered by time whatever the resolver.
+	if current.Deleted || incoming.Deleted {
+		if incoming.Timestamp > current.Timestamp {
+			return incoming
+		}
+		return current
+	}
+	if current.Type != "" && current.Type == incoming.Type {
+		merged, err := crdt.Merge(current.Type, current.Value, incoming.Value)
+		if err != nil {
+			logging.Errorf("Error merging %v values: %v", current.Type, err)
+		} else {
+			result := current
+			result.Value = merged
+			if incoming.Timestamp > result.Timestamp {
+				result.Timestamp = incoming.Timestamp
+				result.Node = incoming.Node
+			}
+			return result
+		}
+	}
+	if supersedes(incoming, current) {
+		return incoming
+	}
+	if supersedes(current, incoming) {
+		return current
+	}
+	return h.resolverFor(bucket, key)(current, incoming)
+}
+
+// supersedes reports whether a was written by a coordinator that already held
+// b or a newer version.
+func supersedes(a model.ValueVersion, b model.ValueVersion) bool {
+	return a.Timestamp > b.Timestamp && a.Base >= b.Timestamp
+}
+
+// putLocal stores a version, a client write or one sent by read repair,
+// hand-off or another replica, merged with the local one. It returns what
+// was stored.
+func (h *Handler) putLocal(ctx context.Context, bucket model.Bucket, key string, value model.ValueVersion) model.ValueVersion {
+	span := startStoreSpan(ctx, "store.put", bucket.Name, key)
+	defer span.End()
+	if local, ok := h.Store.Get(bucket.Name, key); ok {
+		value = h.mergeVersions(bucket, key, local, value)
+	}
+	h.Store.Put(bucket.Name, key, value)
+	h.trackChange(bucket.Name, key)
+	return value
+}
+
+// readRepair pushes the resolved value to replicas that answered a read with
+// a different version.
+func (h *Handler) readRepair(ctx context.Context, bucket model.Bucket, key string, resolved model.ValueVersion, replicaValues map[string]model.ValueVersion) {
+	for target, value := range replicaValues {
+		if value == resolved {
+			continue
+		}
+		logging.Infof("Read repair of %v/%v on %v", bucket.Name, key, target)
+		if target == h.SelfID {
+			h.putLocal(ctx, bucket, key, resolved)
+			continue
+		}
+		if err := h.sendKeyValue(ctx, target, bucket.Name, key, resolved); err != nil {
+			logging.Errorf("Error repairing %v/%v on %v: %v", bucket.Name, key, target, err)
+		}
+	}
+}
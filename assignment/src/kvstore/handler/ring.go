@@ -0,0 +1,307 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kvstore/hash"
+	"kvstore/logging"
+	"kvstore/model"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// RingEpochHeader carries the sender's ring epoch on every request between
+// nodes. A replica whose ring is newer than the coordinator's rejects the
+// request with its own ring so the coordinator can catch up and redirect.
+const RingEpochHeader = "X-Ring-Epoch"
+
+// RingDigestHeader carries the digest of the sender's member table, so that
+// a replica can tell a different ring at the same epoch from its own.
+const RingDigestHeader = "X-Ring-Digest"
+
+var errStaleRing = errors.New("coordinator ring is stale")
+
+type StaleRingResponse struct {
+	Error string          `json:"error"`
+	Ring  model.RingState `json:"ring"`
+}
+
+type OwnershipResponse struct {
+	ID        string  `json:"id"`
+	URL       string  `json:"url"`
+	Zone      string  `json:"zone,omitempty"`
+	Weight    int     `json:"weight"`
+	Ownership float64 `json:"ownership_percent"`
+}
+
+// TopologyResponse is what a client needs to place keys itself: the ring,
+// the placement settings every node uses, the address of every node and the
+// replica count of every bucket.
+type TopologyResponse struct {
+	Epoch       uint64            `json:"epoch"`
+	Placement   string            `json:"placement"`
+	LoadEpsilon float64           `json:"load_epsilon,omitempty"`
+	Ring        model.RingState   `json:"ring"`
+	Nodes       map[string]string `json:"nodes"`
+	Buckets     map[string]int    `json:"buckets"`
+}
+
+type ringView struct {
+	mu    sync.Mutex
+	state model.RingState
+}
+
+func (h *Handler) ringEpoch() uint64 {
+	h.ring.mu.Lock()
+	defer h.ring.mu.Unlock()
+	return h.ring.state.Epoch
+}
+
+// setRingHeaders marks a request to another node with our ring epoch and
+// digest.
+func (h *Handler) setRingHeaders(header http.Header) {
+	h.ring.mu.Lock()
+	defer h.ring.mu.Unlock()
+	header.Set(RingEpochHeader, strconv.FormatUint(h.ring.state.Epoch, 10))
+	header.Set(RingDigestHeader, h.ring.state.Digest())
+}
+
+func (h *Handler) ringSnapshot() model.RingState {
+	h.ring.mu.Lock()
+	defer h.ring.mu.Unlock()
+	return h.ring.state.Clone()
+}
+
+// updateRing applies a change to the ring state, brings the local placement
+// in line with it and rebalances the keys whose replicas changed.
+func (h *Handler) updateRing(change func(state *model.RingState) bool) {
+	h.ring.mu.Lock()
+	before := h.ring.state.Clone()
+	if !change(&h.ring.state) {
+		h.ring.mu.Unlock()
+		return
+	}
+	beforePlacement := h.Placement.Clone()
+	// Nobody else may take this node out of the ring while it is serving,
+	// and only this node decides how many vnodes it owns and its zone.
+	if h.selfState() != model.PeerLeft {
+		h.ring.state.Set(h.SelfID, true, h.Vnodes)
+		h.ring.state.SetZone(h.SelfID, h.Zone)
+	}
+	if h.ring.state.IsEvicted(h.SelfID) && !before.IsEvicted(h.SelfID) {
+		logging.Infof("This node was evicted from the ring by an operator")
+	}
+	var added, removed []string
+	for _, id := range h.ring.state.ActiveMembers() {
+		vnodes := h.ring.state.VnodesOf(id)
+		if !before.IsActive(id) {
+			added = append(added, id)
+			h.Placement.AddWeightedNode(id, vnodes)
+		} else if vnodes != before.VnodesOf(id) {
+			logging.Infof("Node %v now has %d vnodes", id, vnodes)
+			h.Placement.RemoveNode(id)
+			h.Placement.AddWeightedNode(id, vnodes)
+			added = append(added, id)
+		}
+	}
+	for _, id := range before.ActiveMembers() {
+		if !h.ring.state.IsActive(id) {
+			removed = append(removed, id)
+			h.Placement.RemoveNode(id)
+		}
+	}
+	zones := h.ring.state.Zones()
+	if zoneAware, ok := h.Placement.(hash.ZoneAware); ok {
+		zoneAware.SetZones(zones)
+	}
+	rebalance := zonesChanged(&h.ring.state, &before)
+	if ordered, ok := h.Placement.(hash.Ordered); ok {
+		nodes, weights := h.ring.state.JoinOrder()
+		ordered.SetJoinOrder(nodes, weights)
+		// Views that saw a node at different times settle on the earliest,
+		// which moves its buckets.
+		beforeNodes, _ := before.JoinOrder()
+		rebalance = rebalance || !slices.Equal(nodes, beforeNodes)
+	}
+	afterPlacement := h.Placement.Clone()
+	epoch := h.ring.state.Epoch
+	h.ring.mu.Unlock()
+
+	if len(added) == 0 && len(removed) == 0 && epoch == before.Epoch && !rebalance {
+		return
+	}
+	logging.Infof("Ring epoch %d: added %v, removed %v", epoch, added, removed)
+	if rebalance {
+		logging.Infof("Node zones or join order changed: %v", zones)
+	}
+	if len(added) > 0 || len(removed) > 0 || rebalance {
+		reason := fmt.Sprintf("ring epoch %d: added %v, removed %v", epoch, added, removed)
+		go h.rebalance(beforePlacement, afterPlacement, reason)
+	}
+	go h.broadcastGossip()
+}
+
+// zonesChanged reports whether a node that stayed in the ring moved to
+// another zone.
+func zonesChanged(after, before *model.RingState) bool {
+	for _, id := range after.ActiveMembers() {
+		if before.IsActive(id) && before.Members[id].Zone != after.Members[id].Zone {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Handler) setRingMember(id string, active bool, vnodes int) {
+	h.updateRing(func(state *model.RingState) bool {
+		return state.Set(id, active, vnodes)
+	})
+}
+
+func (h *Handler) mergeRing(incoming *model.RingState) {
+	if incoming == nil {
+		return
+	}
+	h.updateRing(func(state *model.RingState) bool {
+		return state.Merge(*incoming)
+	})
+}
+
+// checkRingEpoch rejects a forwarded request routed with an older ring than
+// ours, or with a different ring at the same epoch. A sender at a higher
+// epoch is let through, since it has seen changes we have not. It returns
+// false if the request was rejected.
+func (h *Handler) checkRingEpoch(w http.ResponseWriter, r *http.Request) bool {
+	raw := r.Header.Get(RingEpochHeader)
+	if raw == "" {
+		return true
+	}
+	epoch, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid "+RingEpochHeader)
+		return false
+	}
+	ring := h.ringSnapshot()
+	digest := r.Header.Get(RingDigestHeader)
+	if epoch > ring.Epoch || epoch == ring.Epoch && (digest == "" || digest == ring.Digest()) {
+		return true
+	}
+	logging.Infof("Rejecting %v %v routed with ring epoch %d (%v), ours is %d (%v)", r.Method, r.URL.Path, epoch, digest, ring.Epoch, ring.Digest())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	err = json.NewEncoder(w).Encode(StaleRingResponse{
+		Error: fmt.Sprintf("Ring epoch %d does not match %d", epoch, ring.Epoch),
+		Ring:  ring,
+	})
+	if err != nil {
+		logging.Errorf("Error encoding response: %v", err)
+	}
+	return false
+}
+
+// handleStaleRing adopts the ring a replica rejected our request with.
+func (h *Handler) handleStaleRing(resp *http.Response) error {
+	var stale StaleRingResponse
+	if err := json.NewDecoder(resp.Body).Decode(&stale); err != nil {
+		return fmt.Errorf("decode stale ring response failed: %v", err)
+	}
+	h.mergeRing(&stale.Ring)
+	return fmt.Errorf("%w: replica is at epoch %d", errStaleRing, stale.Ring.Epoch)
+}
+
+// redirectTargets returns the replicas to contact after a replica rejected
+// our stale ring: the remaining targets plus any node the updated ring makes
+// responsible for the key, including the rejecting node if it still is.
+func (h *Handler) redirectTargets(bucket model.Bucket, key string, targets []string, rejected string) []string {
+	tried := make(map[string]bool, len(targets))
+	for _, target := range targets {
+		tried[target] = true
+	}
+	for _, node := range h.getResponsibleNodes(bucket, key) {
+		if !tried[node] || node == rejected {
+			targets = append(targets, node)
+		}
+	}
+	return targets
+}
+
+func (h *Handler) RingHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not supported")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(h.ringSnapshot())
+	if err != nil {
+		logging.Errorf("Error encoding response: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Error encoding response")
+	}
+}
+
+// OwnershipHandler reports the share of the hash space each node is the
+// primary owner of.
+func (h *Handler) OwnershipHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not supported")
+		return
+	}
+	ring := h.ringSnapshot()
+	var resp []OwnershipResponse
+	for id, share := range h.Placement.Ownership() {
+		var zone string
+		if member, ok := ring.Members[id]; ok {
+			zone = member.Zone
+		}
+		address, _ := h.addressOf(id)
+		resp = append(resp, OwnershipResponse{
+			ID:        id,
+			URL:       address,
+			Zone:      zone,
+			Weight:    h.Placement.Weight(id),
+			Ownership: share * 100,
+		})
+	}
+	sort.Slice(resp, func(i, j int) bool {
+		return resp[i].ID < resp[j].ID
+	})
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		logging.Errorf("Error encoding response: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Error encoding response")
+	}
+}
+
+// TopologyHandler serves the cluster topology to clients that route requests
+// to a key's replicas themselves.
+func (h *Handler) TopologyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not supported")
+		return
+	}
+	ring := h.ringSnapshot()
+	resp := TopologyResponse{
+		Epoch:       ring.Epoch,
+		Placement:   h.PlacementStrategy,
+		LoadEpsilon: h.LoadEpsilon,
+		Ring:        ring,
+		Nodes:       make(map[string]string),
+		Buckets:     make(map[string]int),
+	}
+	for id, peer := range h.peerSnapshot() {
+		resp.Nodes[id] = peer.URL
+	}
+	for _, bucket := range h.listBuckets() {
+		resp.Buckets[bucket.Name] = bucket.Replicas
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		logging.Errorf("Error encoding response: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Error encoding response")
+	}
+}
@@ -0,0 +1,158 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"kvstore/logging"
+	"kvstore/model"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DefaultScanLimit = 100
+const MaxScanLimit = 1000
+
+// ScanResponse is one page of keys in key order. Next is the cursor to pass
+// as ?after= for the following page, empty on the last page. Unreachable
+// lists nodes that could not be scanned; with at most replicas-1 of them the
+// page is still complete.
+type ScanResponse struct {
+	Bucket      string       `json:"bucket"`
+	Items       []KVResponse `json:"items"`
+	Next        string       `json:"next,omitempty"`
+	Unreachable []string     `json:"unreachable,omitempty"`
+}
+
+// ScanHandler lists the keys of ?bucket= that start with ?prefix=, ?limit=
+// at a time, after the cursor ?after=. The coordinator scans every node in
+// the ring and merges their copies of each key, so deleted keys stay hidden
+// even on replicas that missed the delete.
+func (h *Handler) ScanHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not supported")
+		return
+	}
+	query := r.URL.Query()
+	bucket, ok := h.getBucket(query.Get("bucket"))
+	if !ok {
+		writeJSONErrorCode(w, http.StatusNotFound, ErrorCodeBucketNotFound, "Bucket not found")
+		return
+	}
+	limit := DefaultScanLimit
+	if raw := query.Get("limit"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < 1 || parsed > MaxScanLimit {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", MaxScanLimit))
+			return
+		}
+		limit = parsed
+	}
+	prefix := query.Get("prefix")
+	after := query.Get("after")
+
+	var resp ScanResponse
+	if r.Header.Get("X-From-Node") == "true" {
+		resp = h.scanLocal(bucket.Name, prefix, after, limit)
+	} else {
+		resp = h.scanCluster(bucket, prefix, after, limit, r)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		logging.Errorf("Error encoding response: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Error encoding response")
+	}
+}
+
+// scanLocal returns up to limit local keys, tombstones included, so the
+// coordinator can resolve them against the other replicas.
+func (h *Handler) scanLocal(bucket string, prefix string, after string, limit int) ScanResponse {
+	keys := h.Store.All()[bucket]
+	var names []string
+	for key := range keys {
+		if key > after && strings.HasPrefix(key, prefix) {
+			names = append(names, key)
+		}
+	}
+	sort.Strings(names)
+	resp := ScanResponse{Bucket: bucket, Items: []KVResponse{}}
+	if len(names) > limit {
+		names = names[:limit]
+		resp.Next = names[limit-1]
+	}
+	for _, key := range names {
+		resp.Items = append(resp.Items, kvResponse(bucket, key, keys[key]))
+	}
+	return resp
+}
+
+func (h *Handler) scanCluster(bucket model.Bucket, prefix string, after string, limit int, r *http.Request) ScanResponse {
+	merged := make(map[string]model.ValueVersion)
+	// Each node only returned keys up to its own cursor; beyond the smallest
+	// of those another page is needed before anything is known for certain.
+	boundary := ""
+	resp := ScanResponse{Bucket: bucket.Name, Items: []KVResponse{}}
+	for _, node := range h.Placement.GetAllPeers() {
+		var page ScanResponse
+		if node == h.SelfID {
+			page = h.scanLocal(bucket.Name, prefix, after, limit)
+		} else if err := h.forwardJSON(node, r, &page); err != nil {
+			logging.Errorf("Error scanning %v: %v", node, err)
+			resp.Unreachable = append(resp.Unreachable, node)
+			continue
+		}
+		if page.Next != "" && (boundary == "" || page.Next < boundary) {
+			boundary = page.Next
+		}
+		for _, item := range page.Items {
+			merged[item.Key] = h.mergeVersions(bucket, item.Key, merged[item.Key], model.ValueVersion{
+				Value:     item.Value,
+				Timestamp: item.Timestamp,
+				ExpiresAt: item.ExpiresAt,
+				Type:      item.Type,
+				Node:      item.Node,
+				Base:      item.Base,
+				Deleted:   item.Deleted,
+			})
+		}
+	}
+
+	now := time.Now().UnixNano()
+	var names []string
+	for key, value := range merged {
+		if boundary != "" && key > boundary {
+			continue
+		}
+		if value.Deleted || value.Expired(now) {
+			continue
+		}
+		names = append(names, key)
+	}
+	sort.Strings(names)
+	resp.Next = boundary
+	if len(names) > limit {
+		names = names[:limit]
+		resp.Next = names[limit-1]
+	}
+	for _, key := range names {
+		resp.Items = append(resp.Items, kvResponse(bucket.Name, key, merged[key]))
+	}
+	return resp
+}
+
+func kvResponse(bucket string, key string, value model.ValueVersion) KVResponse {
+	return KVResponse{
+		Bucket:    bucket,
+		Key:       key,
+		Value:     value.Value,
+		Timestamp: value.Timestamp,
+		ExpiresAt: value.ExpiresAt,
+		Type:      value.Type,
+		Node:      value.Node,
+		Base:      value.Base,
+		Deleted:   value.Deleted,
+	}
+}
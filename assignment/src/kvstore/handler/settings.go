@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"kvstore/logging"
+	"net/http"
+	"time"
+)
+
+// Settings are the tunables that can change while the node runs. The
+// Handler fields of the same names hold them; after the Handler starts they
+// must only be changed through ApplySettings and read through settings.
+type Settings struct {
+	ReadQuorum     int
+	WriteQuorum    int
+	GossipInterval time.Duration
+	PeerTimeout    time.Duration
+	PhiThreshold   float64
+	RebalanceRate  int64
+	CleanupDelay   time.Duration
+	CleanupDryRun  bool
+}
+
+// ReloadRequest sets settings by name on top of the configuration sources.
+type ReloadRequest map[string]interface{}
+
+type ReloadResponse struct {
+	Changed         []string `json:"changed"`
+	RestartRequired []string `json:"restart_required,omitempty"`
+}
+
+func (h *Handler) settings() Settings {
+	h.settingsMu.RLock()
+	defer h.settingsMu.RUnlock()
+	return Settings{
+		ReadQuorum:     h.ReadQuorum,
+		WriteQuorum:    h.WriteQuorum,
+		GossipInterval: h.GossipInterval,
+		PeerTimeout:    h.PeerTimeout,
+		PhiThreshold:   h.PhiThreshold,
+		RebalanceRate:  h.RebalanceRate,
+		CleanupDelay:   h.CleanupDelay,
+		CleanupDryRun:  h.CleanupDryRun,
+	}
+}
+
+// ApplySettings replaces all runtime settings at once, so no request sees a
+// mix of old and new quorums. A changed gossip interval takes effect after
+// the next tick.
+func (h *Handler) ApplySettings(s Settings) {
+	h.settingsMu.Lock()
+	defer h.settingsMu.Unlock()
+	h.ReadQuorum = s.ReadQuorum
+	h.WriteQuorum = s.WriteQuorum
+	h.GossipInterval = s.GossipInterval
+	h.PeerTimeout = s.PeerTimeout
+	h.PhiThreshold = s.PhiThreshold
+	h.RebalanceRate = s.RebalanceRate
+	h.CleanupDelay = s.CleanupDelay
+	h.CleanupDryRun = s.CleanupDryRun
+}
+
+// ReloadHandler reloads the configuration like SIGHUP does. Settings in the
+// request body override the other sources until the node restarts.
+func (h *Handler) ReloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not supported")
+		return
+	}
+	if h.ReloadFunc == nil {
+		writeJSONError(w, http.StatusNotImplemented, "Reloading is not supported")
+		return
+	}
+	var req ReloadRequest
+	if r.ContentLength != 0 {
+		// Numbers are kept as written, so 1000000 does not become 1e+06.
+		decoder := json.NewDecoder(r.Body)
+		decoder.UseNumber()
+		if err := decoder.Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "Invalid JSON")
+			return
+		}
+	}
+	overrides := make(map[string]string, len(req))
+	for name, value := range req {
+		overrides[name] = fmt.Sprint(value)
+	}
+	resp, err := h.ReloadFunc(overrides)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		logging.Errorf("Error encoding response: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Error encoding response")
+	}
+}
@@ -0,0 +1,578 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"kvstore/logging"
+	"kvstore/model"
+	"math"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// SWIM failure detection: every protocol period a random member is pinged
+// directly, and if it does not answer, IndirectPingCount other members are
+// asked to ping it on our behalf. Only when all of them fail is the member
+// suspected. A suspected member that does not refute the suspicion by
+// bumping its incarnation is declared dead once its phi-accrual suspicion
+// level crosses PhiThreshold. Membership changes ride along on every ping and
+// ack.
+const PingTimeout = 500 * time.Millisecond
+const IndirectPingCount = 3
+
+// A dead member is not probed with the others, but one of them is pinged
+// every DeadProbePeriods protocol periods, so a member that was only cut off
+// learns that it is held dead and rejoins once the partition heals.
+const DeadProbePeriods = 10
+
+type MemberUpdate struct {
+	ID          string          `json:"id"`
+	URL         string          `json:"url"`
+	State       model.PeerState `json:"state"`
+	Incarnation uint64          `json:"incarnation"`
+	Vnodes      int             `json:"vnodes"`
+	Zone        string          `json:"zone,omitempty"`
+}
+
+type SwimMessage struct {
+	From      MemberUpdate   `json:"from"`
+	Target    string         `json:"target,omitempty"`
+	TargetURL string         `json:"target_url,omitempty"`
+	Updates   []MemberUpdate `json:"updates,omitempty"`
+}
+
+type pendingUpdate struct {
+	update    MemberUpdate
+	remaining int
+}
+
+type swimState struct {
+	mu          sync.Mutex
+	incarnation uint64
+	state       model.PeerState
+	updates     map[string]*pendingUpdate
+	periods     int
+}
+
+// initSelf registers this node as an alive member. The incarnation starts
+// from the boot time so a restarted node overrides the dead record its peers
+// still hold for it.
+func (h *Handler) initSelf() {
+	h.swim.mu.Lock()
+	if h.swim.incarnation == 0 {
+		h.swim.incarnation = uint64(time.Now().Unix())
+	}
+	h.swim.state = model.PeerAlive
+	incarnation := h.swim.incarnation
+	h.swim.mu.Unlock()
+
+	h.Mu.Lock()
+	if h.Peers == nil {
+		h.Peers = make(map[string]*model.PeerInfo)
+	}
+	h.Peers[h.SelfID] = &model.PeerInfo{
+		ID:           h.SelfID,
+		URL:          h.SelfURL,
+		LastSeen:     time.Now(),
+		State:        model.PeerAlive,
+		Incarnation:  incarnation,
+		Vnodes:       h.Vnodes,
+		Zone:         h.Zone,
+		StateChanged: time.Now(),
+	}
+	h.Mu.Unlock()
+	h.queueUpdate(h.selfUpdate())
+	h.setRingMember(h.SelfID, true, h.Vnodes)
+}
+
+func (h *Handler) selfUpdate() MemberUpdate {
+	h.swim.mu.Lock()
+	defer h.swim.mu.Unlock()
+	return MemberUpdate{
+		ID:          h.SelfID,
+		URL:         h.SelfURL,
+		State:       h.swim.state,
+		Incarnation: h.swim.incarnation,
+		Vnodes:      h.Vnodes,
+		Zone:        h.Zone,
+	}
+}
+
+func (h *Handler) queueUpdate(update MemberUpdate) {
+	h.Mu.Lock()
+	members := len(h.Peers)
+	h.Mu.Unlock()
+
+	h.swim.mu.Lock()
+	defer h.swim.mu.Unlock()
+	if h.swim.updates == nil {
+		h.swim.updates = make(map[string]*pendingUpdate)
+	}
+	// Each update is retransmitted a logarithmic number of times, enough for
+	// it to reach every member with high probability.
+	h.swim.updates[update.ID] = &pendingUpdate{
+		update:    update,
+		remaining: 3 * int(math.Ceil(math.Log2(float64(members+1)))),
+	}
+}
+
+func (h *Handler) piggyback() []MemberUpdate {
+	h.swim.mu.Lock()
+	defer h.swim.mu.Unlock()
+	var updates []MemberUpdate
+	for id, pending := range h.swim.updates {
+		updates = append(updates, pending.update)
+		pending.remaining--
+		if pending.remaining <= 0 {
+			delete(h.swim.updates, id)
+		}
+	}
+	return updates
+}
+
+// refute answers a suspicion or death notice about this node by announcing
+// its own state again with a higher incarnation.
+func (h *Handler) refute(incarnation uint64) {
+	h.swim.mu.Lock()
+	state := h.swim.state
+	h.swim.mu.Unlock()
+	if state == model.PeerLeft {
+		return
+	}
+	logging.Infof("Refuting suspicion at incarnation %d", incarnation)
+	h.announceSelf(state, incarnation)
+}
+
+// announceSelf changes this node's own membership state, bumping its
+// incarnation past minIncarnation so the announcement overrides anything
+// peers currently believe.
+func (h *Handler) announceSelf(state model.PeerState, minIncarnation uint64) {
+	h.swim.mu.Lock()
+	if minIncarnation >= h.swim.incarnation {
+		h.swim.incarnation = minIncarnation
+	}
+	h.swim.incarnation++
+	h.swim.state = state
+	current := h.swim.incarnation
+	h.swim.mu.Unlock()
+
+	h.Mu.Lock()
+	if self, ok := h.Peers[h.SelfID]; ok {
+		self.Incarnation = current
+		self.State = state
+		self.StateChanged = time.Now()
+	}
+	h.Mu.Unlock()
+	logging.Infof("Announcing self as %v with incarnation %d", state, current)
+	h.queueUpdate(h.selfUpdate())
+}
+
+func (h *Handler) selfState() model.PeerState {
+	h.swim.mu.Lock()
+	defer h.swim.mu.Unlock()
+	return h.swim.state
+}
+
+// applyMemberUpdate merges a membership update using SWIM precedence rules:
+// a higher incarnation always wins, and at equal incarnation dead or left
+// overrides suspect, which overrides leaving, which overrides alive. Members
+// are identified by node ID; an update carrying a new address for a known
+// ID moves the member without touching its place in the ring.
+func (h *Handler) applyMemberUpdate(update MemberUpdate) {
+	if update.ID == "" {
+		return
+	}
+	if update.State == "" {
+		update.State = model.PeerAlive
+	}
+	if update.ID == h.SelfID {
+		if update.State == model.PeerSuspect || update.State == model.PeerDead {
+			h.refute(update.Incarnation)
+		}
+		return
+	}
+
+	h.Mu.Lock()
+	local, exists := h.Peers[update.ID]
+	if exists && update.URL != "" && update.URL != local.URL && update.Incarnation >= local.Incarnation {
+		logging.Infof("Member %v moved from %v to %v", update.ID, local.URL, update.URL)
+		local.URL = update.URL
+	}
+	if exists && update.Incarnation >= local.Incarnation {
+		if update.Vnodes > 0 {
+			local.Vnodes = update.Vnodes
+		}
+		if update.Zone != "" {
+			local.Zone = update.Zone
+		}
+	}
+	accept := !exists
+	if exists {
+		switch update.State {
+		case model.PeerAlive:
+			accept = update.Incarnation > local.Incarnation
+		case model.PeerLeaving:
+			accept = update.Incarnation > local.Incarnation ||
+				(local.State == model.PeerAlive && update.Incarnation == local.Incarnation)
+		case model.PeerSuspect:
+			accept = update.Incarnation > local.Incarnation ||
+				((local.State == model.PeerAlive || local.State == model.PeerLeaving) && update.Incarnation == local.Incarnation)
+		case model.PeerDead, model.PeerLeft:
+			accept = !local.IsGone() && update.Incarnation >= local.Incarnation
+		}
+	}
+	if !accept {
+		h.Mu.Unlock()
+		return
+	}
+	previous := model.PeerState("")
+	if exists {
+		previous = local.State
+	} else {
+		local = &model.PeerInfo{ID: update.ID, URL: update.URL, Vnodes: update.Vnodes, Zone: update.Zone, LastSeen: time.Now()}
+		h.Peers[update.ID] = local
+	}
+	local.State = update.State
+	local.Incarnation = update.Incarnation
+	if previous != update.State {
+		local.StateChanged = time.Now()
+	}
+	update.URL = local.URL
+	update.Vnodes = local.Vnodes
+	update.Zone = local.Zone
+	h.Mu.Unlock()
+
+	h.queueUpdate(update)
+	if previous != update.State {
+		logging.Infof("Member %v (%v) is now %v (incarnation %d)", update.ID, update.URL, update.State, update.Incarnation)
+		h.onMemberStateChange(update.ID, update.State)
+	}
+}
+
+// onMemberStateChange keeps the hash ring in line with membership. Suspected
+// and leaving members stay in the ring. Dead members are removed and their
+// data re-replicated; members that left already handed their data off.
+func (h *Handler) onMemberStateChange(id string, state model.PeerState) {
+	switch state {
+	case model.PeerAlive:
+		peer, _ := h.memberState(id)
+		h.updateRing(func(state *model.RingState) bool {
+			changed := state.Set(id, true, peer.Vnodes)
+			if peer.Zone != "" && state.SetZone(id, peer.Zone) {
+				changed = true
+			}
+			return changed
+		})
+	case model.PeerDead, model.PeerLeft:
+		h.setRingMember(id, false, 0)
+	}
+}
+
+// markSeen records direct evidence that a member is reachable and feeds it to
+// the member's heartbeat statistics.
+func (h *Handler) markSeen(id string) {
+	h.Mu.Lock()
+	defer h.Mu.Unlock()
+	if peer, ok := h.Peers[id]; ok {
+		peer.RecordHeartbeat(time.Now())
+	}
+}
+
+func (h *Handler) memberState(id string) (model.PeerInfo, bool) {
+	h.Mu.Lock()
+	defer h.Mu.Unlock()
+	peer, ok := h.Peers[id]
+	if !ok {
+		return model.PeerInfo{}, false
+	}
+	return *peer, true
+}
+
+// addressOf returns the current advertised address of a node.
+func (h *Handler) addressOf(id string) (string, error) {
+	if id == h.SelfID {
+		return h.SelfURL, nil
+	}
+	peer, ok := h.memberState(id)
+	if !ok || peer.URL == "" {
+		return "", fmt.Errorf("no address known for node %v", id)
+	}
+	return peer.URL, nil
+}
+
+func (h *Handler) peerSnapshot() map[string]*model.PeerInfo {
+	h.Mu.Lock()
+	defer h.Mu.Unlock()
+	peers := make(map[string]*model.PeerInfo, len(h.Peers))
+	for id, peer := range h.Peers {
+		copied := *peer
+		peers[id] = &copied
+	}
+	return peers
+}
+
+// randomMembers returns up to n members that are not dead, excluding the
+// given node IDs.
+func (h *Handler) randomMembers(n int, exclude ...string) []string {
+	skip := make(map[string]bool, len(exclude)+1)
+	skip[h.SelfID] = true
+	for _, id := range exclude {
+		skip[id] = true
+	}
+	h.Mu.Lock()
+	var candidates []string
+	for id, peer := range h.Peers {
+		if !skip[id] && !peer.IsGone() {
+			candidates = append(candidates, id)
+		}
+	}
+	h.Mu.Unlock()
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if len(candidates) > n {
+		candidates = candidates[:n]
+	}
+	return candidates
+}
+
+// heldAgainst returns the record of a member if it says the member is
+// suspected or dead at an incarnation the member has not refuted yet, so the
+// member can be told about it and refute it. The member's own record may
+// have stopped being piggybacked long ago.
+func (h *Handler) heldAgainst(id string, incarnation uint64) []MemberUpdate {
+	peer, ok := h.memberState(id)
+	if !ok || (peer.State != model.PeerSuspect && peer.State != model.PeerDead) || peer.Incarnation < incarnation {
+		return nil
+	}
+	return []MemberUpdate{{
+		ID:          peer.ID,
+		URL:         peer.URL,
+		State:       peer.State,
+		Incarnation: peer.Incarnation,
+		Vnodes:      peer.Vnodes,
+		Zone:        peer.Zone,
+	}}
+}
+
+// sendSwimTo posts a protocol message to an address and applies the
+// membership updates carried by the reply, including the responder's own.
+func (h *Handler) sendSwimTo(targetURL string, path string, msg SwimMessage, timeout time.Duration) (SwimMessage, error) {
+	msg.From = h.selfUpdate()
+	msg.Updates = append(msg.Updates, h.piggyback()...)
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return SwimMessage{}, fmt.Errorf("marshal swim message: %w", err)
+	}
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Post(targetURL+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return SwimMessage{}, fmt.Errorf("post to %s: %w", targetURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return SwimMessage{}, fmt.Errorf("%s returned status %d", targetURL, resp.StatusCode)
+	}
+	var ack SwimMessage
+	if err := json.NewDecoder(resp.Body).Decode(&ack); err != nil {
+		return SwimMessage{}, fmt.Errorf("decode ack: %w", err)
+	}
+	h.applyMemberUpdate(ack.From)
+	for _, update := range ack.Updates {
+		h.applyMemberUpdate(update)
+	}
+	h.markSeen(ack.From.ID)
+	return ack, nil
+}
+
+func (h *Handler) sendSwim(target string, path string, msg SwimMessage, timeout time.Duration) (SwimMessage, error) {
+	targetURL, err := h.addressOf(target)
+	if err != nil {
+		return SwimMessage{}, err
+	}
+	return h.sendSwimTo(targetURL, path, msg, timeout)
+}
+
+// ping checks a member directly. An answer from a different node at the
+// member's address does not count: the member may have been replaced. A
+// member held suspected or dead is sent its record, so it refutes it.
+func (h *Handler) ping(target string) error {
+	msg := SwimMessage{Updates: h.heldAgainst(target, 0)}
+	ack, err := h.sendSwim(target, "/swim/ping", msg, PingTimeout)
+	if err != nil {
+		return err
+	}
+	if ack.From.ID != target {
+		return fmt.Errorf("node %v answered in place of %v", ack.From.ID, target)
+	}
+	return nil
+}
+
+// contactSeeds pings every seed address that no known member advertises, so
+// a node learns the IDs behind its configured peers, and now and then a dead
+// member.
+func (h *Handler) contactSeeds() {
+	h.probeDead()
+	known := make(map[string]bool)
+	for _, peer := range h.peerSnapshot() {
+		known[peer.URL] = true
+	}
+	seeds, err := h.Seeds.Resolve()
+	if err != nil {
+		logging.Debugf("Error resolving seeds: %v", err)
+	}
+	for _, seed := range seeds {
+		if known[seed] {
+			continue
+		}
+		if _, err := h.sendSwimTo(seed, "/swim/ping", SwimMessage{}, PingTimeout); err != nil {
+			logging.Debugf("Seed %v unreachable: %v", seed, err)
+		}
+	}
+}
+
+// probeDead pings a random dead member every DeadProbePeriods calls. A
+// member that answers learns from the ping that it is held dead and refutes
+// it with a higher incarnation.
+func (h *Handler) probeDead() {
+	h.swim.mu.Lock()
+	h.swim.periods++
+	due := h.swim.periods%DeadProbePeriods == 0
+	h.swim.mu.Unlock()
+	if !due {
+		return
+	}
+	var dead []string
+	for id, peer := range h.peerSnapshot() {
+		if peer.State == model.PeerDead && peer.URL != "" {
+			dead = append(dead, id)
+		}
+	}
+	if len(dead) == 0 {
+		return
+	}
+	target := dead[rand.Intn(len(dead))]
+	if err := h.ping(target); err != nil {
+		logging.Debugf("Dead member %v unreachable: %v", target, err)
+	}
+}
+
+// probe runs one SWIM protocol period against a random member.
+func (h *Handler) probe() {
+	targets := h.randomMembers(1)
+	if len(targets) == 0 {
+		return
+	}
+	target := targets[0]
+	err := h.ping(target)
+	if err == nil {
+		return
+	}
+	logging.Debugf("Direct ping to %v failed: %v", target, err)
+
+	targetURL, _ := h.addressOf(target)
+	helpers := h.randomMembers(IndirectPingCount, target)
+	acks := make(chan bool, len(helpers))
+	for _, helper := range helpers {
+		go func(helper string) {
+			_, err := h.sendSwim(helper, "/swim/ping-req", SwimMessage{Target: target, TargetURL: targetURL}, 2*PingTimeout)
+			if err != nil {
+				logging.Debugf("Indirect ping to %v via %v failed: %v", target, helper, err)
+			}
+			acks <- err == nil
+		}(helper)
+	}
+	for range helpers {
+		if <-acks {
+			h.markSeen(target)
+			return
+		}
+	}
+
+	peer, ok := h.memberState(target)
+	if !ok || (peer.State != model.PeerAlive && peer.State != model.PeerLeaving) {
+		return
+	}
+	logging.Infof("Suspecting %v after failed direct and %d indirect pings", target, len(helpers))
+	h.applyMemberUpdate(MemberUpdate{ID: target, State: model.PeerSuspect, Incarnation: peer.Incarnation})
+}
+
+// expireSuspects declares suspected members dead once their phi crosses the
+// threshold. Members without enough heartbeat history to compute phi fall
+// back to staying suspected for PeerTimeout.
+func (h *Handler) expireSuspects() {
+	var expired []MemberUpdate
+	threshold := h.phiThreshold()
+	timeout := h.settings().PeerTimeout
+	now := time.Now()
+	h.Mu.Lock()
+	for id, peer := range h.Peers {
+		if peer.State != model.PeerSuspect {
+			continue
+		}
+		phi, ok := peer.Phi(now)
+		if (ok && phi >= threshold) || (!ok && now.Sub(peer.StateChanged) >= timeout) {
+			logging.Infof("Declaring %v dead, phi %.2f (threshold %.2f)", id, phi, threshold)
+			expired = append(expired, MemberUpdate{ID: id, State: model.PeerDead, Incarnation: peer.Incarnation})
+		}
+	}
+	h.Mu.Unlock()
+	for _, update := range expired {
+		h.applyMemberUpdate(update)
+	}
+}
+
+func (h *Handler) handleSwimMessage(w http.ResponseWriter, r *http.Request) (SwimMessage, bool) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not supported")
+		return SwimMessage{}, false
+	}
+	var msg SwimMessage
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Error decoding request")
+		return SwimMessage{}, false
+	}
+	h.applyMemberUpdate(msg.From)
+	for _, update := range msg.Updates {
+		h.applyMemberUpdate(update)
+	}
+	h.markSeen(msg.From.ID)
+	return msg, true
+}
+
+// writeAck answers a protocol message. A sender this node holds suspected
+// or dead gets its record back, so it refutes it.
+func (h *Handler) writeAck(w http.ResponseWriter, from MemberUpdate) {
+	w.Header().Set("Content-Type", "application/json")
+	updates := append(h.heldAgainst(from.ID, from.Incarnation), h.piggyback()...)
+	err := json.NewEncoder(w).Encode(SwimMessage{From: h.selfUpdate(), Updates: updates})
+	if err != nil {
+		logging.Errorf("Error encoding ack: %v", err)
+	}
+}
+
+func (h *Handler) PingHandler(w http.ResponseWriter, r *http.Request) {
+	msg, ok := h.handleSwimMessage(w, r)
+	if !ok {
+		return
+	}
+	h.writeAck(w, msg.From)
+}
+
+func (h *Handler) PingReqHandler(w http.ResponseWriter, r *http.Request) {
+	msg, ok := h.handleSwimMessage(w, r)
+	if !ok {
+		return
+	}
+	if _, known := h.memberState(msg.Target); !known && msg.TargetURL != "" {
+		h.applyMemberUpdate(MemberUpdate{ID: msg.Target, URL: msg.TargetURL, State: model.PeerAlive})
+	}
+	if err := h.ping(msg.Target); err != nil {
+		writeJSONError(w, http.StatusBadGateway, fmt.Sprintf("Ping to %v failed: %v", msg.Target, err))
+		return
+	}
+	h.writeAck(w, msg.From)
+}
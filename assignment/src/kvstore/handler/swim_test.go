@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"kvstore/hash"
+	"kvstore/model"
+	"kvstore/store"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newSwimNode(t *testing.T, id string) *Handler {
+	t.Helper()
+	placement, err := hash.NewPlacement("ring", 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Handler{SelfID: id, Vnodes: 8, Replicas: 1, Placement: placement, Store: store.NewMemoryStore()}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/swim/ping", h.PingHandler)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	h.SelfURL = server.URL
+	h.initSelf()
+	return h
+}
+
+// declareDead makes self hold other dead, as if the partition lasted long
+// enough for every update about it to stop being piggybacked.
+func declareDead(self *Handler, other *Handler) {
+	update := other.selfUpdate()
+	update.State = model.PeerDead
+	self.applyMemberUpdate(update)
+	self.swim.mu.Lock()
+	self.swim.updates = nil
+	self.swim.mu.Unlock()
+}
+
+// Two nodes that declared each other dead while they could not reach each
+// other see each other alive again once one of them probes the other.
+func TestPartitionHeals(t *testing.T) {
+	a, b := newSwimNode(t, "a"), newSwimNode(t, "b")
+	declareDead(a, b)
+	declareDead(b, a)
+
+	for i := 0; i < DeadProbePeriods; i++ {
+		a.probeDead()
+	}
+	// a learned from b's ack that b held it dead and refuted; the refutation
+	// reaches b with a's next ping.
+	a.probe()
+
+	for _, pair := range [][2]*Handler{{a, b}, {b, a}} {
+		self, other := pair[0], pair[1]
+		peer, ok := self.memberState(other.SelfID)
+		if !ok || peer.State != model.PeerAlive {
+			t.Errorf("%v holds %v as %v, want alive", self.SelfID, other.SelfID, peer.State)
+		}
+		if !self.Placement.ContainsPeer(other.SelfID) {
+			t.Errorf("%v did not put %v back into the ring", self.SelfID, other.SelfID)
+		}
+	}
+}
+
+func TestDeadMembersProbedAtLowRate(t *testing.T) {
+	a, b := newSwimNode(t, "a"), newSwimNode(t, "b")
+	declareDead(a, b)
+
+	for i := 0; i < DeadProbePeriods-1; i++ {
+		a.probeDead()
+	}
+	if peer, _ := a.memberState("b"); peer.State != model.PeerDead {
+		t.Fatalf("b is %v before a dead member was due to be probed", peer.State)
+	}
+	a.probeDead()
+	if peer, _ := a.memberState("b"); peer.State != model.PeerAlive {
+		t.Errorf("b is %v after it was probed, want alive", peer.State)
+	}
+}
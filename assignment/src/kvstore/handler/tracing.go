@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"kvstore/tracing"
+	"net/http"
+	"strings"
+)
+
+// untraced are routes of membership and monitoring traffic, which runs
+// several times a second and would drown out the requests worth tracing.
+var untraced = []string{"/kv/gossip", "/swim/", "/health", "/metrics"}
+
+// Trace runs every request in a server span, continuing the trace of the
+// node or client that sent a traceparent header. It must wrap Instrument so
+// the span can be named after the matched route.
+func Trace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, prefix := range untraced {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		parent, _ := tracing.Extract(r.Header)
+		ctx, span := tracing.StartWithParent(r.Context(), r.Method+" "+r.URL.Path, tracing.KindServer, parent)
+		defer span.End()
+		r = r.WithContext(ctx)
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		if r.Pattern != "" {
+			span.SetName(r.Method + " " + r.Pattern)
+			span.SetAttribute("http.route", r.Pattern)
+		}
+		span.SetAttribute("http.request.method", r.Method)
+		span.SetAttribute("url.path", r.URL.Path)
+		span.SetAttribute("http.response.status_code", recorder.status)
+		span.SetAttribute("kvstore.forwarded", r.Header.Get("X-From-Node") == "true")
+		if key := r.URL.Query().Get("key"); key != "" {
+			span.SetAttribute("kvstore.key", key)
+		}
+		if recorder.status >= http.StatusInternalServerError {
+			span.SetError(fmt.Errorf("status %d", recorder.status))
+		}
+	})
+}
+
+// startPeerSpan starts a client span for a request to another node and
+// adds the span's trace context to header.
+func startPeerSpan(ctx context.Context, name string, target string, header http.Header) (context.Context, *tracing.Span) {
+	ctx, span := tracing.Start(ctx, name, tracing.KindClient)
+	span.SetAttribute("peer.id", target)
+	tracing.Inject(ctx, header)
+	return ctx, span
+}
+
+func startStoreSpan(ctx context.Context, name string, bucket string, key string) *tracing.Span {
+	_, span := tracing.Start(ctx, name, tracing.KindInternal)
+	span.SetAttribute("kvstore.bucket", bucket)
+	span.SetAttribute("kvstore.key", key)
+	return span
+}
+
+// TracingResource describes this node on exported spans.
+func (h *Handler) TracingResource() map[string]string {
+	return map[string]string{
+		"service.name":        "kvstore",
+		"service.instance.id": h.SelfID,
+		"kvstore.url":         h.SelfURL,
+		"kvstore.zone":        h.Zone,
+	}
+}
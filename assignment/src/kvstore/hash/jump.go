@@ -0,0 +1,194 @@
+package hash
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"kvstore/logging"
+	"sort"
+	"sync"
+)
+
+// Jump places keys with jump consistent hashing (Lamping and Veach) over
+// buckets laid out in the order nodes joined, one bucket per unit of weight.
+// A joining node's buckets are appended, and a node that leaves keeps its
+// buckets: a key hashed to the bucket of a node no longer in the placement is
+// hashed again with the next seed. Joins and leaves therefore only move the
+// keys the node gains or held, at the cost of extra hashing once many nodes
+// have left. The same seed sequence picks the further replicas.
+type Jump struct {
+	mu      sync.RWMutex
+	weights map[string]int
+	// order lists every node ever added, oldest first, and slots how many
+	// buckets each of them has in the layout.
+	order   []string
+	slots   map[string]int
+	buckets []string
+	zones   map[string]string
+}
+
+func NewJump() *Jump {
+	return &Jump{weights: make(map[string]int), slots: make(map[string]int)}
+}
+
+func (j *Jump) rebuild() {
+	j.buckets = j.buckets[:0]
+	for _, node := range j.order {
+		for i := 0; i < j.slots[node]; i++ {
+			j.buckets = append(j.buckets, node)
+		}
+	}
+}
+
+// AddWeightedNode appends the buckets of a node not seen before. A node that
+// comes back with another weight changes the number of buckets it has in
+// place, which renumbers the buckets after it.
+func (j *Jump) AddWeightedNode(node string, weight int) {
+	if weight < 1 {
+		logging.Errorf("Not adding node %v with invalid weight %d", node, weight)
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.weights[node] = weight
+	if _, ok := j.slots[node]; !ok {
+		j.order = append(j.order, node)
+	}
+	j.slots[node] = weight
+	j.rebuild()
+}
+
+func (j *Jump) RemoveNode(node string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	delete(j.weights, node)
+}
+
+// SetJoinOrder lays the buckets out in the given order, which lists every
+// node that was ever in the placement with its weight. Every node derives the
+// order from the shared ring state, so they agree on the layout whatever
+// order they learned about joins in. Nodes added but not listed follow.
+func (j *Jump) SetJoinOrder(nodes []string, weights []int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	order := make([]string, 0, len(nodes))
+	slots := make(map[string]int, len(nodes))
+	for i, node := range nodes {
+		order = append(order, node)
+		slots[node] = weights[i]
+	}
+	for _, node := range j.order {
+		if _, ok := slots[node]; !ok && j.weights[node] > 0 {
+			order = append(order, node)
+			slots[node] = j.weights[node]
+		}
+	}
+	j.order, j.slots = order, slots
+	j.rebuild()
+}
+
+func (j *Jump) ContainsPeer(node string) bool {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	_, ok := j.weights[node]
+	return ok
+}
+
+func (j *Jump) Weight(node string) int {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return j.weights[node]
+}
+
+func (j *Jump) GetAllPeers() []string {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	peers := make([]string, 0, len(j.weights))
+	for node := range j.weights {
+		peers = append(peers, node)
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+// jumpHash maps a key to a bucket in [0, buckets).
+func jumpHash(key uint64, buckets int) int {
+	var b, next int64 = -1, 0
+	for next < int64(buckets) {
+		b = next
+		key = key*2862933555777941757 + 1
+		next = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+// nextSeed derives the seed of the next try for a key (splitmix64).
+func nextSeed(seed uint64) uint64 {
+	seed += 0x9e3779b97f4a7c15
+	z := seed
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+func (j *Jump) GetNodesForKey(key string, replicas int) []string {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+
+	if len(j.weights) == 0 || len(j.buckets) == 0 {
+		return nil
+	}
+	need := replicas
+	if len(j.zones) > 0 || need > len(j.weights) {
+		need = len(j.weights)
+	}
+	sum := sha1.Sum([]byte(key))
+	seed := binary.BigEndian.Uint64(sum[:8])
+	var candidates []string
+	seen := make(map[string]bool)
+	for tries := 0; len(candidates) < need && tries < 8*len(j.buckets); tries++ {
+		node := j.buckets[jumpHash(seed, len(j.buckets))]
+		if _, ok := j.weights[node]; ok && !seen[node] {
+			candidates = append(candidates, node)
+			seen[node] = true
+		}
+		seed = nextSeed(seed)
+	}
+	// Nodes the tries missed, which only happens with few live buckets
+	// among many, follow in join order.
+	for _, node := range j.order {
+		if len(candidates) >= need {
+			break
+		}
+		if _, ok := j.weights[node]; ok && !seen[node] {
+			candidates = append(candidates, node)
+			seen[node] = true
+		}
+	}
+	return selectReplicas(candidates, replicas, j.zones)
+}
+
+func (j *Jump) SetZones(zones map[string]string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.zones = copyZones(zones)
+}
+
+func (j *Jump) Ownership() map[string]float64 {
+	return sampleOwnership(j)
+}
+
+func (j *Jump) Clone() Placement {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	clone := NewJump()
+	for node, weight := range j.weights {
+		clone.weights[node] = weight
+	}
+	for node, slots := range j.slots {
+		clone.slots[node] = slots
+	}
+	clone.order = append(clone.order, j.order...)
+	clone.zones = copyZones(j.zones)
+	clone.rebuild()
+	return clone
+}
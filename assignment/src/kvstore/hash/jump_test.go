@@ -0,0 +1,78 @@
+package hash
+
+import (
+	"strconv"
+	"testing"
+)
+
+const jumpKeys = 20000
+
+func newTestJump(nodes int) *Jump {
+	j := NewJump()
+	for i := 0; i < nodes; i++ {
+		j.AddWeightedNode("node-"+strconv.Itoa(i), 16)
+	}
+	return j
+}
+
+// movedPrimaries returns the fraction of keys whose primary differs.
+func movedPrimaries(before, after Placement) float64 {
+	moved := 0
+	for i := 0; i < jumpKeys; i++ {
+		key := "key-" + strconv.Itoa(i)
+		if before.GetNodesForKey(key, 1)[0] != after.GetNodesForKey(key, 1)[0] {
+			moved++
+		}
+	}
+	return float64(moved) / jumpKeys
+}
+
+func TestJumpMovement(t *testing.T) {
+	cases := []struct {
+		name   string
+		change func(j *Jump)
+		ideal  float64
+	}{
+		{"join", func(j *Jump) { j.AddWeightedNode("node-10", 16) }, 1.0 / 11},
+		{"leave first", func(j *Jump) { j.RemoveNode("node-0") }, 1.0 / 10},
+		{"leave middle", func(j *Jump) { j.RemoveNode("node-5") }, 1.0 / 10},
+		{"leave last", func(j *Jump) { j.RemoveNode("node-9") }, 1.0 / 10},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			before := newTestJump(10)
+			after := before.Clone().(*Jump)
+			tc.change(after)
+			if moved := movedPrimaries(before, after); moved > 1.2*tc.ideal {
+				t.Errorf("%.1f%% of primaries moved, ideal is %.1f%%", 100*moved, 100*tc.ideal)
+			}
+		})
+	}
+}
+
+func TestJumpRejoinRestoresPlacement(t *testing.T) {
+	before := newTestJump(10)
+	after := before.Clone().(*Jump)
+	after.RemoveNode("node-5")
+	after.AddWeightedNode("node-5", 16)
+	if moved := movedPrimaries(before, after); moved != 0 {
+		t.Errorf("%.1f%% of primaries moved after a node left and came back", 100*moved)
+	}
+}
+
+func TestJumpJoinOrderDecidesLayout(t *testing.T) {
+	nodes := []string{"node-2", "node-0", "node-1"}
+	weights := []int{16, 16, 16}
+	a, b := NewJump(), NewJump()
+	for _, node := range nodes {
+		a.AddWeightedNode(node, 16)
+	}
+	for i := len(nodes) - 1; i >= 0; i-- {
+		b.AddWeightedNode(nodes[i], 16)
+	}
+	a.SetJoinOrder(nodes, weights)
+	b.SetJoinOrder(nodes, weights)
+	if moved := movedPrimaries(a, b); moved != 0 {
+		t.Errorf("placements with the same join order differ for %.1f%% of keys", 100*moved)
+	}
+}
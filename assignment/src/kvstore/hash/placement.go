@@ -0,0 +1,77 @@
+package hash
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Placement decides which nodes hold the replicas of a key. Every strategy
+// must place keys identically on every node given the same nodes and
+// weights.
+type Placement interface {
+	// AddWeightedNode adds a node whose share of keys grows with weight.
+	// Weights below 1 are invalid and the node is not added, since nodes
+	// falling back to different defaults would place keys differently.
+	AddWeightedNode(node string, weight int)
+	RemoveNode(node string)
+	ContainsPeer(node string) bool
+	// Weight returns the weight a node was added with.
+	Weight(node string) int
+	GetAllPeers() []string
+	GetNodesForKey(key string, replicas int) []string
+	// Ownership returns the fraction of keys each node is the primary
+	// replica for.
+	Ownership() map[string]float64
+	Clone() Placement
+}
+
+const (
+	StrategyRing       = "ring"
+	StrategyRendezvous = "rendezvous"
+	StrategyJump       = "jump"
+)
+
+// Ordered is implemented by placements whose layout depends on the order
+// nodes joined in. SetJoinOrder lists every node that was ever in the
+// placement, including those that left, oldest first, with its weight.
+type Ordered interface {
+	SetJoinOrder(nodes []string, weights []int)
+}
+
+var Strategies = []string{StrategyRing, StrategyRendezvous, StrategyJump}
+
+// NewPlacement creates an empty placement of the named strategy. The default
+// weight is the number of vnodes HashRing.AddNode gives a node.
+func NewPlacement(strategy string, defaultWeight int) (Placement, error) {
+	switch strategy {
+	case "", StrategyRing:
+		return NewHashRing(nil, defaultWeight), nil
+	case StrategyRendezvous:
+		return NewRendezvous(), nil
+	case StrategyJump:
+		return NewJump(), nil
+	}
+	return nil, fmt.Errorf("unknown placement strategy %q, available: %v", strategy, Strategies)
+}
+
+const ownershipSamples = 100000
+
+// sampleOwnership estimates ownership for strategies without a closed form
+// by placing a fixed set of sample keys.
+func sampleOwnership(p Placement) map[string]float64 {
+	ownership := make(map[string]float64)
+	if len(p.GetAllPeers()) == 0 {
+		return ownership
+	}
+	counts := make(map[string]int)
+	for i := 0; i < ownershipSamples; i++ {
+		nodes := p.GetNodesForKey("sample-"+strconv.Itoa(i), 1)
+		if len(nodes) > 0 {
+			counts[nodes[0]]++
+		}
+	}
+	for node, count := range counts {
+		ownership[node] = float64(count) / ownershipSamples
+	}
+	return ownership
+}
@@ -0,0 +1,76 @@
+package hash
+
+import "sort"
+
+// Ranged is implemented by placements that assign whole token ranges to the
+// same replicas, which lets a rebalance find the ranges that moved without
+// looking at every key.
+type Ranged interface {
+	Tokens() []uint32
+	GetNodesForToken(token uint32, replicas int) []string
+}
+
+// TokenRange covers the tokens in (Start, End], wrapping around the ring
+// when End <= Start. A range whose Start equals End covers every token.
+type TokenRange struct {
+	Start uint32 `json:"start"`
+	End   uint32 `json:"end"`
+}
+
+func (r TokenRange) Contains(token uint32) bool {
+	if r.Start < r.End {
+		return token > r.Start && token <= r.End
+	}
+	return token > r.Start || token <= r.End
+}
+
+// Token returns the ring position of a key.
+func Token(key string) uint32 {
+	return hashKey(key)
+}
+
+// ChangedRanges returns the token ranges whose set of replicas differs
+// between two placements.
+func ChangedRanges(before, after Ranged, replicas int) []TokenRange {
+	unique := make(map[uint32]bool)
+	for _, token := range before.Tokens() {
+		unique[token] = true
+	}
+	for _, token := range after.Tokens() {
+		unique[token] = true
+	}
+	tokens := make([]uint32, 0, len(unique))
+	for token := range unique {
+		tokens = append(tokens, token)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i] < tokens[j]
+	})
+
+	// Between two consecutive tokens of either placement nothing changes,
+	// so each range's end token stands for the whole range.
+	var changed []TokenRange
+	for i, token := range tokens {
+		prev := tokens[(i+len(tokens)-1)%len(tokens)]
+		if !sameNodes(before.GetNodesForToken(token, replicas), after.GetNodesForToken(token, replicas)) {
+			changed = append(changed, TokenRange{Start: prev, End: token})
+		}
+	}
+	return changed
+}
+
+func sameNodes(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	set := make(map[string]bool, len(a))
+	for _, node := range a {
+		set[node] = true
+	}
+	for _, node := range b {
+		if !set[node] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,104 @@
+package hash
+
+import (
+	"math"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestTokenRangeContains(t *testing.T) {
+	cases := []struct {
+		name  string
+		r     TokenRange
+		token uint32
+		want  bool
+	}{
+		{"start excluded", TokenRange{Start: 10, End: 20}, 10, false},
+		{"inside", TokenRange{Start: 10, End: 20}, 15, true},
+		{"end included", TokenRange{Start: 10, End: 20}, 20, true},
+		{"after end", TokenRange{Start: 10, End: 20}, 21, false},
+		{"wrapping, before zero", TokenRange{Start: math.MaxUint32 - 5, End: 5}, math.MaxUint32, true},
+		{"wrapping, zero", TokenRange{Start: math.MaxUint32 - 5, End: 5}, 0, true},
+		{"wrapping, end included", TokenRange{Start: math.MaxUint32 - 5, End: 5}, 5, true},
+		{"wrapping, start excluded", TokenRange{Start: math.MaxUint32 - 5, End: 5}, math.MaxUint32 - 5, false},
+		{"wrapping, outside", TokenRange{Start: math.MaxUint32 - 5, End: 5}, 6, false},
+		{"ending at the top", TokenRange{Start: 10, End: math.MaxUint32}, math.MaxUint32, true},
+		{"full ring", TokenRange{Start: 7, End: 7}, 7, true},
+		{"full ring, elsewhere", TokenRange{Start: 7, End: 7}, 100, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.r.Contains(tc.token); got != tc.want {
+				t.Errorf("%+v.Contains(%d) = %v, want %v", tc.r, tc.token, got, tc.want)
+			}
+		})
+	}
+}
+
+// fixedRing is a Ranged whose token owners are given directly; a token is
+// served by the owner of the next listed token, wrapping around.
+type fixedRing map[uint32]string
+
+func (f fixedRing) Tokens() []uint32 {
+	tokens := make([]uint32, 0, len(f))
+	for token := range f {
+		tokens = append(tokens, token)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i] < tokens[j] })
+	return tokens
+}
+
+func (f fixedRing) GetNodesForToken(token uint32, replicas int) []string {
+	tokens := f.Tokens()
+	idx := sort.Search(len(tokens), func(i int) bool { return tokens[i] >= token })
+	return []string{f[tokens[idx%len(tokens)]]}
+}
+
+func TestChangedRanges(t *testing.T) {
+	cases := []struct {
+		name   string
+		before fixedRing
+		after  fixedRing
+		want   []TokenRange
+	}{
+		{
+			name:   "unchanged",
+			before: fixedRing{100: "a", 200: "b"},
+			after:  fixedRing{100: "a", 200: "b"},
+			want:   nil,
+		},
+		{
+			name:   "node added in the middle",
+			before: fixedRing{100: "a", 200: "b"},
+			after:  fixedRing{100: "a", 150: "c", 200: "b"},
+			want:   []TokenRange{{Start: 100, End: 150}},
+		},
+		{
+			name:   "node added before the first token takes the wrapping range",
+			before: fixedRing{100: "a", 200: "b"},
+			after:  fixedRing{50: "c", 100: "a", 200: "b"},
+			want:   []TokenRange{{Start: 200, End: 50}},
+		},
+		{
+			name:   "node removed hands its range to the next token",
+			before: fixedRing{100: "a", 150: "c", 200: "b"},
+			after:  fixedRing{100: "a", 200: "b"},
+			want:   []TokenRange{{Start: 100, End: 150}},
+		},
+		{
+			name:   "owner changed on the wrapping range",
+			before: fixedRing{100: "a", 200: "b"},
+			after:  fixedRing{100: "c", 200: "b"},
+			want:   []TokenRange{{Start: 200, End: 100}},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := ChangedRanges(tc.before, tc.after, 1)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("ChangedRanges = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
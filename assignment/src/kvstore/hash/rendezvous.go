@@ -0,0 +1,117 @@
+package hash
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"kvstore/logging"
+	"math"
+	"sort"
+	"sync"
+)
+
+// Rendezvous implements weighted highest-random-weight hashing: every node
+// scores each key and the highest scores hold the replicas. Adding or
+// removing a node only moves the keys that node wins or held.
+type Rendezvous struct {
+	mu      sync.RWMutex
+	weights map[string]int
+	zones   map[string]string
+}
+
+func NewRendezvous() *Rendezvous {
+	return &Rendezvous{weights: make(map[string]int)}
+}
+
+func (r *Rendezvous) AddWeightedNode(node string, weight int) {
+	if weight < 1 {
+		logging.Errorf("Not adding node %v with invalid weight %d", node, weight)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.weights[node] = weight
+}
+
+func (r *Rendezvous) RemoveNode(node string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.weights, node)
+}
+
+func (r *Rendezvous) ContainsPeer(node string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.weights[node]
+	return ok
+}
+
+func (r *Rendezvous) Weight(node string) int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.weights[node]
+}
+
+func (r *Rendezvous) GetAllPeers() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	peers := make([]string, 0, len(r.weights))
+	for node := range r.weights {
+		peers = append(peers, node)
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+// score is the weighted rendezvous score -w/ln(h), where h is the key and
+// node hashed to (0, 1).
+func score(key string, node string, weight int) float64 {
+	sum := sha1.Sum([]byte(node + "|" + key))
+	h := (float64(binary.BigEndian.Uint64(sum[:8])>>11) + 0.5) / float64(1<<53)
+	return -float64(weight) / math.Log(h)
+}
+
+func (r *Rendezvous) GetNodesForKey(key string, replicas int) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	type scored struct {
+		node  string
+		score float64
+	}
+	scores := make([]scored, 0, len(r.weights))
+	for node, weight := range r.weights {
+		scores = append(scores, scored{node: node, score: score(key, node, weight)})
+	}
+	sort.Slice(scores, func(i, j int) bool {
+		if scores[i].score != scores[j].score {
+			return scores[i].score > scores[j].score
+		}
+		return scores[i].node < scores[j].node
+	})
+	candidates := make([]string, len(scores))
+	for i, s := range scores {
+		candidates[i] = s.node
+	}
+	return selectReplicas(candidates, replicas, r.zones)
+}
+
+func (r *Rendezvous) SetZones(zones map[string]string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.zones = copyZones(zones)
+}
+
+func (r *Rendezvous) Ownership() map[string]float64 {
+	return sampleOwnership(r)
+}
+
+func (r *Rendezvous) Clone() Placement {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	clone := NewRendezvous()
+	for node, weight := range r.weights {
+		clone.weights[node] = weight
+	}
+	clone.zones = copyZones(r.zones)
+	return clone
+}
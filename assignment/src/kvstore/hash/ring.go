@@ -13,6 +13,19 @@ type HashRing struct {
 	nodes        map[uint32]string
 	sortedHashes []uint32
 	virtualNodes int
+	// vnodes holds the number of virtual nodes each node was added with.
+	vnodes map[string]int
+
+	// With loadEpsilon set, each token range goes to the first node
+	// clockwise whose assigned share of the hash space is still below
+	// (1+loadEpsilon) times its fair share (consistent hashing with bounded
+	// loads, with ranges as the balls). owners[i] is the primary of the
+	// range ending at sortedHashes[i]. Ranges are assigned in token order,
+	// so every node derives the same owners from the same ring.
+	loadEpsilon float64
+	owners      []string
+
+	zones map[string]string
 }
 
 func NewHashRing(peers []string, replicas int) *HashRing {
@@ -20,6 +33,7 @@ func NewHashRing(peers []string, replicas int) *HashRing {
 		nodes:        make(map[uint32]string),
 		sortedHashes: []uint32{},
 		virtualNodes: replicas,
+		vnodes:       make(map[string]int),
 	}
 	for _, peer := range peers {
 		hr.AddNode(peer)
@@ -33,9 +47,20 @@ func hashKey(key string) uint32 {
 }
 
 func (hr *HashRing) AddNode(peer string) {
+	hr.AddWeightedNode(peer, hr.virtualNodes)
+}
+
+// AddWeightedNode adds a node with its own number of virtual nodes, so nodes
+// with more capacity own a proportionally larger share of the keys.
+func (hr *HashRing) AddWeightedNode(peer string, vnodes int) {
+	if vnodes < 1 {
+		logging.Errorf("Not adding node %v with invalid vnode count %d", peer, vnodes)
+		return
+	}
 	hr.mu.Lock()
 	defer hr.mu.Unlock()
-	for i := 0; i < hr.virtualNodes; i++ {
+	hr.vnodes[peer] = vnodes
+	for i := 0; i < vnodes; i++ {
 		hash := hashKey(peer + "#" + strconv.Itoa(i))
 		hr.nodes[hash] = peer
 		hr.sortedHashes = append(hr.sortedHashes, hash)
@@ -43,17 +68,21 @@ func (hr *HashRing) AddNode(peer string) {
 	sort.Slice(hr.sortedHashes, func(i, j int) bool {
 		return hr.sortedHashes[i] < hr.sortedHashes[j]
 	})
-	logging.Infof("Added node %v to hash ring %v", peer, hr.nodes)
+	hr.assignOwners()
+	logging.Infof("Added node %v to hash ring with %d vnodes", peer, vnodes)
 }
 
 func (hr *HashRing) RemoveNode(peer string) {
 	hr.mu.Lock()
 	defer hr.mu.Unlock()
 
-	for i := 0; i < hr.virtualNodes; i++ {
+	for i := 0; i < hr.vnodes[peer]; i++ {
 		hash := hashKey(peer + "#" + strconv.Itoa(i))
-		delete(hr.nodes, hash)
+		if hr.nodes[hash] == peer {
+			delete(hr.nodes, hash)
+		}
 	}
+	delete(hr.vnodes, peer)
 	hr.sortedHashes = make([]uint32, 0, len(hr.nodes))
 	for hash := range hr.nodes {
 		hr.sortedHashes = append(hr.sortedHashes, hash)
@@ -61,7 +90,8 @@ func (hr *HashRing) RemoveNode(peer string) {
 	sort.Slice(hr.sortedHashes, func(i, j int) bool {
 		return hr.sortedHashes[i] < hr.sortedHashes[j]
 	})
-	logging.Infof("Removed node %v from hash ring %v", peer, hr.nodes)
+	hr.assignOwners()
+	logging.Infof("Removed node %v from hash ring", peer)
 }
 
 func (hr *HashRing) GetNodeForKey(key string) string {
@@ -79,37 +109,160 @@ func (hr *HashRing) GetNodeForKey(key string) string {
 }
 
 func (hr *HashRing) GetNodesForKey(key string, replicas int) []string {
+	return hr.GetNodesForToken(hashKey(key), replicas)
+}
+
+// GetNodesForToken returns the replicas for a position on the ring; every
+// key hashing to the same range between two tokens has the same replicas.
+func (hr *HashRing) GetNodesForToken(hash uint32, replicas int) []string {
 	hr.mu.RLock()
 	defer hr.mu.RUnlock()
 
-	hash := hashKey(key)
 	idx := sort.Search(len(hr.sortedHashes), func(i int) bool {
 		return hr.sortedHashes[i] >= hash
 	})
 
-	var result []string
+	if idx == len(hr.sortedHashes) {
+		idx = 0
+	}
+
+	// Zones may skip nodes, so the whole ring order is needed; otherwise the
+	// first distinct nodes clockwise are the replicas. With bounded loads
+	// the range's assigned owner comes first.
+	need := replicas
+	if len(hr.zones) > 0 {
+		need = len(hr.vnodes)
+	}
+	var candidates []string
 	seen := make(map[string]bool)
-	for i := 0; len(result) < replicas && i < len(hr.sortedHashes); i++ {
+	if hr.owners != nil {
+		candidates = append(candidates, hr.owners[idx])
+		seen[hr.owners[idx]] = true
+	}
+	for i := 0; len(candidates) < need && i < len(hr.sortedHashes); i++ {
 		node := hr.nodes[hr.sortedHashes[(idx+i)%len(hr.sortedHashes)]]
 		if !seen[node] {
-			result = append(result, node)
+			candidates = append(candidates, node)
 			seen[node] = true
 		}
 	}
-	return result
+	return selectReplicas(candidates, replicas, hr.zones)
+}
+
+// assignOwners assigns every token range a primary under bounded loads. A
+// node only goes over its capacity when no node clockwise can take the whole
+// range, and then by less than one range. The capacities add up to more than
+// the whole hash space, so some node always has room. The caller holds hr.mu
+// for writing.
+func (hr *HashRing) assignOwners() {
+	hr.owners = nil
+	if hr.loadEpsilon <= 0 || len(hr.sortedHashes) == 0 {
+		return
+	}
+	const space = float64(1 << 32)
+	totalVnodes := 0
+	for _, vnodes := range hr.vnodes {
+		totalVnodes += vnodes
+	}
+	n := len(hr.sortedHashes)
+	assigned := make(map[string]float64, len(hr.vnodes))
+	hr.owners = make([]string, n)
+	for i, token := range hr.sortedHashes {
+		arc := float64(token - hr.sortedHashes[(i+n-1)%n]) // wraps around for the first range
+		if n == 1 {
+			arc = space
+		}
+		// Prefer the first node the whole range fits in; failing that, the
+		// first one that still has room.
+		owner, fallback := "", ""
+		for j := 0; j < n && owner == ""; j++ {
+			node := hr.nodes[hr.sortedHashes[(i+j)%n]]
+			capacity := (1 + hr.loadEpsilon) * space * float64(hr.vnodes[node]) / float64(totalVnodes)
+			if assigned[node]+arc <= capacity {
+				owner = node
+			} else if fallback == "" && assigned[node] < capacity {
+				fallback = node
+			}
+		}
+		if owner == "" {
+			owner = fallback
+		}
+		hr.owners[i] = owner
+		assigned[owner] += arc
+	}
+}
+
+// SetZones records the zone of each node; replicas of a key are spread over
+// as many zones as possible.
+func (hr *HashRing) SetZones(zones map[string]string) {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	hr.zones = copyZones(zones)
+}
+
+// SetBoundedLoad enables consistent hashing with bounded loads, which caps
+// each node's primary share of the hash space at (1+epsilon) times its
+// weighted fair share. An epsilon of zero disables it.
+func (hr *HashRing) SetBoundedLoad(epsilon float64) {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	hr.loadEpsilon = epsilon
+	hr.assignOwners()
 }
 
 func (hr *HashRing) ContainsPeer(peer string) bool {
 	hr.mu.RLock()
 	defer hr.mu.RUnlock()
 
-	for i := 0; i < hr.virtualNodes; i++ {
-		hash := hashKey(peer + "#" + strconv.Itoa(i))
-		if _, ok := hr.nodes[hash]; ok {
-			return true
+	_, ok := hr.vnodes[peer]
+	return ok
+}
+
+// Tokens returns the positions of all vnodes, sorted.
+func (hr *HashRing) Tokens() []uint32 {
+	hr.mu.RLock()
+	defer hr.mu.RUnlock()
+	return append([]uint32(nil), hr.sortedHashes...)
+}
+
+// Weight returns the number of virtual nodes a node was added with.
+func (hr *HashRing) Weight(peer string) int {
+	hr.mu.RLock()
+	defer hr.mu.RUnlock()
+	return hr.vnodes[peer]
+}
+
+// Ownership returns the fraction of the hash space each node owns, i.e. the
+// share of keys it is the primary replica for.
+func (hr *HashRing) Ownership() map[string]float64 {
+	hr.mu.RLock()
+	defer hr.mu.RUnlock()
+
+	ownership := make(map[string]float64, len(hr.vnodes))
+	if len(hr.sortedHashes) == 0 {
+		return ownership
+	}
+	const space = float64(1 << 32)
+	for i, hash := range hr.sortedHashes {
+		// Each vnode owns the arc from its predecessor, exclusive, to itself.
+		var prev uint32
+		if i == 0 {
+			prev = hr.sortedHashes[len(hr.sortedHashes)-1]
+		} else {
+			prev = hr.sortedHashes[i-1]
 		}
+		arc := hash - prev // wraps around for the first vnode
+		owner := hr.nodes[hash]
+		if hr.owners != nil {
+			owner = hr.owners[i]
+		}
+		if len(hr.sortedHashes) == 1 {
+			ownership[owner] = 1
+			break
+		}
+		ownership[owner] += float64(arc) / space
 	}
-	return false
+	return ownership
 }
 
 func (hr *HashRing) GetAllPeers() []string {
@@ -129,3 +282,25 @@ func (hr *HashRing) GetAllPeers() []string {
 	sort.Strings(peers)
 	return peers
 }
+
+func (hr *HashRing) Clone() Placement {
+	hr.mu.RLock()
+	defer hr.mu.RUnlock()
+
+	clone := &HashRing{
+		nodes:        make(map[uint32]string, len(hr.nodes)),
+		sortedHashes: append([]uint32(nil), hr.sortedHashes...),
+		virtualNodes: hr.virtualNodes,
+		vnodes:       make(map[string]int, len(hr.vnodes)),
+		loadEpsilon:  hr.loadEpsilon,
+		owners:       append([]string(nil), hr.owners...),
+		zones:        copyZones(hr.zones),
+	}
+	for hash, peer := range hr.nodes {
+		clone.nodes[hash] = peer
+	}
+	for peer, vnodes := range hr.vnodes {
+		clone.vnodes[peer] = vnodes
+	}
+	return clone
+}
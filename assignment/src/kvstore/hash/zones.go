@@ -0,0 +1,48 @@
+package hash
+
+// ZoneAware is implemented by placements that spread the replicas of a key
+// over distinct zones.
+type ZoneAware interface {
+	SetZones(zones map[string]string)
+}
+
+// selectReplicas picks replicas from candidates, which are distinct nodes in
+// the strategy's preference order. Nodes in a zone not used yet come first;
+// when there are fewer zones than replicas the remaining replicas are filled
+// in preference order. Nodes without a zone share the empty zone, so without
+// any zones configured this is plain preference order.
+func selectReplicas(candidates []string, replicas int, zones map[string]string) []string {
+	result := make([]string, 0, replicas)
+	chosen := make(map[string]bool, replicas)
+	usedZones := make(map[string]bool)
+	take := func(node string) {
+		result = append(result, node)
+		chosen[node] = true
+		usedZones[zones[node]] = true
+	}
+	for _, node := range candidates {
+		if len(result) >= replicas {
+			return result
+		}
+		if !usedZones[zones[node]] {
+			take(node)
+		}
+	}
+	for _, node := range candidates {
+		if len(result) >= replicas {
+			return result
+		}
+		if !chosen[node] {
+			take(node)
+		}
+	}
+	return result
+}
+
+func copyZones(zones map[string]string) map[string]string {
+	copied := make(map[string]string, len(zones))
+	for node, zone := range zones {
+		copied[node] = zone
+	}
+	return copied
+}
@@ -0,0 +1,59 @@
+package hash
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSelectReplicas(t *testing.T) {
+	cases := []struct {
+		name       string
+		candidates []string
+		replicas   int
+		zones      map[string]string
+		want       []string
+	}{
+		{
+			name:       "no zones keeps preference order",
+			candidates: []string{"a", "b", "c", "d"},
+			replicas:   3,
+			want:       []string{"a", "b", "c"},
+		},
+		{
+			name:       "skips nodes in a used zone",
+			candidates: []string{"a", "b", "c", "d"},
+			replicas:   3,
+			zones:      map[string]string{"a": "z1", "b": "z1", "c": "z2", "d": "z3"},
+			want:       []string{"a", "c", "d"},
+		},
+		{
+			name:       "fewer zones than replicas fills in preference order",
+			candidates: []string{"a", "b", "c", "d"},
+			replicas:   3,
+			zones:      map[string]string{"a": "z1", "b": "z1", "c": "z1", "d": "z2"},
+			want:       []string{"a", "d", "b"},
+		},
+		{
+			name:       "nodes without a zone share one",
+			candidates: []string{"a", "b", "c"},
+			replicas:   2,
+			zones:      map[string]string{"c": "z1"},
+			want:       []string{"a", "c"},
+		},
+		{
+			name:       "fewer candidates than replicas",
+			candidates: []string{"a", "b"},
+			replicas:   3,
+			zones:      map[string]string{"a": "z1", "b": "z2"},
+			want:       []string{"a", "b"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := selectReplicas(tc.candidates, tc.replicas, tc.zones)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("selectReplicas = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -3,20 +3,31 @@ package logging
 import (
 	"context"
 	"fmt"
+	"io"
 	"log/slog"
 	"runtime"
 	"time"
 )
 
-var Logger *slog.Logger
+// Logger discards everything until InitLogger is called, so packages that
+// log can also be used as a library, e.g. by the client.
+var Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// level can be changed with SetDebug while the logger is in use.
+var level slog.LevelVar
 
 func InitLogger(debug bool) {
-	var level = slog.LevelInfo
+	SetDebug(debug)
+	handler := NewPrettyHandler(&level)
+	Logger = slog.New(handler)
+}
+
+func SetDebug(debug bool) {
 	if debug {
-		level = slog.LevelDebug
+		level.Set(slog.LevelDebug)
+	} else {
+		level.Set(slog.LevelInfo)
 	}
-	handler := NewPrettyHandler(level)
-	Logger = slog.New(handler)
 }
 
 func Infof(format string, args ...interface{}) {
@@ -10,17 +10,17 @@ import (
 )
 
 type PrettyHandler struct {
-	level slog.Level
+	level slog.Leveler
 }
 
-func NewPrettyHandler(level slog.Level) slog.Handler {
+func NewPrettyHandler(level slog.Leveler) slog.Handler {
 	return &PrettyHandler{
 		level: level,
 	}
 }
 
 func (h *PrettyHandler) Enabled(_ context.Context, level slog.Level) bool {
-	return level >= h.level
+	return level >= h.level.Level()
 }
 
 func (h *PrettyHandler) Handle(_ context.Context, r slog.Record) error {
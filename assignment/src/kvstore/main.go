@@ -1,100 +1,197 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"kvstore/handler"
 	"kvstore/hash"
 	"kvstore/logging"
-	"kvstore/model"
+	"kvstore/metrics"
+	"kvstore/nodeid"
 	"kvstore/store"
+	"kvstore/tracing"
 	"log"
+	"math"
 	"net/http"
 	"os"
-	"strings"
-	"time"
+	"os/signal"
+	"sync"
+	"syscall"
 )
 
-type Config struct {
-	SelfURL string
-	Port    string
-	Peers   []string
-}
-
-func loadConfig() Config {
-	selfURL := os.Getenv("SELF_URL")
-	port := os.Getenv("PORT")
-	peersRaw := os.Getenv("PEERS")
-
-	if selfURL == "" || port == "" || peersRaw == "" {
-		fmt.Println("Missing environment variables. Required: SELF_URL, PORT, PEERS")
-		os.Exit(1)
-	}
-
-	peers := strings.Split(peersRaw, ",")
-
-	return Config{
-		SelfURL: selfURL,
-		Port:    port,
-		Peers:   peers,
-	}
-}
-
 func SetupRoutes(h *handler.Handler) http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/health", h.HealthHandler)
+	mux.Handle("/metrics", metrics.Handler())
 	mux.Handle("/kv", h)
 	mux.HandleFunc("/kv/all", h.GetAllHandler)
+	mux.HandleFunc("/kv/scan", h.ScanHandler)
 	mux.HandleFunc("/kv/gossip", h.GossipHandler)
+	mux.HandleFunc("/swim/ping", h.PingHandler)
+	mux.HandleFunc("/swim/ping-req", h.PingReqHandler)
+	mux.HandleFunc("/cluster/join", h.JoinHandler)
+	mux.HandleFunc("/cluster/topology", h.TopologyHandler)
 	mux.HandleFunc("/kv/internal", h.InternalPutHandler)
-	return mux
+	mux.HandleFunc("/kv/internal/batch", h.InternalBatchHandler)
+	mux.HandleFunc("/kv/internal/confirm", h.InternalConfirmHandler)
+	mux.HandleFunc("/kv/query", h.QueryHandler)
+	mux.HandleFunc("/kv/history", h.HistoryHandler)
+	mux.HandleFunc("/crdt/counter", h.CounterHandler)
+	mux.HandleFunc("/crdt/set", h.SetHandler)
+	mux.HandleFunc("/crdt/register", h.RegisterHandler)
+	mux.HandleFunc("/crdt/map", h.MapHandler)
+	mux.HandleFunc("/admin/buckets", h.RequireAdmin(h.BucketsHandler))
+	mux.HandleFunc("/admin/indexes", h.RequireAdmin(h.IndexesHandler))
+	mux.HandleFunc("/admin/phi", h.RequireAdmin(h.PhiHandler))
+	mux.HandleFunc("/admin/decommission", h.RequireAdmin(h.DecommissionHandler))
+	mux.HandleFunc("/admin/ring", h.RequireAdmin(h.RingHandler))
+	mux.HandleFunc("/admin/ownership", h.RequireAdmin(h.OwnershipHandler))
+	mux.HandleFunc("/admin/transfers", h.RequireAdmin(h.TransfersHandler))
+	mux.HandleFunc("/admin/cleanup", h.RequireAdmin(h.CleanupHandler))
+	mux.HandleFunc("/admin/peers", h.RequireAdmin(h.PeersHandler))
+	mux.HandleFunc("/admin/tokens", h.RequireAdmin(h.TokensHandler))
+	mux.HandleFunc("/admin/preference", h.RequireAdmin(h.PreferenceHandler))
+	mux.HandleFunc("/admin/members", h.RequireAdmin(h.MembersHandler))
+	mux.HandleFunc("/admin/reload", h.RequireAdmin(h.ReloadHandler))
+	return handler.Trace(handler.Instrument(mux))
 }
 
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	logging.InitLogger(false)
-
-	config := loadConfig()
-
-	logging.Infof("SELF_URL: %s", config.SelfURL)
-	logging.Infof("PORT    : %s", config.Port)
-	logging.Infof("PEERS   : %s", config.Peers)
+	config, sources, loader := loadConfig(os.Args[1:])
+	logging.InitLogger(config.Debug)
 
-	hr := hash.NewHashRing(config.Peers, 1)
-	hr.AddNode(config.SelfURL)
+	selfID, err := nodeid.Load(config.DataDir)
+	if err != nil {
+		fmt.Println("Error loading node id:", err)
+		os.Exit(1)
+	}
 
-	kvStore := store.NewMemoryStore()
+	logging.Infof("NODE_ID : %s", selfID)
+	for _, line := range config.describe(sources) {
+		logging.Infof("%s", line)
+	}
+	if config.AdminToken == "" {
+		logging.Infof("ADMIN_INSECURE is set and ADMIN_TOKEN is not, the admin API is unauthenticated")
+	}
 
-	peers := make(map[string]*model.PeerInfo)
-	peers[config.SelfURL] = &model.PeerInfo{
-		URL:      config.SelfURL,
-		LastSeen: time.Now(),
+	// Nodes, including this one, are added to the placement as the gossiped
+	// ring state admits them.
+	placement, err := hash.NewPlacement(config.Placement, config.Vnodes)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
 	}
-	for _, peer := range config.Peers {
-		peers[peer] = &model.PeerInfo{
-			URL:      peer,
-			LastSeen: time.Now(),
-		}
+	if ring, ok := placement.(*hash.HashRing); ok {
+		ring.SetBoundedLoad(config.LoadEpsilon)
 	}
+	// A node's weight scales the number of vnodes it advertises.
+	selfVnodes := int(math.Max(1, math.Round(float64(config.Vnodes)*config.Weight)))
+
+	kvStore := store.NewMemoryStoreWithRetention(config.Retention)
+	kvStore.SetTokenFunc(handler.KeyToken)
 
 	h := &handler.Handler{
-		SelfURL:     config.SelfURL,
-		HashRing:    hr,
-		Store:       kvStore,
-		Replicas:    3,
-		ReadQuorum:  2,
-		WriteQuorum: 2,
-		Peers:       peers,
+		SelfID:       selfID,
+		SelfURL:      config.SelfURL,
+		Vnodes:       selfVnodes,
+		Zone:         config.Zone,
+		LoadEpsilon:  config.LoadEpsilon,
+		Placement:    placement,
+		Store:        kvStore,
+		Replicas:     config.Replicas,
+		ReadQuorum:   config.ReadQuorum,
+		WriteQuorum:  config.WriteQuorum,
+		Seeds:        config.Seeds,
+		PhiThreshold: config.PhiThreshold,
+
+		PlacementStrategy: config.Placement,
+		RebalanceRate:     config.RebalanceRate,
+		CleanupDelay:      config.CleanupDelay,
+		CleanupDryRun:     config.CleanupDryRun,
+		AdminToken:        config.AdminToken,
+		AdminInsecure:     config.AdminInsecure,
+
+		GossipInterval: config.GossipInterval,
+		PeerTimeout:    config.PeerTimeout,
 	}
 
+	h.RegisterMetrics()
+	exporter, err := newTraceExporter(config)
+	if err != nil {
+		fmt.Println("Error opening trace exporter:", err)
+		os.Exit(1)
+	}
+	tracing.SetSampleRatio(config.TraceSampleRatio)
+	tracing.SetExporter(exporter, h.TracingResource())
 	router := SetupRoutes(h)
 
+	addr := ":" + config.Port
+	server := &http.Server{Addr: addr, Handler: router}
+	stopped := make(chan struct{})
+	var shutdownOnce sync.Once
+	// shutdown hands this node's keys to the nodes that own them once it is
+	// gone and tells peers it left so they stop routing to it, then stops
+	// accepting requests and waits for the running ones. Keys those requests
+	// wrote are handed off as well before gossip stops. The store lives in
+	// memory, so whatever was not handed off is lost with the process.
+	shutdown := func(reason string) {
+		shutdownOnce.Do(func() {
+			logging.Infof("Shutting down: %s", reason)
+			h.Leave()
+			ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+			defer cancel()
+			if err := server.Shutdown(ctx); err != nil {
+				logging.Errorf("Requests still running after %v, closing them: %v", config.ShutdownTimeout, err)
+				server.Close()
+			}
+			h.FinishHandOff()
+			h.StopGossiping()
+			if exporter := tracing.SetExporter(nil, nil); exporter != nil {
+				exporter.Close()
+			}
+			close(stopped)
+		})
+	}
+	h.ShutdownFunc = func() { shutdown("decommissioned") }
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		go func() {
+			<-signals
+			logging.Errorf("Second signal received, exiting without draining")
+			os.Exit(1)
+		}()
+		shutdown(sig.String())
+	}()
+	reloads := &reloader{loader: loader, current: config, handler: h}
+	h.ReloadFunc = reloads.reload
+	reloads.watchSignals()
+
 	h.StartGossiping()
+	go h.JoinCluster()
 
-	addr := ":" + config.Port
 	logging.Infof("Listening on %s...", config.Port)
 
-	err := http.ListenAndServe(addr, router)
+	err = server.ListenAndServe()
+	if err == http.ErrServerClosed {
+		<-stopped
+		logging.Infof("Server stopped")
+		return
+	}
 	if err != nil {
 		logging.Errorf("Server failed: %v", err)
 	}
 }
+
+func newTraceExporter(config Config) (tracing.Exporter, error) {
+	switch config.TraceExporter {
+	case "stdout":
+		return tracing.NewJSONExporter(os.Stdout), nil
+	case "file":
+		return tracing.NewFileExporter(config.TraceFile)
+	}
+	return nil, nil
+}
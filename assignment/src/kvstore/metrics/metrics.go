@@ -0,0 +1,140 @@
+// Package metrics implements counters, gauges and histograms with labels and
+// exposes them in the Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are latency buckets in seconds, from 1ms to 10s.
+var DefaultBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// family holds the series of one metric, keyed by their label values.
+type family struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	// bounds are the bucket upper bounds of a histogram.
+	bounds []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	// Histograms only.
+	buckets []uint64
+	count   uint64
+}
+
+func (f *family) get(labelValues []string) *series {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", f.name, len(f.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		f.series[key] = s
+	}
+	return s
+}
+
+type CounterVec struct {
+	f *family
+}
+
+// NewCounterVec registers a counter in the Default registry.
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	return &CounterVec{f: Default.register(name, help, "counter", labels)}
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		panic("metrics: counters cannot decrease")
+	}
+	c.f.mu.Lock()
+	c.f.get(labelValues).value += delta
+	c.f.mu.Unlock()
+}
+
+type GaugeVec struct {
+	f *family
+}
+
+// NewGaugeVec registers a gauge in the Default registry.
+func NewGaugeVec(name string, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{f: Default.register(name, help, "gauge", labels)}
+}
+
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	g.f.mu.Lock()
+	g.f.get(labelValues).value = value
+	g.f.mu.Unlock()
+}
+
+func (g *GaugeVec) Add(delta float64, labelValues ...string) {
+	g.f.mu.Lock()
+	g.f.get(labelValues).value += delta
+	g.f.mu.Unlock()
+}
+
+// Reset drops every series, for gauges that are rebuilt on each scrape.
+func (g *GaugeVec) Reset() {
+	g.f.mu.Lock()
+	g.f.series = make(map[string]*series)
+	g.f.mu.Unlock()
+}
+
+type HistogramVec struct {
+	f *family
+}
+
+// NewHistogramVec registers a histogram with the given upper bounds in the
+// Default registry.
+func NewHistogramVec(name string, help string, bounds []float64, labels ...string) *HistogramVec {
+	bounds = append([]float64(nil), bounds...)
+	sort.Float64s(bounds)
+	f := Default.register(name, help, "histogram", labels)
+	f.bounds = bounds
+	return &HistogramVec{f: f}
+}
+
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	h.f.mu.Lock()
+	defer h.f.mu.Unlock()
+	s := h.f.get(labelValues)
+	if s.buckets == nil {
+		s.buckets = make([]uint64, len(h.f.bounds))
+	}
+	for i, bound := range h.f.bounds {
+		if value <= bound {
+			s.buckets[i]++
+		}
+	}
+	s.count++
+	s.value += value
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return fmt.Sprint(v)
+}
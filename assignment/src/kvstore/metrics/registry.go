@@ -0,0 +1,134 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Registry holds metric families and the collectors that refresh gauges
+// before each scrape.
+type Registry struct {
+	mu         sync.Mutex
+	families   []*family
+	collectors []func()
+	// scrapeMu keeps collectors of concurrent scrapes apart.
+	scrapeMu sync.Mutex
+}
+
+var Default = &Registry{}
+
+func (r *Registry) register(name string, help string, kind string, labels []string) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, f := range r.families {
+		if f.name == name {
+			panic("metrics: " + name + " is registered twice")
+		}
+	}
+	f := &family{name: name, help: help, kind: kind, labels: labels, series: make(map[string]*series)}
+	r.families = append(r.families, f)
+	return f
+}
+
+// OnScrape registers collect to run before every scrape of the Default
+// registry, to set gauges that are cheaper to compute on demand.
+func OnScrape(collect func()) {
+	Default.mu.Lock()
+	Default.collectors = append(Default.collectors, collect)
+	Default.mu.Unlock()
+}
+
+// Handler serves the Default registry in the Prometheus text format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		out := bufio.NewWriter(w)
+		Default.Write(out)
+		out.Flush()
+	})
+}
+
+// Write runs the collectors and writes every family sorted by name.
+func (r *Registry) Write(w *bufio.Writer) {
+	r.scrapeMu.Lock()
+	defer r.scrapeMu.Unlock()
+	r.mu.Lock()
+	collectors := append([]func(){}, r.collectors...)
+	families := append([]*family{}, r.families...)
+	r.mu.Unlock()
+	for _, collect := range collectors {
+		collect()
+	}
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].name < families[j].name
+	})
+	for _, f := range families {
+		f.write(w)
+	}
+}
+
+func (f *family) write(w *bufio.Writer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := f.series[key]
+		labels := f.formatLabels(s.labelValues, "")
+		if f.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, labels, formatValue(s.value))
+			continue
+		}
+		for i, bound := range f.bounds {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, f.formatLabels(s.labelValues, formatValue(bound)), s.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, f.formatLabels(s.labelValues, "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.name, labels, formatValue(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", f.name, labels, s.count)
+	}
+}
+
+// formatLabels renders {name="value",...}, with le appended for histogram
+// buckets when it is not empty.
+func (f *family) formatLabels(values []string, le string) string {
+	if len(values) == 0 && le == "" {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range f.labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", name, escapeLabel(values[i]))
+	}
+	if le != "" {
+		if len(f.labels) > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "le=\"%s\"", le)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
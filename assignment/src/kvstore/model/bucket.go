@@ -0,0 +1,18 @@
+package model
+
+const DefaultBucket = "default"
+
+type Bucket struct {
+	Name         string `json:"name"`
+	Replicas     int    `json:"replicas"`
+	ReadQuorum   int    `json:"read_quorum"`
+	WriteQuorum  int    `json:"write_quorum"`
+	DefaultTTL   int64  `json:"default_ttl"`    // seconds, 0 means keys never expire
+	MaxValueSize int    `json:"max_value_size"` // bytes, 0 means unlimited
+	UpdatedAt    int64  `json:"updated_at"`
+
+	// Resolver names the conflict resolver for the bucket; PrefixResolvers
+	// overrides it for keys starting with a prefix, longest prefix first.
+	Resolver        string            `json:"resolver,omitempty"`
+	PrefixResolvers map[string]string `json:"prefix_resolvers,omitempty"`
+}
@@ -0,0 +1,18 @@
+package model
+
+import "strings"
+
+type Index struct {
+	Name      string `json:"name"`
+	Bucket    string `json:"bucket,omitempty"` // empty matches every bucket
+	Prefix    string `json:"prefix,omitempty"` // empty matches every key
+	Path      string `json:"path"`             // dotted JSON path, e.g. "user.email" or "tags.0"
+	UpdatedAt int64  `json:"updated_at"`
+}
+
+func (i Index) Matches(bucket string, key string) bool {
+	if i.Bucket != "" && i.Bucket != bucket {
+		return false
+	}
+	return strings.HasPrefix(key, i.Prefix)
+}
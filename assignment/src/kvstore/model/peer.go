@@ -2,7 +2,37 @@ package model
 
 import "time"
 
+type PeerState string
+
+const (
+	PeerAlive   PeerState = "alive"
+	PeerSuspect PeerState = "suspect"
+	PeerDead    PeerState = "dead"
+	PeerLeaving PeerState = "leaving" // handing off its data, still serving
+	PeerLeft    PeerState = "left"    // left gracefully, no failover needed
+)
+
 type PeerInfo struct {
-	URL      string
-	LastSeen time.Time
+	ID          string
+	URL         string
+	LastSeen    time.Time
+	State       PeerState
+	Incarnation uint64
+	Vnodes      int
+	Zone        string
+
+	// StateChanged, Intervals and heartbeats are local bookkeeping for the
+	// failure detector and are never gossiped.
+	StateChanged time.Time       `json:"-"`
+	Intervals    []time.Duration `json:"-"`
+	heartbeats   int
+}
+
+func (p *PeerInfo) IsAlive() bool {
+	return p.State == "" || p.State == PeerAlive
+}
+
+// IsGone reports whether the peer is no longer a cluster member.
+func (p *PeerInfo) IsGone() bool {
+	return p.State == PeerDead || p.State == PeerLeft
 }
@@ -0,0 +1,70 @@
+package model
+
+import (
+	"math"
+	"time"
+)
+
+const heartbeatWindow = 100
+
+// minHeartbeatStdDev keeps phi from exploding when heartbeats arrive with
+// almost no jitter, e.g. on a quiet LAN.
+const minHeartbeatStdDev = 100 * time.Millisecond
+
+// RecordHeartbeat notes that the peer was heard from at the given time and
+// keeps a sliding window of inter-arrival intervals.
+func (p *PeerInfo) RecordHeartbeat(now time.Time) {
+	if !p.LastSeen.IsZero() && now.After(p.LastSeen) && p.heartbeats > 0 {
+		p.Intervals = append(p.Intervals, now.Sub(p.LastSeen))
+		if len(p.Intervals) > heartbeatWindow {
+			p.Intervals = p.Intervals[len(p.Intervals)-heartbeatWindow:]
+		}
+	}
+	p.heartbeats++
+	p.LastSeen = now
+}
+
+func (p *PeerInfo) HeartbeatStats() (mean time.Duration, stdDev time.Duration) {
+	if len(p.Intervals) == 0 {
+		return 0, 0
+	}
+	var sum float64
+	for _, interval := range p.Intervals {
+		sum += float64(interval)
+	}
+	m := sum / float64(len(p.Intervals))
+	var variance float64
+	for _, interval := range p.Intervals {
+		d := float64(interval) - m
+		variance += d * d
+	}
+	variance /= float64(len(p.Intervals))
+	return time.Duration(m), time.Duration(math.Sqrt(variance))
+}
+
+// Phi is the phi-accrual suspicion level: -log10 of the probability that a
+// heartbeat arrives later than now given the observed inter-arrival times.
+// It returns false until enough heartbeats have been seen.
+func (p *PeerInfo) Phi(now time.Time) (float64, bool) {
+	if len(p.Intervals) < 2 {
+		return 0, false
+	}
+	mean, stdDev := p.HeartbeatStats()
+	if stdDev < minHeartbeatStdDev {
+		stdDev = minHeartbeatStdDev
+	}
+	elapsed := float64(now.Sub(p.LastSeen))
+	// Logistic approximation of the normal CDF, as used by Akka and Cassandra.
+	y := (elapsed - float64(mean)) / float64(stdDev)
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+	var phi float64
+	if elapsed > float64(mean) {
+		phi = -math.Log10(e / (1.0 + e))
+	} else {
+		phi = -math.Log10(1.0 - 1.0/(1.0+e))
+	}
+	if math.IsInf(phi, 1) || math.IsNaN(phi) {
+		phi = math.MaxFloat64
+	}
+	return phi, true
+}
@@ -0,0 +1,245 @@
+package model
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"sort"
+)
+
+// RingMember records whether a node owns vnodes in the ring and how many.
+// Version grows with every change to the entry, so the most recent decision
+// about a node always wins when two views are merged. Vnodes is always sent,
+// since every node must place a member with the same count; a member is only
+// active with a count of at least 1. An evicted node was removed by an
+// operator and stays out of the ring, even while alive, until it is
+// readmitted. Joined orders the members by when they were first seen, for
+// placements whose layout depends on join order; it never changes once set
+// and the lowest value wins when views disagree.
+type RingMember struct {
+	Active  bool   `json:"active"`
+	Evicted bool   `json:"evicted,omitempty"`
+	Vnodes  int    `json:"vnodes"`
+	Zone    string `json:"zone,omitempty"`
+	Version uint64 `json:"version"`
+	Joined  uint64 `json:"joined"`
+}
+
+// RingState is the cluster-wide ring membership. It is gossiped between
+// nodes and merged entry by entry, and its epoch is derived from the entry
+// versions so that identical states have identical epochs on every node.
+type RingState struct {
+	Epoch   uint64                 `json:"epoch"`
+	Members map[string]*RingMember `json:"members"`
+}
+
+// Set marks a node as in or out of the ring and reports whether anything
+// changed. A vnode count of zero keeps the node's current count, and a node
+// whose count is not known yet is not put into the ring. Evicted nodes are
+// not put back into the ring either.
+func (r *RingState) Set(id string, active bool, vnodes int) bool {
+	if r.Members == nil {
+		r.Members = make(map[string]*RingMember)
+	}
+	member, ok := r.Members[id]
+	if ok && active && member.Evicted {
+		return false
+	}
+	if vnodes < 1 && ok {
+		vnodes = member.Vnodes
+	}
+	if active && vnodes < 1 {
+		return false
+	}
+	if ok && member.Active == active && member.Vnodes == vnodes {
+		return false
+	}
+	if !ok {
+		member = &RingMember{Joined: r.Epoch + 1}
+		r.Members[id] = member
+	}
+	member.Active = active
+	if vnodes > 0 {
+		member.Vnodes = vnodes
+	}
+	member.Version++
+	r.updateEpoch()
+	return true
+}
+
+// Merge folds another view of the ring into this one. Higher versions win;
+// at equal versions removal wins, so concurrent decisions converge the same
+// way everywhere. It reports whether anything changed.
+func (r *RingState) Merge(other RingState) bool {
+	changed := false
+	for id, incoming := range other.Members {
+		if r.Members == nil {
+			r.Members = make(map[string]*RingMember)
+		}
+		// An active entry without a vnode count cannot be placed the
+		// same way everywhere, so it is ignored.
+		if incoming.Active && incoming.Vnodes < 1 {
+			continue
+		}
+		local, ok := r.Members[id]
+		if ok && (incoming.Version < local.Version ||
+			(incoming.Version == local.Version && (incoming.Active || !local.Active))) {
+			if incoming.Joined != 0 && (local.Joined == 0 || incoming.Joined < local.Joined) {
+				local.Joined = incoming.Joined
+				changed = true
+			}
+			continue
+		}
+		copied := *incoming
+		if ok && local.Joined != 0 && (copied.Joined == 0 || local.Joined < copied.Joined) {
+			copied.Joined = local.Joined
+		}
+		r.Members[id] = &copied
+		changed = true
+	}
+	if changed {
+		r.updateEpoch()
+	}
+	return changed
+}
+
+// Evict takes a node out of the ring until it is readmitted.
+func (r *RingState) Evict(id string) bool {
+	if r.Members == nil {
+		r.Members = make(map[string]*RingMember)
+	}
+	member, ok := r.Members[id]
+	if ok && member.Evicted {
+		return false
+	}
+	if !ok {
+		member = &RingMember{Joined: r.Epoch + 1}
+		r.Members[id] = member
+	}
+	member.Active = false
+	member.Evicted = true
+	member.Version++
+	r.updateEpoch()
+	return true
+}
+
+// Readmit lifts an eviction and puts the node back into the ring if it is
+// alive.
+func (r *RingState) Readmit(id string, alive bool) bool {
+	member, ok := r.Members[id]
+	if !ok || !member.Evicted {
+		return false
+	}
+	member.Evicted = false
+	member.Active = alive
+	member.Version++
+	r.updateEpoch()
+	return true
+}
+
+func (r *RingState) IsEvicted(id string) bool {
+	member, ok := r.Members[id]
+	return ok && member.Evicted
+}
+
+// Digest hashes the member table. Two views can reach the same epoch through
+// different changes, so nodes compare digests to tell such views apart.
+func (r *RingState) Digest() string {
+	ids := make([]string, 0, len(r.Members))
+	for id := range r.Members {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	h := sha1.New()
+	for _, id := range ids {
+		m := r.Members[id]
+		fmt.Fprintf(h, "%s|%t|%t|%d|%s|%d|%d\n", id, m.Active, m.Evicted, m.Vnodes, m.Zone, m.Version, m.Joined)
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+func (r *RingState) updateEpoch() {
+	var epoch uint64
+	for _, member := range r.Members {
+		epoch += member.Version
+	}
+	r.Epoch = epoch
+}
+
+// SetZone records the zone a node reported for zone-aware placement.
+func (r *RingState) SetZone(id string, zone string) bool {
+	member, ok := r.Members[id]
+	if !ok || member.Zone == zone {
+		return false
+	}
+	member.Zone = zone
+	member.Version++
+	r.updateEpoch()
+	return true
+}
+
+// Zones returns the zone of every node in the ring that reported one.
+func (r *RingState) Zones() map[string]string {
+	zones := make(map[string]string)
+	for id, member := range r.Members {
+		if member.Active && member.Zone != "" {
+			zones[id] = member.Zone
+		}
+	}
+	return zones
+}
+
+func (r *RingState) VnodesOf(id string) int {
+	if member, ok := r.Members[id]; ok {
+		return member.Vnodes
+	}
+	return 0
+}
+
+func (r *RingState) IsActive(id string) bool {
+	member, ok := r.Members[id]
+	return ok && member.Active
+}
+
+// ActiveMembers returns the IDs of the nodes in the ring, sorted.
+func (r *RingState) ActiveMembers() []string {
+	var ids []string
+	for id, member := range r.Members {
+		if member.Active {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// JoinOrder returns every node that was ever in the ring, including those
+// that left, oldest first, with its vnode count. Nodes seen at the same time
+// are ordered by ID.
+func (r *RingState) JoinOrder() ([]string, []int) {
+	ids := make([]string, 0, len(r.Members))
+	for id := range r.Members {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := r.Members[ids[i]], r.Members[ids[j]]
+		if a.Joined != b.Joined {
+			return a.Joined < b.Joined
+		}
+		return ids[i] < ids[j]
+	})
+	vnodes := make([]int, len(ids))
+	for i, id := range ids {
+		vnodes[i] = r.Members[id].Vnodes
+	}
+	return ids, vnodes
+}
+
+func (r *RingState) Clone() RingState {
+	clone := RingState{Epoch: r.Epoch, Members: make(map[string]*RingMember, len(r.Members))}
+	for id, member := range r.Members {
+		copied := *member
+		clone.Members[id] = &copied
+	}
+	return clone
+}
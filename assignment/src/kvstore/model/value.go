@@ -3,4 +3,18 @@ package model
 type ValueVersion struct {
 	Value     string `json:"value"`
 	Timestamp int64  `json:"timestamp"`
+	ExpiresAt int64  `json:"expires_at,omitempty"`
+	Type      string `json:"type,omitempty"` // crdt type, empty for plain values
+	Node      string `json:"node,omitempty"` // coordinator that accepted the write
+	// Base is the timestamp of the version the coordinator held when it
+	// accepted the write. The write replaces that version and older ones
+	// outright; only versions it had not seen go through the resolver.
+	Base int64 `json:"base,omitempty"`
+	// Deleted marks a tombstone: the key was deleted at Timestamp. Tombstones
+	// are replicated like writes so a stale replica cannot bring the key back.
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+func (v ValueVersion) Expired(now int64) bool {
+	return v.ExpiresAt != 0 && now >= v.ExpiresAt
 }
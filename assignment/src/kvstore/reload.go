@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"kvstore/handler"
+	"kvstore/logging"
+	"kvstore/tracing"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// reloader loads the configuration again on SIGHUP or POST /admin/reload and
+// applies the reloadable settings to the running node. Other settings that
+// changed are only reported, since they need a restart.
+type reloader struct {
+	mu      sync.Mutex
+	loader  *configLoader
+	current Config
+	handler *handler.Handler
+}
+
+func (r *reloader) watchSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			logging.Infof("SIGHUP received, reloading configuration")
+			if _, err := r.reload(nil); err != nil {
+				logging.Errorf("Reload failed, keeping the current configuration: %v", err)
+			}
+		}
+	}()
+}
+
+func (r *reloader) reload(overrides map[string]string) (handler.ReloadResponse, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	resp := handler.ReloadResponse{Changed: []string{}}
+	previous := r.loader.overrides
+	merged := make(map[string]string, len(previous)+len(overrides))
+	for name, raw := range previous {
+		merged[name] = raw
+	}
+	for name, raw := range overrides {
+		name = strings.ReplaceAll(strings.ToLower(name), "-", "_")
+		s, ok := settingNamed(name)
+		if !ok {
+			return resp, fmt.Errorf("unknown setting %q", name)
+		}
+		if !s.reloadable {
+			return resp, fmt.Errorf("%s cannot be changed without a restart", name)
+		}
+		merged[name] = raw
+	}
+
+	r.loader.overrides = merged
+	loaded, _, err := r.loader.load()
+	if err != nil {
+		r.loader.overrides = previous
+		return resp, err
+	}
+
+	next := r.current
+	for _, s := range settings {
+		old, value := s.get(&r.current), s.get(&loaded)
+		if old == value {
+			continue
+		}
+		if !s.reloadable {
+			resp.RestartRequired = append(resp.RestartRequired, s.name)
+			continue
+		}
+		s.set(&next, value)
+		resp.Changed = append(resp.Changed, fmt.Sprintf("%s=%s (was %s)", s.name, value, old))
+	}
+	if problems := next.validate(); len(problems) > 0 {
+		r.loader.overrides = previous
+		return resp, configError(problems)
+	}
+
+	r.handler.ApplySettings(next.runtimeSettings())
+	logging.SetDebug(next.Debug)
+	tracing.SetSampleRatio(next.TraceSampleRatio)
+	r.current = next
+
+	for _, change := range resp.Changed {
+		logging.Infof("Reloaded %s", change)
+	}
+	for _, name := range resp.RestartRequired {
+		logging.Infof("%s changed but only takes effect after a restart", name)
+	}
+	if len(resp.Changed) == 0 && len(resp.RestartRequired) == 0 {
+		logging.Infof("Reloaded configuration, nothing changed")
+	}
+	return resp, nil
+}
+
+func (c Config) runtimeSettings() handler.Settings {
+	return handler.Settings{
+		ReadQuorum:     c.ReadQuorum,
+		WriteQuorum:    c.WriteQuorum,
+		GossipInterval: c.GossipInterval,
+		PeerTimeout:    c.PeerTimeout,
+		PhiThreshold:   c.PhiThreshold,
+		RebalanceRate:  c.RebalanceRate,
+		CleanupDelay:   c.CleanupDelay,
+		CleanupDryRun:  c.CleanupDryRun,
+	}
+}
+
+func settingNamed(name string) (setting, bool) {
+	for _, s := range settings {
+		if s.name == name {
+			return s, true
+		}
+	}
+	return setting{}, false
+}
@@ -0,0 +1,112 @@
+package seed
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Source describes where a node finds the addresses of existing cluster
+// members when it starts. Any combination of a static list, a DNS name and
+// a seed file may be given; they are resolved again on every join attempt so
+// a changed DNS record or edited file is picked up while retrying.
+type Source struct {
+	Addresses []string
+	// DNSName is a host:port whose A/AAAA records each point at a seed,
+	// e.g. "kv-seeds.internal:8001".
+	DNSName string
+	// File lists one seed address per line; blank lines and lines starting
+	// with # are ignored.
+	File string
+}
+
+func (s Source) Empty() bool {
+	return len(s.Addresses) == 0 && s.DNSName == "" && s.File == ""
+}
+
+// Resolve returns the current seed addresses. Addresses that resolved are
+// returned even if another part of the source failed.
+func (s Source) Resolve() ([]string, error) {
+	unique := make(map[string]bool)
+	for _, address := range s.Addresses {
+		if address = strings.TrimSpace(address); address != "" {
+			unique[withScheme(address)] = true
+		}
+	}
+	var errs []string
+	if s.File != "" {
+		addresses, err := readFile(s.File)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+		for _, address := range addresses {
+			unique[address] = true
+		}
+	}
+	if s.DNSName != "" {
+		addresses, err := lookup(s.DNSName)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+		for _, address := range addresses {
+			unique[address] = true
+		}
+	}
+
+	addresses := make([]string, 0, len(unique))
+	for address := range unique {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	if len(errs) > 0 {
+		return addresses, fmt.Errorf("resolve seeds: %s", strings.Join(errs, "; "))
+	}
+	return addresses, nil
+}
+
+func readFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open seed file: %w", err)
+	}
+	defer f.Close()
+	var addresses []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		addresses = append(addresses, withScheme(line))
+	}
+	if err := scanner.Err(); err != nil {
+		return addresses, fmt.Errorf("read seed file: %w", err)
+	}
+	return addresses, nil
+}
+
+func lookup(name string) ([]string, error) {
+	host, port, err := net.SplitHostPort(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid seed dns name %q: %w", name, err)
+	}
+	ips, err := net.LookupHost(host)
+	if err != nil {
+		return nil, fmt.Errorf("lookup %s: %w", host, err)
+	}
+	addresses := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addresses = append(addresses, "http://"+net.JoinHostPort(ip, port))
+	}
+	return addresses, nil
+}
+
+func withScheme(address string) string {
+	if strings.Contains(address, "://") {
+		return address
+	}
+	return "http://" + address
+}
@@ -0,0 +1,90 @@
+package store
+
+import (
+	"kvstore/model"
+	"sort"
+	"time"
+)
+
+// Retention bounds how many prior versions of a key are kept. A zero field
+// disables that bound; the newest version is always kept.
+type Retention struct {
+	MaxVersions int
+	MaxAge      time.Duration
+}
+
+var DefaultRetention = Retention{MaxVersions: 10}
+
+// insertVersion adds value to a history sorted by timestamp, replacing any
+// version with the same timestamp so replays are idempotent.
+func insertVersion(history []model.ValueVersion, value model.ValueVersion) []model.ValueVersion {
+	i := sort.Search(len(history), func(i int) bool {
+		return history[i].Timestamp >= value.Timestamp
+	})
+	if i < len(history) && history[i].Timestamp == value.Timestamp {
+		history[i] = value
+		return history
+	}
+	history = append(history, model.ValueVersion{})
+	copy(history[i+1:], history[i:])
+	history[i] = value
+	return history
+}
+
+func (r Retention) prune(history []model.ValueVersion, now time.Time) []model.ValueVersion {
+	if r.MaxVersions > 0 && len(history) > r.MaxVersions {
+		history = history[len(history)-r.MaxVersions:]
+	}
+	if r.MaxAge > 0 {
+		cutoff := now.Add(-r.MaxAge).UnixNano()
+		i := sort.Search(len(history), func(i int) bool {
+			return history[i].Timestamp >= cutoff
+		})
+		if i == len(history) {
+			i = len(history) - 1
+		}
+		history = history[i:]
+	}
+	return append([]model.ValueVersion(nil), history...)
+}
+
+// PutHistory merges versions received from another replica into the key's
+// history without changing its current version.
+func (m *MemoryStore) PutHistory(bucket, key string, history []model.ValueVersion) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	versions, ok := m.history[bucket]
+	if !ok {
+		versions = make(map[string][]model.ValueVersion)
+		m.history[bucket] = versions
+	}
+	merged := versions[key]
+	for _, value := range history {
+		merged = insertVersion(merged, value)
+	}
+	versions[key] = m.retention.prune(merged, time.Now())
+}
+
+func (m *MemoryStore) History(bucket, key string) []model.ValueVersion {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]model.ValueVersion(nil), m.history[bucket][key]...)
+}
+
+// GetAt returns the version of a key that was current at the given time.
+func (m *MemoryStore) GetAt(bucket, key string, asOf int64) (model.ValueVersion, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	history := m.history[bucket][key]
+	i := sort.Search(len(history), func(i int) bool {
+		return history[i].Timestamp > asOf
+	})
+	if i == 0 {
+		return model.ValueVersion{}, false
+	}
+	val := history[i-1]
+	if val.Expired(asOf) {
+		return model.ValueVersion{}, false
+	}
+	return val, true
+}
@@ -0,0 +1,100 @@
+package store
+
+import (
+	"encoding/json"
+	"kvstore/model"
+	"strconv"
+	"strings"
+)
+
+type indexedKey struct {
+	Bucket string
+	Key    string
+}
+
+type secondaryIndex struct {
+	def     model.Index
+	entries map[string]map[indexedKey]struct{}
+	byKey   map[indexedKey]string
+}
+
+func newSecondaryIndex(def model.Index) *secondaryIndex {
+	return &secondaryIndex{
+		def:     def,
+		entries: make(map[string]map[indexedKey]struct{}),
+		byKey:   make(map[indexedKey]string),
+	}
+}
+
+func (idx *secondaryIndex) update(bucket string, key string, value model.ValueVersion) {
+	idx.remove(bucket, key)
+	if !idx.def.Matches(bucket, key) {
+		return
+	}
+	field, ok := ExtractJSONPath(value.Value, idx.def.Path)
+	if !ok {
+		return
+	}
+	k := indexedKey{Bucket: bucket, Key: key}
+	keys, ok := idx.entries[field]
+	if !ok {
+		keys = make(map[indexedKey]struct{})
+		idx.entries[field] = keys
+	}
+	keys[k] = struct{}{}
+	idx.byKey[k] = field
+}
+
+func (idx *secondaryIndex) remove(bucket string, key string) {
+	k := indexedKey{Bucket: bucket, Key: key}
+	field, ok := idx.byKey[k]
+	if !ok {
+		return
+	}
+	delete(idx.byKey, k)
+	delete(idx.entries[field], k)
+	if len(idx.entries[field]) == 0 {
+		delete(idx.entries, field)
+	}
+}
+
+// ExtractJSONPath walks a dotted path through a JSON document and returns the
+// value found there in a canonical string form. Numeric path segments index
+// into arrays.
+func ExtractJSONPath(raw string, path string) (string, bool) {
+	var doc interface{}
+	if err := json.Unmarshal([]byte(raw), &doc); err != nil {
+		return "", false
+	}
+	current := doc
+	for _, segment := range strings.Split(path, ".") {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			next, ok := node[segment]
+			if !ok {
+				return "", false
+			}
+			current = next
+		case []interface{}:
+			i, err := strconv.Atoi(segment)
+			if err != nil || i < 0 || i >= len(node) {
+				return "", false
+			}
+			current = node[i]
+		default:
+			return "", false
+		}
+	}
+	switch v := current.(type) {
+	case string:
+		return v, true
+	case nil:
+		return "", false
+	default:
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return "", false
+		}
+		return string(encoded), true
+	}
+}
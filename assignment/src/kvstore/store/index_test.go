@@ -0,0 +1,39 @@
+package store
+
+import "testing"
+
+func TestExtractJSONPath(t *testing.T) {
+	const doc = `{"user":{"email":"a@b.c","age":42,"admin":true,"tags":["x",{"name":"y"}],"manager":null}}`
+	cases := []struct {
+		name  string
+		raw   string
+		path  string
+		want  string
+		found bool
+	}{
+		{"top-level object", doc, "user.email", "a@b.c", true},
+		{"number", doc, "user.age", "42", true},
+		{"bool", doc, "user.admin", "true", true},
+		{"array element", doc, "user.tags.0", "x", true},
+		{"object inside array", doc, "user.tags.1.name", "y", true},
+		{"object value encoded", `{"a":{"b":1}}`, "a", `{"b":1}`, true},
+		{"array value encoded", `{"a":[1,2]}`, "a", `[1,2]`, true},
+		{"missing field", doc, "user.phone", "", false},
+		{"index out of range", doc, "user.tags.2", "", false},
+		{"negative index", doc, "user.tags.-1", "", false},
+		{"non-numeric index", doc, "user.tags.first", "", false},
+		{"null value", doc, "user.manager", "", false},
+		{"path through a string", doc, "user.email.domain", "", false},
+		{"top-level array", `["a","b"]`, "1", "b", true},
+		{"top-level string", `"plain"`, "a", "", false},
+		{"not json", `plain`, "a", "", false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, found := ExtractJSONPath(tc.raw, tc.path)
+			if got != tc.want || found != tc.found {
+				t.Errorf("ExtractJSONPath(%s, %q) = %q, %v, want %q, %v", tc.raw, tc.path, got, found, tc.want, tc.found)
+			}
+		})
+	}
+}
@@ -1,42 +1,200 @@
 package store
 
 import (
+	"kvstore/hash"
 	"kvstore/model"
+	"sort"
 	"sync"
+	"time"
 )
 
 type MemoryStore struct {
-	data map[string]model.ValueVersion
-	mu   sync.RWMutex
+	data      map[string]map[string]model.ValueVersion
+	history   map[string]map[string][]model.ValueVersion
+	retention Retention
+	indexes   map[string]*secondaryIndex
+	// tokens orders each bucket's keys by ring position once a TokenFunc is
+	// set.
+	tokens    map[string]*tokenIndex
+	tokenFunc TokenFunc
+	mu        sync.RWMutex
 }
 
 func NewMemoryStore() *MemoryStore {
+	return NewMemoryStoreWithRetention(DefaultRetention)
+}
+
+func NewMemoryStoreWithRetention(retention Retention) *MemoryStore {
 	return &MemoryStore{
-		data: make(map[string]model.ValueVersion),
+		data:      make(map[string]map[string]model.ValueVersion),
+		history:   make(map[string]map[string][]model.ValueVersion),
+		retention: retention,
+		indexes:   make(map[string]*secondaryIndex),
+		tokens:    make(map[string]*tokenIndex),
+	}
+}
+
+// SetTokenFunc indexes every key by the ring position fn gives it, so
+// KeysInRange can be used.
+func (m *MemoryStore) SetTokenFunc(fn TokenFunc) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tokenFunc = fn
+	m.tokens = make(map[string]*tokenIndex)
+	for bucket, keys := range m.data {
+		for key := range keys {
+			m.indexToken(bucket, key)
+		}
+	}
+}
+
+// indexToken adds a new key to its bucket's token index. The caller holds
+// m.mu for writing.
+func (m *MemoryStore) indexToken(bucket string, key string) {
+	if m.tokenFunc == nil {
+		return
+	}
+	idx, ok := m.tokens[bucket]
+	if !ok {
+		idx = newTokenIndex()
+		m.tokens[bucket] = idx
 	}
+	idx.add(m.tokenFunc(bucket, key), key)
 }
 
-func (m *MemoryStore) All() map[string]model.ValueVersion {
+func (m *MemoryStore) Buckets() []string {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
-	return m.data
+	buckets := make([]string, 0, len(m.data))
+	for bucket, keys := range m.data {
+		if len(keys) > 0 {
+			buckets = append(buckets, bucket)
+		}
+	}
+	sort.Strings(buckets)
+	return buckets
+}
+
+// KeysInRange returns the keys of bucket whose tokens fall in r, in ring
+// order. Expired keys are included; Get leaves them out.
+func (m *MemoryStore) KeysInRange(bucket string, r hash.TokenRange) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	idx, ok := m.tokens[bucket]
+	if !ok {
+		return nil
+	}
+	return idx.keysIn(r)
 }
 
-func (m *MemoryStore) Get(key string) (model.ValueVersion, bool) {
+func (m *MemoryStore) All() map[string]map[string]model.ValueVersion {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
-	val, ok := m.data[key]
+	now := time.Now().UnixNano()
+	all := make(map[string]map[string]model.ValueVersion, len(m.data))
+	for bucket, keys := range m.data {
+		copied := make(map[string]model.ValueVersion, len(keys))
+		for key, val := range keys {
+			if val.Expired(now) {
+				continue
+			}
+			copied[key] = val
+		}
+		all[bucket] = copied
+	}
+	return all
+}
+
+func (m *MemoryStore) Get(bucket, key string) (model.ValueVersion, bool) {
+	storeOperations.Inc("get")
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	val, ok := m.data[bucket][key]
+	if ok && val.Expired(time.Now().UnixNano()) {
+		return model.ValueVersion{}, false
+	}
 	return val, ok
 }
 
-func (m *MemoryStore) Put(key string, value model.ValueVersion) {
+// Put records value in the key's history and makes it the current version.
+// Callers resolve conflicts with the stored version before calling Put.
+func (m *MemoryStore) Put(bucket, key string, value model.ValueVersion) {
+	storeOperations.Inc("put")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	versions, ok := m.history[bucket]
+	if !ok {
+		versions = make(map[string][]model.ValueVersion)
+		m.history[bucket] = versions
+	}
+	versions[key] = m.retention.prune(insertVersion(versions[key], value), time.Now())
+
+	keys, ok := m.data[bucket]
+	if !ok {
+		keys = make(map[string]model.ValueVersion)
+		m.data[bucket] = keys
+	}
+	if previous, ok := keys[key]; ok {
+		storeBytes.Add(-entrySize(key, previous.Value), bucket)
+	} else {
+		storeKeys.Add(1, bucket)
+		m.indexToken(bucket, key)
+	}
+	storeBytes.Add(entrySize(key, value.Value), bucket)
+	keys[key] = value
+	for _, idx := range m.indexes {
+		idx.update(bucket, key, value)
+	}
+}
+
+func (m *MemoryStore) Delete(bucket, key string) {
+	storeOperations.Inc("delete")
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.data[key] = value
+	if previous, ok := m.data[bucket][key]; ok {
+		storeKeys.Add(-1, bucket)
+		storeBytes.Add(-entrySize(key, previous.Value), bucket)
+		if idx, ok := m.tokens[bucket]; ok {
+			idx.remove(m.tokenFunc(bucket, key), key)
+		}
+	}
+	delete(m.data[bucket], key)
+	delete(m.history[bucket], key)
+	for _, idx := range m.indexes {
+		idx.remove(bucket, key)
+	}
 }
 
-func (m *MemoryStore) Delete(key string) {
+func (m *MemoryStore) DefineIndex(def model.Index) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	delete(m.data, key)
+	idx := newSecondaryIndex(def)
+	for bucket, keys := range m.data {
+		for key, value := range keys {
+			idx.update(bucket, key, value)
+		}
+	}
+	m.indexes[def.Name] = idx
+}
+
+func (m *MemoryStore) Lookup(index string, field string) (map[string]map[string]model.ValueVersion, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	idx, ok := m.indexes[index]
+	if !ok {
+		return nil, false
+	}
+	now := time.Now().UnixNano()
+	result := make(map[string]map[string]model.ValueVersion)
+	for k := range idx.entries[field] {
+		val, ok := m.data[k.Bucket][k.Key]
+		if !ok || val.Expired(now) {
+			continue
+		}
+		if result[k.Bucket] == nil {
+			result[k.Bucket] = make(map[string]model.ValueVersion)
+		}
+		result[k.Bucket][k.Key] = val
+	}
+	return result, true
 }
@@ -0,0 +1,13 @@
+package store
+
+import "kvstore/metrics"
+
+var (
+	storeOperations = metrics.NewCounterVec("kvstore_store_operations_total", "Store operations by type.", "op")
+	storeKeys       = metrics.NewGaugeVec("kvstore_store_keys", "Keys held by this node, tombstones included, by bucket.", "bucket")
+	storeBytes      = metrics.NewGaugeVec("kvstore_store_bytes", "Size of the current keys and values held by this node, by bucket.", "bucket")
+)
+
+func entrySize(key string, value string) float64 {
+	return float64(len(key) + len(value))
+}
@@ -1,10 +1,21 @@
 package store
 
-import "kvstore/model"
+import (
+	"kvstore/hash"
+	"kvstore/model"
+)
 
 type KeyValueStore interface {
-	Get(key string) (value model.ValueVersion, ok bool)
-	Put(key string, value model.ValueVersion)
-	Delete(key string)
-	All() map[string]model.ValueVersion
+	Get(bucket, key string) (value model.ValueVersion, ok bool)
+	Put(bucket, key string, value model.ValueVersion)
+	Delete(bucket, key string)
+	GetAt(bucket, key string, asOf int64) (value model.ValueVersion, ok bool)
+	History(bucket, key string) []model.ValueVersion
+	PutHistory(bucket, key string, history []model.ValueVersion)
+	All() map[string]map[string]model.ValueVersion
+	// Buckets lists the buckets holding keys.
+	Buckets() []string
+	KeysInRange(bucket string, r hash.TokenRange) []string
+	DefineIndex(def model.Index)
+	Lookup(index string, field string) (map[string]map[string]model.ValueVersion, bool)
 }
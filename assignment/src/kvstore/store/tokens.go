@@ -0,0 +1,93 @@
+package store
+
+import (
+	"kvstore/hash"
+	"math"
+	"sort"
+)
+
+// TokenFunc returns the ring position of a key.
+type TokenFunc func(bucket string, key string) uint32
+
+// tokenIndex orders the keys of one bucket by ring position, so the keys of a
+// token range can be found without looking at the rest of the bucket. Keys
+// are kept in slots by the top bits of their token, each slot sorted by token
+// and key; a range only visits the slots it overlaps.
+type tokenIndex struct {
+	slots map[uint32][]tokenEntry
+}
+
+type tokenEntry struct {
+	token uint32
+	key   string
+}
+
+const tokenSlotBits = 16
+
+func newTokenIndex() *tokenIndex {
+	return &tokenIndex{slots: make(map[uint32][]tokenEntry)}
+}
+
+func slotOf(token uint32) uint32 {
+	return token >> (32 - tokenSlotBits)
+}
+
+func (e tokenEntry) less(other tokenEntry) bool {
+	if e.token != other.token {
+		return e.token < other.token
+	}
+	return e.key < other.key
+}
+
+func (idx *tokenIndex) add(token uint32, key string) {
+	entry := tokenEntry{token: token, key: key}
+	slot := idx.slots[slotOf(token)]
+	i := sort.Search(len(slot), func(i int) bool { return !slot[i].less(entry) })
+	if i < len(slot) && slot[i] == entry {
+		return
+	}
+	slot = append(slot, tokenEntry{})
+	copy(slot[i+1:], slot[i:])
+	slot[i] = entry
+	idx.slots[slotOf(token)] = slot
+}
+
+func (idx *tokenIndex) remove(token uint32, key string) {
+	entry := tokenEntry{token: token, key: key}
+	slot := idx.slots[slotOf(token)]
+	i := sort.Search(len(slot), func(i int) bool { return !slot[i].less(entry) })
+	if i == len(slot) || slot[i] != entry {
+		return
+	}
+	slot = append(slot[:i], slot[i+1:]...)
+	if len(slot) == 0 {
+		delete(idx.slots, slotOf(token))
+		return
+	}
+	idx.slots[slotOf(token)] = slot
+}
+
+// keysIn returns the keys in r in ring order, i.e. starting right after
+// r.Start and wrapping around past the highest token.
+func (idx *tokenIndex) keysIn(r hash.TokenRange) []string {
+	var keys []string
+	if r.Start < r.End {
+		return idx.keysBetween(keys, r.Start+1, r.End)
+	}
+	if r.Start != math.MaxUint32 {
+		keys = idx.keysBetween(keys, r.Start+1, math.MaxUint32)
+	}
+	return idx.keysBetween(keys, 0, r.End)
+}
+
+// keysBetween appends the keys with tokens from lo to hi, inclusive.
+func (idx *tokenIndex) keysBetween(keys []string, lo uint32, hi uint32) []string {
+	for slot := slotOf(lo); slot <= slotOf(hi); slot++ {
+		for _, entry := range idx.slots[slot] {
+			if entry.token >= lo && entry.token <= hi {
+				keys = append(keys, entry.key)
+			}
+		}
+	}
+	return keys
+}
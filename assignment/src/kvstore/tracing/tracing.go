@@ -0,0 +1,248 @@
+// Package tracing records spans of work across nodes. Span and trace ids and
+// their propagation follow W3C Trace Context, and exported spans carry the
+// OpenTelemetry field names, so traces can be loaded into OpenTelemetry
+// tooling offline.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceparentHeader carries the span context between nodes.
+const TraceparentHeader = "traceparent"
+
+type Kind string
+
+const (
+	KindServer   Kind = "server"
+	KindClient   Kind = "client"
+	KindInternal Kind = "internal"
+)
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+// SpanContext identifies a span across process boundaries.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Traceparent formats sc as a W3C traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+// ParseTraceparent parses a version 00 traceparent header value.
+func ParseTraceparent(value string) (SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return SpanContext{}, false
+	}
+	var sc SpanContext
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return SpanContext{}, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return SpanContext{}, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return SpanContext{}, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, sc.IsValid()
+}
+
+// Span is a timed operation. Its methods may be called on a nil *Span.
+type Span struct {
+	name   string
+	kind   Kind
+	sc     SpanContext
+	parent SpanID
+	start  time.Time
+
+	mu         sync.Mutex
+	attributes map[string]interface{}
+	err        string
+	ended      bool
+}
+
+type spanKey struct{}
+
+// FromContext returns the span stored in ctx, or nil.
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// Start begins a span as a child of the span in ctx, or of a new trace if
+// ctx holds none.
+func Start(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	var parent SpanContext
+	if span := FromContext(ctx); span != nil {
+		parent = span.sc
+	}
+	return StartWithParent(ctx, name, kind, parent)
+}
+
+// StartWithParent begins a span under a parent from another node, e.g. one
+// read from a traceparent header. An invalid parent starts a new trace,
+// which is sampled according to the configured ratio.
+func StartWithParent(ctx context.Context, name string, kind Kind, parent SpanContext) (context.Context, *Span) {
+	span := &Span{name: name, kind: kind, start: time.Now()}
+	if parent.IsValid() {
+		span.sc.TraceID = parent.TraceID
+		span.sc.Sampled = parent.Sampled
+		span.parent = parent.SpanID
+	} else {
+		rand.Read(span.sc.TraceID[:])
+		span.sc.Sampled = sample()
+	}
+	rand.Read(span.sc.SpanID[:])
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+// SetName renames the span, for servers that only know the route once the
+// request was routed.
+func (s *Span) SetName(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.name = name
+	s.mu.Unlock()
+}
+
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil || !s.sc.Sampled {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return
+	}
+	if s.attributes == nil {
+		s.attributes = make(map[string]interface{})
+	}
+	s.attributes[key] = value
+}
+
+// SetError marks the span as failed. A nil err is ignored.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.err = err.Error()
+	s.mu.Unlock()
+}
+
+// End finishes the span and hands it to the exporter if it is sampled.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	end := time.Now()
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	data := SpanData{
+		TraceID:    s.sc.TraceID.String(),
+		SpanID:     s.sc.SpanID.String(),
+		Name:       s.name,
+		Kind:       s.kind,
+		Start:      s.start.UnixNano(),
+		End:        end.UnixNano(),
+		Attributes: s.attributes,
+		Status:     Status{Code: "ok"},
+	}
+	if s.err != "" {
+		data.Status = Status{Code: "error", Message: s.err}
+	}
+	s.mu.Unlock()
+	if s.parent != (SpanID{}) {
+		data.ParentSpanID = s.parent.String()
+	}
+	if !s.sc.Sampled {
+		return
+	}
+	export(data)
+}
+
+// Inject writes the span context of ctx into header.
+func Inject(ctx context.Context, header http.Header) {
+	if span := FromContext(ctx); span != nil {
+		header.Set(TraceparentHeader, span.sc.Traceparent())
+	}
+}
+
+// Extract reads the span context a caller sent in header.
+func Extract(header http.Header) (SpanContext, bool) {
+	value := header.Get(TraceparentHeader)
+	if value == "" {
+		return SpanContext{}, false
+	}
+	return ParseTraceparent(value)
+}
+
+var (
+	configMu    sync.RWMutex
+	sampleRatio = 1.0
+)
+
+// SetSampleRatio sets the share of new traces that are recorded. Spans of
+// traces started elsewhere follow the caller's decision.
+func SetSampleRatio(ratio float64) {
+	configMu.Lock()
+	sampleRatio = ratio
+	configMu.Unlock()
+}
+
+func sample() bool {
+	configMu.RLock()
+	ratio := sampleRatio
+	exporting := exporter != nil
+	configMu.RUnlock()
+	if !exporting || ratio <= 0 {
+		return false
+	}
+	if ratio >= 1 {
+		return true
+	}
+	const precision = 1 << 30
+	n, err := rand.Int(rand.Reader, big.NewInt(precision))
+	return err == nil && float64(n.Int64()) < ratio*precision
+}
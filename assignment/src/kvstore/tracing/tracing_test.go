@@ -0,0 +1,57 @@
+package tracing
+
+import "testing"
+
+func TestParseTraceparent(t *testing.T) {
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	const spanID = "00f067aa0ba902b7"
+	cases := []struct {
+		name        string
+		value       string
+		ok          bool
+		wantSampled bool
+	}{
+		{"sampled", "00-" + traceID + "-" + spanID + "-01", true, true},
+		{"not sampled", "00-" + traceID + "-" + spanID + "-00", true, false},
+		{"other flags", "00-" + traceID + "-" + spanID + "-03", true, true},
+		{"surrounding space", " 00-" + traceID + "-" + spanID + "-01 ", true, true},
+		{"future version with more fields", "01-" + traceID + "-" + spanID + "-01-extra", true, true},
+		{"empty", "", false, false},
+		{"invalid version", "ff-" + traceID + "-" + spanID + "-01", false, false},
+		{"short trace id", "00-" + traceID[2:] + "-" + spanID + "-01", false, false},
+		{"short span id", "00-" + traceID + "-" + spanID[2:] + "-01", false, false},
+		{"missing flags", "00-" + traceID + "-" + spanID, false, false},
+		{"non-hex trace id", "00-" + "zz" + traceID[2:] + "-" + spanID + "-01", false, false},
+		{"non-hex flags", "00-" + traceID + "-" + spanID + "-zz", false, false},
+		{"zero trace id", "00-00000000000000000000000000000000-" + spanID + "-01", false, false},
+		{"zero span id", "00-" + traceID + "-0000000000000000-01", false, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			sc, ok := ParseTraceparent(tc.value)
+			if ok != tc.ok {
+				t.Fatalf("ParseTraceparent(%q) ok = %v, want %v", tc.value, ok, tc.ok)
+			}
+			if !ok {
+				return
+			}
+			if sc.TraceID.String() != traceID || sc.SpanID.String() != spanID {
+				t.Errorf("ParseTraceparent(%q) = %v/%v, want %v/%v", tc.value, sc.TraceID, sc.SpanID, traceID, spanID)
+			}
+			if sc.Sampled != tc.wantSampled {
+				t.Errorf("ParseTraceparent(%q) sampled = %v, want %v", tc.value, sc.Sampled, tc.wantSampled)
+			}
+		})
+	}
+}
+
+func TestTraceparentRoundTrip(t *testing.T) {
+	want := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, ok := ParseTraceparent(want)
+	if !ok {
+		t.Fatalf("ParseTraceparent(%q) failed", want)
+	}
+	if got := sc.Traceparent(); got != want {
+		t.Errorf("Traceparent() = %q, want %q", got, want)
+	}
+}